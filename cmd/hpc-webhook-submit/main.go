@@ -0,0 +1,49 @@
+// hpc-webhook-submit is the forced command for the HPC webhook server key in the authorized keys of a user.
+//
+// It reads a single structured request from stdin, performs it on behalf of the user,
+// and writes the result as JSON to stdout.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+
+	"github.com/Donders-Institute/hpc-webhook/internal/submit"
+)
+
+// maxRequestSize limits the size of the request read from stdin
+const maxRequestSize = 64 * 1024
+
+// runLogin runs the command in a login shell, to have the environment of the scheduler available.
+// The arguments are passed as positional parameters, so they are never interpreted by the shell.
+func runLogin(dir string, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command("bash", append([]string{"-l", "-c", `exec "$0" "$@"`, name}, args...)...)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+func main() {
+	var req submit.Request
+	var rsp submit.Response
+
+	cuser, err := user.Current()
+	if err != nil {
+		rsp.Error = err.Error()
+	} else if err = json.NewDecoder(io.LimitReader(os.Stdin, maxRequestSize)).Decode(&req); err != nil {
+		rsp.Error = "invalid request"
+	} else {
+		rsp = submit.Handle(cuser.HomeDir, req, runLogin)
+	}
+
+	if rsp.Error != "" {
+		fmt.Fprintf(os.Stderr, "hpc-webhook-submit: %s request for delivery %s failed: %s\n", req.Action, req.DeliveryID, rsp.Error)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(rsp); err != nil || rsp.Error != "" {
+		os.Exit(1)
+	}
+}
@@ -1,86 +1,172 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Donders-Institute/hpc-webhook/internal/config"
 	"github.com/Donders-Institute/hpc-webhook/internal/server"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 )
 
 func main() {
-	// Set HPC webhook server variables
-	hpcWebhookHost := os.Getenv("HPC_WEBHOOK_HOST")
-	hpcWebhookInternalPort := os.Getenv("HPC_WEBHOOK_INTERNAL_PORT")
-	hpcWebhookExternalPort := os.Getenv("HPC_WEBHOOK_EXTERNAL_PORT")
-	address := fmt.Sprintf("%s:%s", hpcWebhookHost, hpcWebhookInternalPort)
-	homeDir := os.Getenv("HOME_DIR")
-	dataDir := os.Getenv("DATA_DIR")
-	privateKeyFilename := os.Getenv("PRIVATE_KEY_FILE")
-	publicKeyFilename := os.Getenv("PUBLIC_KEY_FILE")
-
-	// Set target computer variables
-	relayNode := os.Getenv("RELAY_NODE")
-	relayNodeTestUser := os.Getenv("RELAY_NODE_TEST_USER")
-	relayNodeTestUserPassword := os.Getenv("RELAY_NODE_TEST_USER_PASSWORD")
-	connectionTimeoutSeconds, err := strconv.Atoi(os.Getenv("CONNECTION_TIMEOUT_SECONDS"))
+	// Read the configuration from the configuration file, the environment and the flags
+	cfg, options, err := config.Load(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if options.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if options.PrintConfig {
+		return
 	}
 
-	// Set the database variables
-	host := os.Getenv("POSTGRES_HOST")
-	port := os.Getenv("POSTGRES_PORT")
-	user := os.Getenv("POSTGRES_USER")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	dbname := os.Getenv("POSTGRES_DATABASE")
+	// Set the level and the format (text or json) of the log
+	err = server.SetupLogging(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.WithinContainer() {
+		log.Infof("Running within a container: listening on all interfaces, database host '%s'", cfg.Database.Host)
+	}
 
-	// Override settings if we run the server in a Docker container
-	if server.RunsWithinContainer() {
-		host = "db"
-		address = fmt.Sprintf("0.0.0.0:%s", hpcWebhookInternalPort)
+	// Export traces to the OTLP collector, configured with the standard OpenTelemetry variables
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider := server.SetupTracing(exporter)
+		defer provider.Shutdown(context.Background())
 	}
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	// Read the static token of the admin API from its secret file
+	var adminToken string
+	if cfg.Admin.TokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.Admin.TokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminToken = strings.TrimSpace(string(token))
+	}
 
-	db, err := server.InitDB(psqlInfo)
+	// Open the store selected by the scheme of the data source name
+	dataSourceName := cfg.DataSourceName()
+	if server.StoreScheme(dataSourceName) == server.StoreSchemeMemory {
+		log.Fatal("the memory store is meant for testing only, use PostgreSQL or SQLite")
+	}
+	store, db, err := server.OpenStore(dataSourceName, cfg.Host, cfg.ExternalPort)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	// Setup the app
 	api := server.API{
-		DB: db,
+		DB:    db,
+		Store: store,
 		Connector: server.SSHConnector{
 			Description: "SSH connection to relay node",
 		},
-		DataDir:                   dataDir,
-		HomeDir:                   homeDir,
-		RelayNode:                 relayNode,
-		RelayNodeTestUser:         relayNodeTestUser,
-		RelayNodeTestUserPassword: relayNodeTestUserPassword,
-		ConnectionTimeoutSeconds:  connectionTimeoutSeconds,
-		HPCWebhookHost:            hpcWebhookHost,
-		HPCWebhookInternalPort:    hpcWebhookInternalPort,
-		HPCWebhookExternalPort:    hpcWebhookExternalPort,
-		PrivateKeyFilename:        privateKeyFilename,
-		PublicKeyFilename:         publicKeyFilename,
+		DataDir:                   cfg.DataDir,
+		HomeDir:                   cfg.HomeDir,
+		RelayNode:                 cfg.RelayNode.Host,
+		RelayNodeTestUser:         cfg.RelayNode.TestUser,
+		RelayNodeTestUserPassword: cfg.RelayNode.TestUserPassword,
+		ConnectionTimeoutSeconds:  cfg.RelayNode.ConnectionTimeoutSeconds,
+		HPCWebhookHost:            cfg.Host,
+		HPCWebhookInternalPort:    cfg.InternalPort,
+		HPCWebhookExternalPort:    cfg.ExternalPort,
+		PrivateKeyFilename:        cfg.Keys.PrivateKeyFile,
+		PublicKeyFilename:         cfg.Keys.PublicKeyFile,
+		KeyPassphraseFilename:     cfg.Keys.PassphraseFile,
+		AgentSocket:               cfg.Keys.AgentSocket,
+		CAKeyFilename:             cfg.Keys.CAKeyFile,
+		CAPassphraseFilename:      cfg.Keys.CAPassphraseFile,
+		CASocket:                  cfg.Keys.CASocket,
+		CertValiditySeconds:       cfg.Keys.CertificateValiditySeconds,
+		AuthorizedKeyFrom:         cfg.Keys.AuthorizedKeyFrom,
+		AuthorizedKeyCommand:      cfg.Keys.AuthorizedKeyCommand,
+		TokenGracePeriodSeconds:   cfg.TokenGracePeriodSeconds,
+		AdminToken:                adminToken,
+		AdminClientNames:          cfg.Admin.ClientNames,
+		RelayProbeSeconds:         cfg.RelayNode.ProbeSeconds,
 	}
 
 	// Set the data dir and create it
 	err = os.MkdirAll(api.DataDir, os.ModePerm)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	app := &api
 
+	// Open the audit log file for appending
+	if cfg.AuditLogFile != "" {
+		auditLog, err := os.OpenFile(cfg.AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditLog.Close()
+		app.AuditLog = auditLog
+	}
+
+	// Bring the database schema up to date, unless it is migrated explicitly.
+	// The schema of an SQLite database is migrated when it is opened.
+	postgres := server.StoreScheme(dataSourceName) == server.StoreSchemePostgres
+	if postgres && cfg.Database.Migrate && (len(options.Args) == 0 || options.Args[0] != "migrate") {
+		if err := server.Migrate(db, server.LatestSchemaVersion()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Check the server key pair before it is handed out to users, unless the keys are held in ssh-agent.
+	// After a key rotation the keys in use are found in the database, rather than in the configuration.
+	if cfg.Keys.AgentSocket == "" {
+		if err := app.ValidateServerKeys(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Run an admin command instead of the server
+	if len(options.Args) > 0 {
+		if options.Args[0] == "migrate" && db == nil {
+			log.Fatal("the schema migrations apply to a PostgreSQL or SQLite database only")
+		}
+		runCommand(app, options.Args[0], options.Args[1:])
+		return
+	}
+
+	// Submit the deliveries that were left pending when the server stopped
+	if err := app.ResumeDeliveries(); err != nil {
+		log.Error(err)
+	}
+
+	// Remove expired webhooks in the background
+	go app.Janitor(time.Duration(cfg.JanitorIntervalSeconds) * time.Second)
+
 	r := mux.NewRouter()
 
 	// Handle external webhook payloads
@@ -91,6 +177,132 @@ func main() {
 	r.HandleFunc(server.ConfigurationInfoPath, app.ConfigurationInfoHandler).Methods("GET")
 	r.HandleFunc(server.ConfigurationListPath, app.ConfigurationListHandler).Methods("GET")
 	r.HandleFunc(server.ConfigurationDeletePath, app.ConfigurationDeleteHandler).Methods("DELETE")
+	r.HandleFunc(server.ConfigurationUpdatePath, app.ConfigurationUpdateHandler).Methods("PATCH")
+	r.HandleFunc(server.ConfigurationRotatePath, app.ConfigurationRotateHandler).Methods("POST")
+	r.HandleFunc(server.ConfigurationTestPath, app.ConfigurationTestHandler).Methods("POST")
+	r.HandleFunc(server.ConfigurationDoctorPath, app.ConfigurationDoctorHandler).Methods("POST")
 
-	log.Fatal(http.ListenAndServe(address, r))
+	// Handle the health checks
+	r.HandleFunc(server.HealthzPath, app.HealthzHandler).Methods("GET")
+	r.HandleFunc(server.ReadyzPath, app.ReadyzHandler).Methods("GET")
+
+	// The admin API and the metrics are served on an internal-only listener
+	internal := mux.NewRouter()
+
+	// Expose the metrics for Prometheus
+	internal.Handle(server.MetricsPath, promhttp.Handler()).Methods("GET")
+
+	// Handle the admin API
+	internal.HandleFunc(server.AdminWebhooksPath, app.AdminWebhooksHandler).Methods("GET")
+	internal.HandleFunc(server.AdminDisablePath, app.AdminDisableHandler).Methods("POST")
+	internal.HandleFunc(server.AdminUsersPath, app.AdminUsersHandler).Methods("GET")
+	internal.HandleFunc(server.AdminPayloadsPath, app.AdminPayloadsHandler).Methods("DELETE")
+	internal.HandleFunc(server.AdminAuditPath, app.AdminAuditHandler).Methods("GET")
+	internal.HandleFunc(server.AdminDeliveriesPath, app.AdminDeliveriesHandler).Methods("GET")
+
+	// Assign an id to every request for correlating the log
+	httpServer := &http.Server{Addr: cfg.ListenAddress(), Handler: server.RequestLogger(r)}
+	internalServer := &http.Server{Addr: cfg.AdminListenAddress(), Handler: server.RequestLogger(internal)}
+
+	// Serve over TLS when a certificate is given, accepting client certificates signed by the client CA
+	if cfg.TLS.CertFile != "" && cfg.TLS.ClientCAFile != "" {
+		clientCA, err := ioutil.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig := &tls.Config{ClientCAs: x509.NewCertPool()}
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(clientCA) {
+			log.Fatalf("no certificates in client CA file '%s'", cfg.TLS.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		httpServer.TLSConfig = tlsConfig
+		internalServer.TLSConfig = tlsConfig.Clone()
+	}
+
+	serveErr := make(chan error, 2)
+	for _, s := range []*http.Server{httpServer, internalServer} {
+		go func(s *http.Server) {
+			log.Infof("Listening on %s", s.Addr)
+			if cfg.TLS.CertFile == "" {
+				serveErr <- s.ListenAndServe()
+				return
+			}
+			serveErr <- s.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		}(s)
+	}
+
+	// Serve until the server is asked to stop
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Infof("Received %s, shutting down", sig)
+	}
+
+	// Stop accepting deliveries, and wait for the submissions in flight until the deadline.
+	// Unfinished deliveries remain pending, to be submitted when the server starts again, unless their job
+	// was being submitted. Those are marked as interrupted then, rather than submitted twice.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+	if err := internalServer.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+	// The submissions still in flight record their result in the store, so it is only closed once they have returned.
+	// Otherwise it is left open, and they are stopped along with the process.
+	if err := app.Shutdown(ctx); err != nil {
+		log.Warn(err)
+	} else if err := store.Close(); err != nil {
+		log.Error(err)
+	}
+	log.Info("Server stopped")
+}
+
+// runCommand runs an admin command with the configuration of the server
+func runCommand(app *server.API, command string, args []string) {
+	switch command {
+	case "rotate-keys":
+		// Replace the server key pair, or resume an unfinished rotation.
+		// Finish the rotation in a separate run, once the server uses the new key.
+		suffix := time.Now().Format("20060102150405")
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		keyType := flags.String("type", server.KeyTypeEd25519, "type of the new key pair (ed25519 or rsa)")
+		privateKeyFilename := flags.String("private-key", path.Join(app.DefaultKeyDir(), "hpc_webhook_private_key."+suffix), "file to write the new private key to")
+		publicKeyFilename := flags.String("public-key", path.Join(app.DefaultKeyDir(), "hpc_webhook_public_key."+suffix), "file to write the new public key to")
+		finish := flags.Bool("finish", false, "remove the previous key from the authorized keys, once the server uses the new key")
+		flags.Parse(args)
+
+		if *finish {
+			if err := app.FinishKeyRotation(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if err := app.RotateKeys(*keyType, *privateKeyFilename, *publicKeyFilename); err != nil {
+			log.Fatal(err)
+		}
+	case "migrate":
+		// Migrate the database schema up or down to a version, by default the latest one
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		version := flags.Int("to", server.LatestSchemaVersion(), "version to migrate the database schema to, 0 removes all tables")
+		status := flags.Bool("status", false, "only show the version of the database schema")
+		flags.Parse(args)
+
+		if !*status {
+			if err := server.Migrate(app.DB, *version); err != nil {
+				log.Fatal(err)
+			}
+		}
+		current, err := server.SchemaVersion(app.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Database schema at version %d, the latest version is %d", current, server.LatestSchemaVersion())
+	default:
+		log.Fatalf("unknown command '%s'", command)
+	}
 }
@@ -0,0 +1,459 @@
+// Package config implements the configuration of the HPC webhook server.
+//
+// The settings are read from a YAML or TOML file, of which the values are overridden by the environment
+// variables of the settings, which in turn are overridden by the command line flags.
+// Settings that are not given anywhere keep their defaults.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Donders-Institute/hpc-webhook/internal/server"
+	"github.com/Donders-Institute/hpc-webhook/internal/submit"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFileEnv is the environment variable with the configuration file, when it is not given as flag
+const ConfigFileEnv = "HPC_WEBHOOK_CONFIG"
+
+// Redacted replaces the values of secret settings when the configuration is printed
+const Redacted = "REDACTED"
+
+// Modes of the container override
+const (
+	ContainerAuto   = "auto"   // ContainerAuto applies the container override when the server runs within a Docker container
+	ContainerAlways = "always" // ContainerAlways always applies the container override
+	ContainerNever  = "never"  // ContainerNever never applies the container override
+)
+
+// Config is the configuration of the HPC webhook server.
+// Each setting can be given in the configuration file, by its environment variable, or by its flag.
+type Config struct {
+	Host         string `yaml:"host" toml:"host" env:"HPC_WEBHOOK_HOST" flag:"host" usage:"public host name of the server"`
+	InternalPort string `yaml:"internalPort" toml:"internalPort" env:"HPC_WEBHOOK_INTERNAL_PORT" flag:"internal-port" usage:"port the server listens on"`
+	ExternalPort string `yaml:"externalPort" toml:"externalPort" env:"HPC_WEBHOOK_EXTERNAL_PORT" flag:"external-port" usage:"port of the server for the outside world"`
+	HomeDir      string `yaml:"homeDir" toml:"homeDir" env:"HOME_DIR" flag:"home-dir" usage:"directory with the home directories of the users"`
+	DataDir      string `yaml:"dataDir" toml:"dataDir" env:"DATA_DIR" flag:"data-dir" usage:"directory for the payloads of the deliveries"`
+	LogLevel     string `yaml:"logLevel" toml:"logLevel" env:"LOG_LEVEL" flag:"log-level" usage:"level of the log: error, warn, info, debug or trace"`
+	LogFormat    string `yaml:"logFormat" toml:"logFormat" env:"LOG_FORMAT" flag:"log-format" usage:"format of the log: text or json"`
+	AuditLogFile string `yaml:"auditLogFile" toml:"auditLogFile" env:"AUDIT_LOG_FILE" flag:"audit-log-file" usage:"file receiving every entry of the audit trail as a JSON line"`
+
+	TokenGracePeriodSeconds int `yaml:"tokenGracePeriodSeconds" toml:"tokenGracePeriodSeconds" env:"TOKEN_GRACE_PERIOD_SECONDS" flag:"token-grace-period-seconds" usage:"period in which a rotated payload URL remains valid"`
+	JanitorIntervalSeconds  int `yaml:"janitorIntervalSeconds" toml:"janitorIntervalSeconds" env:"JANITOR_INTERVAL_SECONDS" flag:"janitor-interval-seconds" usage:"period between two removals of expired webhooks"`
+	ShutdownTimeoutSeconds  int `yaml:"shutdownTimeoutSeconds" toml:"shutdownTimeoutSeconds" env:"SHUTDOWN_TIMEOUT_SECONDS" flag:"shutdown-timeout-seconds" usage:"time the submissions in flight are given to finish when the server stops"`
+
+	Keys      KeysConfig      `yaml:"keys" toml:"keys"`
+	TLS       TLSConfig       `yaml:"tls" toml:"tls"`
+	Admin     AdminConfig     `yaml:"admin" toml:"admin"`
+	RelayNode RelayNodeConfig `yaml:"relayNode" toml:"relayNode"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	Container ContainerConfig `yaml:"container" toml:"container"`
+
+	withinContainer bool // The container override has been applied
+}
+
+// KeysConfig contains the settings of the SSH keys the server connects to the relay node with
+type KeysConfig struct {
+	PrivateKeyFile             string `yaml:"privateKeyFile" toml:"privateKeyFile" env:"PRIVATE_KEY_FILE" flag:"private-key-file" usage:"private key of the server"`
+	PublicKeyFile              string `yaml:"publicKeyFile" toml:"publicKeyFile" env:"PUBLIC_KEY_FILE" flag:"public-key-file" usage:"public key of the server, added to the authorized keys of the users"`
+	PassphraseFile             string `yaml:"passphraseFile" toml:"passphraseFile" env:"PRIVATE_KEY_PASSPHRASE_FILE" flag:"passphrase-file" usage:"secret file with the passphrase of the private key"`
+	AgentSocket                string `yaml:"agentSocket" toml:"agentSocket" env:"SSH_AUTH_SOCK" flag:"agent-socket" usage:"ssh-agent holding the server keys, used instead of the key files"`
+	CAKeyFile                  string `yaml:"caKeyFile" toml:"caKeyFile" env:"SSH_CA_KEY_FILE" flag:"ca-key-file" usage:"CA key signing short-lived user certificates"`
+	CAPassphraseFile           string `yaml:"caPassphraseFile" toml:"caPassphraseFile" env:"SSH_CA_KEY_PASSPHRASE_FILE" flag:"ca-passphrase-file" usage:"secret file with the passphrase of the CA key"`
+	CASocket                   string `yaml:"caSocket" toml:"caSocket" env:"SSH_CA_SOCKET" flag:"ca-socket" usage:"ssh-agent holding the CA key, used instead of the CA key file"`
+	CertificateValiditySeconds int    `yaml:"certificateValiditySeconds" toml:"certificateValiditySeconds" env:"SSH_CERTIFICATE_VALIDITY_SECONDS" flag:"certificate-validity-seconds" usage:"lifetime of the user certificates"`
+	AuthorizedKeyFrom          string `yaml:"authorizedKeyFrom" toml:"authorizedKeyFrom" env:"AUTHORIZED_KEY_FROM" flag:"authorized-key-from" usage:"host pattern the server connects from"`
+	AuthorizedKeyCommand       string `yaml:"authorizedKeyCommand" toml:"authorizedKeyCommand" env:"AUTHORIZED_KEY_COMMAND" flag:"authorized-key-command" usage:"forced command for the server key in the authorized keys"`
+}
+
+// TLSConfig contains the settings to serve over TLS
+type TLSConfig struct {
+	CertFile     string `yaml:"certFile" toml:"certFile" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"certificate of the server, to serve over TLS"`
+	KeyFile      string `yaml:"keyFile" toml:"keyFile" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"private key of the certificate of the server"`
+	ClientCAFile string `yaml:"clientCAFile" toml:"clientCAFile" env:"TLS_CLIENT_CA_FILE" flag:"tls-client-ca-file" usage:"CA verifying the client certificates"`
+}
+
+// AdminConfig contains the internal listener and the credentials of the admin API
+type AdminConfig struct {
+	Port        string   `yaml:"port" toml:"port" env:"ADMIN_PORT" flag:"admin-port" usage:"internal-only port serving the admin API and the metrics"`
+	TokenFile   string   `yaml:"tokenFile" toml:"tokenFile" env:"ADMIN_TOKEN_FILE" flag:"admin-token-file" usage:"secret file with the static token of the admin API"`
+	ClientNames []string `yaml:"clientNames" toml:"clientNames" env:"ADMIN_CLIENT_NAMES" flag:"admin-client-names" usage:"comma-separated common names of the client certificates allowed to use the admin API"`
+}
+
+// RelayNodeConfig contains the settings of the relay node the jobs are submitted on
+type RelayNodeConfig struct {
+	Host                     string `yaml:"host" toml:"host" env:"RELAY_NODE" flag:"relay-node" usage:"relay node the jobs are submitted on"`
+	ConnectionTimeoutSeconds int    `yaml:"connectionTimeoutSeconds" toml:"connectionTimeoutSeconds" env:"CONNECTION_TIMEOUT_SECONDS" flag:"connection-timeout-seconds" usage:"timeout of the SSH connections to the relay node"`
+	TestUser                 string `yaml:"testUser" toml:"testUser" env:"RELAY_NODE_TEST_USER" flag:"relay-node-test-user" usage:"user probing the relay node in the readiness check"`
+	TestUserPassword         string `yaml:"testUserPassword" toml:"testUserPassword" env:"RELAY_NODE_TEST_USER_PASSWORD" flag:"relay-node-test-user-password" usage:"password of the test user" secret:"true"`
+	ProbeSeconds             int    `yaml:"probeSeconds" toml:"probeSeconds" env:"RELAY_NODE_PROBE_SECONDS" flag:"relay-node-probe-seconds" usage:"period for which the probe of the relay node is reused"`
+}
+
+// DatabaseConfig contains the connection settings of the database
+type DatabaseConfig struct {
+	URL      string `yaml:"url" toml:"url" env:"DATABASE_URL" flag:"database-url" usage:"data source name selecting the store, postgres://..., sqlite:<file> or memory:, instead of the other connection settings" secret:"true"`
+	Host     string `yaml:"host" toml:"host" env:"POSTGRES_HOST" flag:"database-host" usage:"host of the database"`
+	Port     string `yaml:"port" toml:"port" env:"POSTGRES_PORT" flag:"database-port" usage:"port of the database"`
+	User     string `yaml:"user" toml:"user" env:"POSTGRES_USER" flag:"database-user" usage:"user of the database"`
+	Password string `yaml:"password" toml:"password" env:"POSTGRES_PASSWORD" flag:"database-password" usage:"password of the database user" secret:"true"`
+	Name     string `yaml:"name" toml:"name" env:"POSTGRES_DATABASE" flag:"database-name" usage:"name of the database"`
+	SSLMode  string `yaml:"sslMode" toml:"sslMode" env:"POSTGRES_SSLMODE" flag:"database-sslmode" usage:"SSL mode of the database connection"`
+	Migrate  bool   `yaml:"migrate" toml:"migrate" env:"DATABASE_MIGRATE" flag:"database-migrate" usage:"migrate the database schema to the latest version at startup"`
+}
+
+// ContainerConfig contains the override of the settings when the server runs within a Docker container:
+// the server listens on all interfaces, and connects to the database by the name of its service.
+type ContainerConfig struct {
+	Mode         string `yaml:"mode" toml:"mode" env:"CONTAINER_MODE" flag:"container-mode" usage:"apply the container override: auto, always or never"`
+	DatabaseHost string `yaml:"databaseHost" toml:"databaseHost" env:"CONTAINER_DATABASE_HOST" flag:"container-database-host" usage:"host of the database within the container network"`
+}
+
+// Options are the command line options that are not settings
+type Options struct {
+	ConfigFile  string   // File the configuration is read from
+	PrintConfig bool     // Print the configuration, with the secrets redacted, instead of running the server
+	Args        []string // Command and its arguments following the options
+}
+
+// Default returns the configuration with the default settings
+func Default() Config {
+	return Config{
+		InternalPort:            "5111",
+		ExternalPort:            "443",
+		HomeDir:                 "/home",
+		DataDir:                 "/data",
+		LogLevel:                "info",
+		LogFormat:               "text",
+		TokenGracePeriodSeconds: server.DefaultTokenGracePeriodSeconds,
+		JanitorIntervalSeconds:  server.DefaultJanitorIntervalSeconds,
+		ShutdownTimeoutSeconds:  server.DefaultShutdownTimeoutSeconds,
+		Keys: KeysConfig{
+			CertificateValiditySeconds: server.DefaultCertificateValiditySeconds,
+			AuthorizedKeyCommand:       submit.Command,
+		},
+		Admin: AdminConfig{
+			Port: "5112",
+		},
+		RelayNode: RelayNodeConfig{
+			ConnectionTimeoutSeconds: 30,
+			ProbeSeconds:             server.DefaultRelayProbeSeconds,
+		},
+		Database: DatabaseConfig{
+			Port:    "5432",
+			SSLMode: "disable",
+			Migrate: true,
+		},
+		Container: ContainerConfig{
+			Mode:         ContainerAuto,
+			DatabaseHost: "db",
+		},
+	}
+}
+
+// setting is a single setting of the configuration, with its names in the file, the environment and the flags
+type setting struct {
+	name   string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// settings lists the settings of the configuration, of which the values refer to the configuration itself
+func (c *Config) settings() []setting {
+	return appendSettings(nil, "", reflect.ValueOf(c).Elem())
+}
+
+func appendSettings(settings []setting, prefix string, v reflect.Value) []setting {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			settings = appendSettings(settings, name+".", v.Field(i))
+			continue
+		}
+		settings = append(settings, setting{
+			name:   name,
+			env:    field.Tag.Get("env"),
+			flag:   field.Tag.Get("flag"),
+			usage:  field.Tag.Get("usage"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return settings
+}
+
+// set parses the value of a setting given as text
+func (s setting) set(text string) error {
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(text)
+	case reflect.Int:
+		i, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", text)
+		}
+		s.value.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("invalid boolean '%s'", text)
+		}
+		s.value.SetBool(b)
+	case reflect.Slice:
+		var values []string
+		for _, value := range strings.Split(text, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		s.value.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", s.value.Type())
+	}
+	return nil
+}
+
+// flagValue records the value of a flag, to be applied after the file and the environment are read
+type flagValue struct {
+	text string
+	set  bool
+}
+
+func (f *flagValue) String() string {
+	return f.text
+}
+
+func (f *flagValue) Set(text string) error {
+	f.text = text
+	f.set = true
+	return nil
+}
+
+// Load reads the configuration from the command line arguments (without the program name),
+// the configuration file and the environment, and applies the container override.
+// The environment variables are looked up with getenv.
+func Load(args []string, getenv func(string) string, output io.Writer) (Config, Options, error) {
+	c := Default()
+	var options Options
+
+	// Parse the flags, which are applied last
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&options.ConfigFile, "config", getenv(ConfigFileEnv), "YAML or TOML file to read the configuration from")
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "print the configuration, with the secrets redacted, and exit")
+	settings := c.settings()
+	values := make([]flagValue, len(settings))
+	for i, s := range settings {
+		usage := s.usage
+		if s.env != "" {
+			usage = fmt.Sprintf("%s (%s)", usage, s.env)
+		}
+		flags.Var(&values[i], s.flag, usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return c, options, err
+	}
+	options.Args = flags.Args()
+
+	if options.ConfigFile != "" {
+		if err := c.readFile(options.ConfigFile); err != nil {
+			return c, options, err
+		}
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if text := getenv(s.env); text != "" {
+			if err := s.set(text); err != nil {
+				return c, options, fmt.Errorf("invalid environment variable %s: %s", s.env, err)
+			}
+		}
+	}
+	for i, s := range settings {
+		if values[i].set {
+			if err := s.set(values[i].text); err != nil {
+				return c, options, fmt.Errorf("invalid flag -%s: %s", s.flag, err)
+			}
+		}
+	}
+
+	c.applyContainer(server.RunsWithinContainer())
+	return c, options, nil
+}
+
+// readFile reads the settings in a YAML or TOML file, as told by its extension
+func (c *Config) readFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(data), c)
+		if undecoded := metadata.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown setting '%s'", undecoded[0])
+		}
+	default:
+		return fmt.Errorf("invalid configuration file '%s': expected a .yaml, .yml or .toml file", filename)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration file '%s': %s", filename, err)
+	}
+	return nil
+}
+
+// applyContainer overrides the listen address and the database host when the server runs within a container,
+// according to the container mode
+func (c *Config) applyContainer(runsWithinContainer bool) {
+	if c.Container.Mode == ContainerNever || (c.Container.Mode != ContainerAlways && !runsWithinContainer) {
+		return
+	}
+	c.Database.Host = c.Container.DatabaseHost
+	c.withinContainer = true
+}
+
+// WithinContainer reports whether the container override has been applied
+func (c Config) WithinContainer() bool {
+	return c.withinContainer
+}
+
+// ListenAddress returns the address the server listens on
+func (c Config) ListenAddress() string {
+	if c.withinContainer {
+		return net.JoinHostPort("0.0.0.0", c.InternalPort)
+	}
+	return net.JoinHostPort(c.Host, c.InternalPort)
+}
+
+// AdminListenAddress returns the internal-only address serving the admin API and the metrics.
+// Within a container it is reachable from the container network, as long as the port is not published.
+func (c Config) AdminListenAddress() string {
+	if c.withinContainer {
+		return net.JoinHostPort("0.0.0.0", c.Admin.Port)
+	}
+	return net.JoinHostPort("localhost", c.Admin.Port)
+}
+
+// DataSourceName returns the connection string of the database, of which the scheme selects the store
+func (c Config) DataSourceName() string {
+	if c.Database.URL != "" {
+		return c.Database.URL
+	}
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Database.Host, c.Database.Port, c.Database.User, c.Database.Password, c.Database.Name, c.Database.SSLMode)
+}
+
+// Validate checks all settings, and reports every invalid one
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(c.Host != "", "host: the public host name of the server is required")
+	check(isValidPort(c.InternalPort), "internalPort: invalid port '%s'", c.InternalPort)
+	check(isValidPort(c.ExternalPort), "externalPort: invalid port '%s'", c.ExternalPort)
+	check(isValidPort(c.Admin.Port), "admin.port: invalid port '%s'", c.Admin.Port)
+	check(c.Admin.Port != c.InternalPort, "admin.port: must differ from the internal port")
+	check(c.HomeDir != "", "homeDir: the directory with the home directories is required")
+	check(c.DataDir != "", "dataDir: the directory for the payloads is required")
+	_, err := log.ParseLevel(c.LogLevel)
+	check(err == nil, "logLevel: invalid level '%s'", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "logFormat: invalid format '%s', expected text or json", c.LogFormat)
+	check(c.TokenGracePeriodSeconds >= 0, "tokenGracePeriodSeconds: must not be negative")
+	check(c.JanitorIntervalSeconds > 0, "janitorIntervalSeconds: must be positive")
+	check(c.ShutdownTimeoutSeconds >= 0, "shutdownTimeoutSeconds: must not be negative")
+
+	check(c.Keys.AgentSocket != "" || c.Keys.PrivateKeyFile != "", "keys.privateKeyFile: the private key is required, unless the keys are held in ssh-agent")
+	check(c.Keys.AgentSocket != "" || c.Keys.PublicKeyFile != "", "keys.publicKeyFile: the public key is required, unless the keys are held in ssh-agent")
+	check(c.Keys.CertificateValiditySeconds > 0, "keys.certificateValiditySeconds: must be positive")
+	check(c.Keys.AuthorizedKeyCommand != "", "keys.authorizedKeyCommand: the forced command is required")
+	check(c.Keys.CAPassphraseFile == "" || c.Keys.CAKeyFile != "", "keys.caPassphraseFile: the passphrase requires a CA key file")
+	check((c.Keys.CAKeyFile == "" && c.Keys.CASocket == "") || c.Keys.AuthorizedKeyFrom == "" || isValidSourceAddress(c.Keys.AuthorizedKeyFrom),
+		"keys.authorizedKeyFrom: the source address of the user certificates requires addresses or CIDR ranges, got '%s'", c.Keys.AuthorizedKeyFrom)
+
+	check(c.TLS.CertFile == "" || c.TLS.KeyFile != "", "tls.keyFile: the private key of the certificate is required")
+	check(c.TLS.KeyFile == "" || c.TLS.CertFile != "", "tls.certFile: the certificate of the private key is required")
+	check(c.TLS.ClientCAFile == "" || c.TLS.CertFile != "", "tls.clientCAFile: client certificates require serving over TLS")
+
+	check(c.RelayNode.Host != "", "relayNode.host: the relay node is required")
+	check(c.RelayNode.ConnectionTimeoutSeconds > 0, "relayNode.connectionTimeoutSeconds: must be positive")
+	check(c.RelayNode.ProbeSeconds >= 0, "relayNode.probeSeconds: must not be negative")
+
+	if c.Database.URL == "" {
+		check(c.Database.Host != "", "database.host: the host of the database is required")
+		check(isValidPort(c.Database.Port), "database.port: invalid port '%s'", c.Database.Port)
+		check(c.Database.User != "", "database.user: the user of the database is required")
+		check(c.Database.Name != "", "database.name: the name of the database is required")
+	}
+
+	check(c.Container.Mode == ContainerAuto || c.Container.Mode == ContainerAlways || c.Container.Mode == ContainerNever,
+		"container.mode: invalid mode '%s', expected auto, always or never", c.Container.Mode)
+	check(c.Container.Mode == ContainerNever || c.Container.DatabaseHost != "", "container.databaseHost: the host of the database within the container network is required")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Check that a port is a number in the valid range
+func isValidPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
+
+// Check the comma-separated list of addresses and CIDR ranges of the source-address option of a user certificate
+func isValidSourceAddress(addresses string) bool {
+	for _, address := range strings.Split(addresses, ",") {
+		if _, _, err := net.ParseCIDR(address); err != nil && net.ParseIP(address) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Redact returns a copy of the configuration in which the values of the secret settings are replaced
+func (c Config) Redact() Config {
+	for _, s := range c.settings() {
+		if s.secret && s.value.String() != "" {
+			s.value.SetString(Redacted)
+		}
+	}
+	return c
+}
+
+// Print writes the configuration as YAML, with the secrets redacted
+func (c Config) Print(w io.Writer) error {
+	data, err := yaml.Marshal(c.Redact())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,326 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write a configuration file in a test directory, which is removed by the returned function
+func writeConfigFile(t *testing.T, filename string, content string) (string, func()) {
+	dir := path.Join("..", "..", "test", "results", "config")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename = path.Join(dir, filename)
+	err = ioutil.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Obtain the environment variables from a map
+func environment(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename, remove := writeConfigFile(t, "server.yaml", `
+host: hpc-webhook.dccn.nl
+relayNode:
+  host: relaynode.dccn.nl
+database:
+  host: localhost
+  user: postgres
+  password: secret
+  name: hpc_webhook_db
+admin:
+  clientNames: [admin1, admin2]
+`)
+	defer remove()
+
+	env := map[string]string{
+		"POSTGRES_HOST":  "db.dccn.nl",
+		"RELAY_NODE":     "relaynode2.dccn.nl",
+		"CONTAINER_MODE": ContainerNever,
+	}
+	args := []string{"-config", filename, "-relay-node", "relaynode3.dccn.nl", "-database-migrate", "false", "rotate-keys", "-type", "rsa"}
+
+	c, options, err := Load(args, environment(env), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment overrides the file, and the flags override the environment
+	if c.Host != "hpc-webhook.dccn.nl" {
+		t.Errorf("Expected host from the file, but got '%s'", c.Host)
+	}
+	if c.Database.Host != "db.dccn.nl" {
+		t.Errorf("Expected database host from the environment, but got '%s'", c.Database.Host)
+	}
+	if c.RelayNode.Host != "relaynode3.dccn.nl" {
+		t.Errorf("Expected relay node from the flags, but got '%s'", c.RelayNode.Host)
+	}
+	if c.Database.Migrate {
+		t.Errorf("Expected the migration at startup to be disabled by the flags")
+	}
+	if !reflect.DeepEqual(c.Admin.ClientNames, []string{"admin1", "admin2"}) {
+		t.Errorf("Expected admin client names from the file, but got %v", c.Admin.ClientNames)
+	}
+
+	// Settings that are not given keep their defaults
+	if c.InternalPort != "5111" || c.RelayNode.ConnectionTimeoutSeconds != 30 {
+		t.Errorf("Expected the default port and connection timeout, but got '%s' and %d", c.InternalPort, c.RelayNode.ConnectionTimeoutSeconds)
+	}
+
+	// The command follows the options
+	if !reflect.DeepEqual(options.Args, []string{"rotate-keys", "-type", "rsa"}) {
+		t.Errorf("Expected the command and its arguments, but got %v", options.Args)
+	}
+	if c.ListenAddress() != "hpc-webhook.dccn.nl:5111" {
+		t.Errorf("Expected to listen on the host, but got '%s'", c.ListenAddress())
+	}
+	if c.AdminListenAddress() != "localhost:5112" {
+		t.Errorf("Expected the admin API to listen on localhost only, but got '%s'", c.AdminListenAddress())
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	filename, remove := writeConfigFile(t, "server.toml", `
+host = "hpc-webhook.dccn.nl"
+shutdownTimeoutSeconds = 10
+
+[relayNode]
+host = "relaynode.dccn.nl"
+`)
+	defer remove()
+
+	c, _, err := Load([]string{"-config", filename}, environment(nil), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "hpc-webhook.dccn.nl" || c.RelayNode.Host != "relaynode.dccn.nl" || c.ShutdownTimeoutSeconds != 10 {
+		t.Errorf("Expected the settings from the file, but got %+v", c)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []struct {
+		filename string
+		content  string
+		env      map[string]string
+		args     []string
+	}{
+		{
+			filename: "server.yaml",
+			content:  "hostname: hpc-webhook.dccn.nl\n", // Unknown setting
+		},
+		{
+			filename: "server.toml",
+			content:  "[relay]\nhost = \"relaynode.dccn.nl\"\n", // Unknown setting
+		},
+		{
+			filename: "server.json",
+			content:  "{}", // Unsupported format
+		},
+		{
+			filename: "server.yaml",
+			env:      map[string]string{"CONNECTION_TIMEOUT_SECONDS": "thirty"}, // Invalid number
+		},
+		{
+			filename: "server.yaml",
+			args:     []string{"-janitor-interval-seconds", "hourly"}, // Invalid number
+		},
+		{
+			filename: "server.yaml",
+			args:     []string{"-unknown"}, // Unknown flag
+		},
+	}
+
+	for i, c := range cases {
+		filename, remove := writeConfigFile(t, c.filename, c.content)
+		args := append([]string{"-config", filename}, c.args...)
+		if _, _, err := Load(args, environment(c.env), ioutil.Discard); err == nil {
+			t.Errorf("Test case %d: expected an error", i)
+		}
+		remove()
+	}
+}
+
+// validConfig returns a configuration with every required setting
+func validConfig() Config {
+	c := Default()
+	c.Host = "hpc-webhook.dccn.nl"
+	c.Keys.PrivateKeyFile = "/run/secrets/hpc_webhook_private_key"
+	c.Keys.PublicKeyFile = "/run/secrets/hpc_webhook_public_key"
+	c.RelayNode.Host = "relaynode.dccn.nl"
+	c.Database.Host = "localhost"
+	c.Database.User = "postgres"
+	c.Database.Name = "hpc_webhook_db"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		modify         func(c *Config)
+		expectedResult bool
+	}{
+		{
+			modify:         func(c *Config) {},
+			expectedResult: true, // Valid configuration
+		},
+		{
+			modify: func(c *Config) {
+				c.Keys.PrivateKeyFile, c.Keys.PublicKeyFile, c.Keys.AgentSocket = "", "", "/run/ssh-agent.sock"
+			},
+			expectedResult: true, // Keys held in ssh-agent
+		},
+		{
+			modify: func(c *Config) {
+				c.Database.URL, c.Database.Host, c.Database.User = "sqlite:/data/hpc-webhook.db", "", ""
+			},
+			expectedResult: true, // Store given by its data source name
+		},
+		{
+			modify:         func(c *Config) { c.Host = "" },
+			expectedResult: false, // Missing host
+		},
+		{
+			modify:         func(c *Config) { c.InternalPort = "70000" },
+			expectedResult: false, // Invalid port
+		},
+		{
+			modify:         func(c *Config) { c.Admin.Port = c.InternalPort },
+			expectedResult: false, // Admin API on the public port
+		},
+		{
+			modify:         func(c *Config) { c.LogLevel = "verbose" },
+			expectedResult: false, // Invalid log level
+		},
+		{
+			modify:         func(c *Config) { c.RelayNode.ConnectionTimeoutSeconds = 0 },
+			expectedResult: false, // Missing connection timeout
+		},
+		{
+			modify: func(c *Config) {
+				c.Keys.CAKeyFile, c.Keys.CAPassphraseFile, c.Keys.AuthorizedKeyFrom = "/run/secrets/ca", "/run/secrets/ca-passphrase", "10.0.0.0/8,192.168.1.5"
+			},
+			expectedResult: true, // User certificates restricted to source addresses
+		},
+		{
+			modify:         func(c *Config) { c.Keys.CAKeyFile, c.Keys.AuthorizedKeyFrom = "/run/secrets/ca", "*.dccn.nl" },
+			expectedResult: false, // Host pattern as source address of the user certificates
+		},
+		{
+			modify:         func(c *Config) { c.Keys.CAPassphraseFile = "/run/secrets/ca-passphrase" },
+			expectedResult: false, // CA passphrase without CA key file
+		},
+		{
+			modify:         func(c *Config) { c.TLS.CertFile = "/run/secrets/tls.crt" },
+			expectedResult: false, // Certificate without private key
+		},
+		{
+			modify:         func(c *Config) { c.Container.Mode = "sometimes" },
+			expectedResult: false, // Invalid container mode
+		},
+	}
+
+	for i, c := range cases {
+		config := validConfig()
+		c.modify(&config)
+		err := config.Validate()
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Test case %d: expected result %v, but got error '%v'", i, c.expectedResult, err)
+		}
+	}
+
+	// Every invalid setting is reported
+	config := validConfig()
+	config.Host = ""
+	config.Database.User = ""
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "host:") || !strings.Contains(err.Error(), "database.user:") {
+		t.Errorf("Expected the host and the database user to be reported, but got '%v'", err)
+	}
+}
+
+func TestApplyContainer(t *testing.T) {
+	cases := []struct {
+		mode                string
+		runsWithinContainer bool
+		expectedOverride    bool
+	}{
+		{ContainerAuto, true, true},
+		{ContainerAuto, false, false},
+		{ContainerAlways, false, true},
+		{ContainerNever, true, false},
+	}
+
+	for i, c := range cases {
+		config := validConfig()
+		config.Container.Mode = c.mode
+		config.applyContainer(c.runsWithinContainer)
+
+		if config.WithinContainer() != c.expectedOverride {
+			t.Errorf("Test case %d: expected override %v, but got %v", i, c.expectedOverride, config.WithinContainer())
+		}
+		if c.expectedOverride && (config.Database.Host != "db" || config.ListenAddress() != "0.0.0.0:5111" || config.AdminListenAddress() != "0.0.0.0:5112") {
+			t.Errorf("Test case %d: expected the container database host and listen address, but got '%s' and '%s'", i, config.Database.Host, config.ListenAddress())
+		}
+		if !c.expectedOverride && (config.Database.Host != "localhost" || config.ListenAddress() != "hpc-webhook.dccn.nl:5111") {
+			t.Errorf("Test case %d: expected the configured database host and listen address, but got '%s' and '%s'", i, config.Database.Host, config.ListenAddress())
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	config := validConfig()
+	config.Database.Password = "s3cr3t"
+	config.RelayNode.TestUserPassword = "password"
+
+	var b bytes.Buffer
+	if err := config.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	printed := b.String()
+	if strings.Contains(printed, "s3cr3t") || strings.Contains(printed, "password: password") {
+		t.Errorf("Expected the secrets to be redacted, but got:\n%s", printed)
+	}
+	if !strings.Contains(printed, "password: "+Redacted) || !strings.Contains(printed, "host: relaynode.dccn.nl") {
+		t.Errorf("Expected the redacted configuration, but got:\n%s", printed)
+	}
+
+	// The configuration itself is not changed
+	if config.Database.Password != "s3cr3t" {
+		t.Errorf("Expected the password to be kept, but got '%s'", config.Database.Password)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("..", "..", "configs", "hpc-webhook-server.yaml.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename, remove := writeConfigFile(t, "server.yaml", string(content))
+	defer remove()
+
+	c, _, err := Load([]string{"-config", filename}, environment(nil), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
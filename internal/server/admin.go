@@ -0,0 +1,436 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFailureWindowSeconds is the period in which failed deliveries count as recent failures,
+// unless requested otherwise
+const DefaultFailureWindowSeconds = 24 * 60 * 60
+
+// DefaultPayloadRetentionSeconds is the age from which payload files are purged, unless requested otherwise.
+// Younger payloads may still be waiting for their coalescing window to close.
+const DefaultPayloadRetentionSeconds = MaxCoalesceSeconds
+
+// AdminWebhooksResponse contains the webhooks of all users matching the filter
+type AdminWebhooksResponse struct {
+	Webhooks []Item `json:"webhooks"`
+}
+
+// AdminDisableResponse contains the webhook after it has been disabled
+type AdminDisableResponse struct {
+	Webhook Item `json:"webhook"`
+}
+
+// AdminUsersResponse contains the delivery statistics per user, counting failures since a certain time
+type AdminUsersResponse struct {
+	Since string      `json:"since"`
+	Users []UserStats `json:"users"`
+}
+
+// AdminPayloadsResponse contains the number of payload files that have been purged
+type AdminPayloadsResponse struct {
+	Purged int `json:"purged"`
+}
+
+// AdminAuditResponse contains the entries of the audit trail matching the query
+type AdminAuditResponse struct {
+	Records []AuditRecord `json:"records"`
+}
+
+// AdminDeliveriesResponse contains the deliveries matching the query
+type AdminDeliveriesResponse struct {
+	Deliveries []DeliveryRecord `json:"deliveries"`
+}
+
+// authorizeAdmin checks the credentials of a request to the admin API:
+// the static admin token as bearer token, or a verified client certificate of an allowed common name
+func (a *API) authorizeAdmin(req *http.Request) error {
+	if a.AdminToken == "" && len(a.AdminClientNames) == 0 {
+		return errors.New("admin API is not configured")
+	}
+
+	if a.AdminToken != "" {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1 {
+			return nil
+		}
+	}
+
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, name := range a.AdminClientNames {
+			if commonName == name {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("invalid admin credentials")
+}
+
+// Check the method and the credentials of a request to the admin API, and write the error response
+func (a *API) checkAdminRequest(w http.ResponseWriter, req *http.Request, method string) bool {
+	if !strings.EqualFold(req.Method, method) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		requestLogger(req).Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return false
+	}
+
+	if err := a.authorizeAdmin(req); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		requestLogger(req).Warnf("Error 401 - Unauthorized: %s", err)
+		fmt.Fprint(w, "Error 401 - Unauthorized: ", err)
+		return false
+	}
+	return true
+}
+
+// Write the JSON response of an admin request
+func writeAdminResponse(w http.ResponseWriter, response interface{}) {
+	js, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+func parseAdminWebhooksRequest(req *http.Request) (WebhookFilter, error) {
+	query := req.URL.Query()
+	filter := WebhookFilter{
+		Groupname: query.Get("groupname"),
+		Username:  query.Get("username"),
+	}
+	if s := query.Get("enabled"); s != "" {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return filter, fmt.Errorf("invalid enabled filter '%s'", s)
+		}
+		filter.Enabled = &enabled
+	}
+	return filter, nil
+}
+
+func parseAdminDisableRequest(req *http.Request) (string, error) {
+	// Check the URL path
+	if !isValidAdminDisableURLPath(req.URL.Path) {
+		return "", fmt.Errorf("invalid URL path '%s'", req.URL.Path)
+	}
+	return path.Base(path.Dir(req.URL.Path)), nil
+}
+
+func parseAdminAuditRequest(req *http.Request) (AuditFilter, error) {
+	query := req.URL.Query()
+	filter := AuditFilter{
+		Hash:     query.Get("webhook"),
+		Username: query.Get("username"),
+		Trace:    query.Get("trace"),
+		From:     query.Get("from"),
+		To:       query.Get("to"),
+	}
+	if filter.Hash != "" && !isValidWebhookID(filter.Hash) {
+		return filter, fmt.Errorf("invalid webhook id '%s'", filter.Hash)
+	}
+	if filter.Trace != "" && !isValidTraceID(filter.Trace) {
+		return filter, fmt.Errorf("invalid trace id '%s'", filter.Trace)
+	}
+	for _, t := range []string{filter.From, filter.To} {
+		if _, err := time.Parse(time.RFC3339, t); t != "" && err != nil {
+			return filter, fmt.Errorf("invalid time '%s': must be a RFC3339 time", t)
+		}
+	}
+	return filter, nil
+}
+
+func parseAdminDeliveriesRequest(req *http.Request) (DeliveryFilter, error) {
+	query := req.URL.Query()
+	filter := DeliveryFilter{
+		Hash:   query.Get("webhook"),
+		Status: query.Get("status"),
+		Trace:  query.Get("trace"),
+	}
+	if filter.Hash != "" && !isValidWebhookID(filter.Hash) {
+		return filter, fmt.Errorf("invalid webhook id '%s'", filter.Hash)
+	}
+	if filter.Trace != "" && !isValidTraceID(filter.Trace) {
+		return filter, fmt.Errorf("invalid trace id '%s'", filter.Trace)
+	}
+	return filter, nil
+}
+
+// Parse a period in seconds from the query, falling back to a default when it is not given
+func parseQuerySeconds(req *http.Request, key string, defaultSeconds int) (time.Duration, error) {
+	s := req.URL.Query().Get(key)
+	if s == "" {
+		return time.Duration(defaultSeconds) * time.Second, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", key, s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Remove the payload files modified before a certain time, of a single user if given.
+// The payloads of the deliveries that are still to be submitted are kept, whatever their age.
+// Returns the number of removed files.
+func purgePayloads(payloadsDir string, username string, before time.Time, pending map[string]bool) (int, error) {
+	if username != "" {
+		if strings.ContainsAny(username, `/\`) || username == "." || username == ".." {
+			return 0, fmt.Errorf("invalid username '%s'", username)
+		}
+		payloadsDir = path.Join(payloadsDir, username)
+	}
+
+	purged := 0
+	err := filepath.Walk(payloadsDir, func(filename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !info.ModTime().Before(before) || pending[info.Name()] {
+			return nil
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// AdminWebhooksHandler handles a HTTP GET request
+// to list the webhooks of all users, optionally filtered by groupname, username and enabled
+func (a *API) AdminWebhooksHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "GET") {
+		return
+	}
+
+	// Parse and validate the request
+	filter, err := parseAdminWebhooksRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Get the list of webhooks
+	list, err := a.store().FilterWebhooks(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	writeAdminResponse(w, AdminWebhooksResponse{Webhooks: list})
+}
+
+// AdminDisableHandler handles a HTTP POST request
+// to disable a certain webhook, regardless of its owner
+func (a *API) AdminDisableHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "POST") {
+		return
+	}
+
+	// Parse and validate the request
+	hash, err := parseAdminDisableRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Find the owner of the webhook
+	list, err := a.store().GetWebhookByHash(hash)
+	if err == nil && len(list) == 0 {
+		err = fmt.Errorf("webhook '%s' does not exist", hash)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	item := list[0]
+
+	// Disable the webhook
+	now := time.Now()
+	err = a.store().SetWebhookEnabled(item.Hash, item.Groupname, item.Username, false)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	item.Enabled = false
+	a.audit(item.Hash, item.Username, AuditActionDisable, "disabled by admin", requestSource(req), now)
+	logger.WithField("webhook", item.Hash).Info("Webhook disabled by admin")
+
+	// Succes
+	writeAdminResponse(w, AdminDisableResponse{Webhook: item})
+}
+
+// AdminUsersHandler handles a HTTP GET request
+// to obtain the queue depth and the recent failures of every user with webhooks
+func (a *API) AdminUsersHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "GET") {
+		return
+	}
+
+	// Parse and validate the request
+	window, err := parseQuerySeconds(req, "windowSeconds", DefaultFailureWindowSeconds)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Get the statistics
+	since := time.Now().Add(-window).Format(time.RFC3339)
+	users, err := a.store().UserStats(since)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	writeAdminResponse(w, AdminUsersResponse{Since: since, Users: users})
+}
+
+// AdminPayloadsHandler handles a HTTP DELETE request
+// to purge the stale payload files, optionally of a single user
+func (a *API) AdminPayloadsHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "DELETE") {
+		return
+	}
+
+	// Parse and validate the request
+	age, err := parseQuerySeconds(req, "olderThanSeconds", DefaultPayloadRetentionSeconds)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Find the deliveries of which the payload is still needed
+	deliveries, err := a.store().PendingDeliveries()
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	pending := make(map[string]bool, len(deliveries))
+	for _, delivery := range deliveries {
+		pending[delivery.Delivery] = true
+	}
+
+	// Remove the payload files
+	purged, err := purgePayloads(path.Join(a.DataDir, "payloads"), req.URL.Query().Get("username"), time.Now().Add(-age), pending)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	logger.Infof("%d payloads purged by admin", purged)
+
+	// Succes
+	writeAdminResponse(w, AdminPayloadsResponse{Purged: purged})
+}
+
+// AdminAuditHandler handles a HTTP GET request
+// to query the audit trail, optionally by webhook, user and time range
+func (a *API) AdminAuditHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "GET") {
+		return
+	}
+
+	// Parse and validate the request
+	filter, err := parseAdminAuditRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Get the audit entries
+	records, err := a.store().AuditRecords(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	writeAdminResponse(w, AdminAuditResponse{Records: records})
+}
+
+// AdminDeliveriesHandler handles a HTTP GET request
+// to query the delivery history, optionally by webhook, status and trace
+func (a *API) AdminDeliveriesHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	if !a.checkAdminRequest(w, req, "GET") {
+		return
+	}
+
+	// Parse and validate the request
+	filter, err := parseAdminDeliveriesRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Get the deliveries
+	deliveries, err := a.store().Deliveries(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	writeAdminResponse(w, AdminDeliveriesResponse{Deliveries: deliveries})
+}
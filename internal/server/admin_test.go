@@ -0,0 +1,310 @@
+package server
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAdminWebhooksHandler(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+
+	cases := []struct {
+		method         string
+		adminURL       string
+		headerInfo     map[string]string
+		expectedArgs   []driver.Value
+		expectedStatus int
+		expectedString string
+		expectedResult bool
+	}{
+		{
+			method:   "GET",
+			adminURL: "/admin/webhooks?username=username&enabled=true",
+			headerInfo: map[string]string{
+				"Authorization": "Bearer admintoken",
+			},
+			expectedArgs:   []driver.Value{"username", true},
+			expectedStatus: 200,
+			expectedResult: true, // No error
+		},
+		{
+			method:   "GET",
+			adminURL: "/admin/webhooks",
+			headerInfo: map[string]string{
+				"Authorization": "Bearer wrongtoken",
+			},
+			expectedStatus: 401,
+			expectedString: `Error 401 - Unauthorized: invalid admin credentials`,
+			expectedResult: false, // Invalid token
+		},
+		{
+			method:   "GET",
+			adminURL: "/admin/webhooks?enabled=maybe",
+			headerInfo: map[string]string{
+				"Authorization": "Bearer admintoken",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid enabled filter 'maybe'`,
+			expectedResult: false, // Invalid filter
+		},
+		{
+			method:   "POST",
+			adminURL: "/admin/webhooks",
+			headerInfo: map[string]string{
+				"Authorization": "Bearer admintoken",
+			},
+			expectedStatus: 405,
+			expectedString: `Error 405 - Method not allowed: invalid method: POST`,
+			expectedResult: false, // Invalid method
+		},
+	}
+
+	for _, c := range cases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		api := API{
+			DB:                     db,
+			HPCWebhookHost:         "hpc-webhook.dccn.nl",
+			HPCWebhookInternalPort: "5111",
+			HPCWebhookExternalPort: "443",
+			AdminToken:             "admintoken",
+		}
+		app := &api
+
+		req, err := http.NewRequest(c.method, c.adminURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range c.headerInfo {
+			req.Header.Set(key, value)
+		}
+
+		if c.expectedResult {
+			expectedRows := sqlmock.NewRows(itemColumnNames).
+				AddRow(1, hash, "groupname", "username", "", "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", hash, nil)
+			mock.ExpectQuery(`^SELECT (.+) FROM hpc_webhook WHERE username = \$1 AND enabled = \$2 ORDER BY id$`).
+				WithArgs(c.expectedArgs...).
+				WillReturnRows(expectedRows)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminWebhooksHandler)
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, c.expectedStatus)
+			return
+		}
+
+		if !c.expectedResult {
+			// Check the expected string
+			if rr.Body.String() != c.expectedString {
+				t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), c.expectedString)
+			}
+			continue
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("handler returned wrong content type: got %v want application/json", contentType)
+		}
+		var response AdminWebhooksResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Webhooks) != 1 || response.Webhooks[0].Hash != hash {
+			t.Errorf("handler returned unexpected webhooks: %+v", response.Webhooks)
+		}
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestAdminDisableHandler(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	api := API{
+		DB:                     db,
+		HPCWebhookHost:         "hpc-webhook.dccn.nl",
+		HPCWebhookInternalPort: "5111",
+		HPCWebhookExternalPort: "443",
+		AdminToken:             "admintoken",
+	}
+	app := &api
+
+	req, err := http.NewRequest("POST", "/admin/webhooks/"+hash+"/disable", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admintoken")
+
+	expectedRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, "groupname", "username", "", "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", hash, nil)
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook WHERE hash = \\$1$").
+		WithArgs(hash).
+		WillReturnRows(expectedRows)
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook SET enabled").
+		WithArgs(false, hash, "groupname", "username").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, "username", AuditActionDisable, "disabled by admin", sqlmock.AnyArg(), "", AnyTimeString{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.AdminDisableHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+	var response AdminDisableResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Webhook.Hash != hash || response.Webhook.Enabled {
+		t.Errorf("handler returned unexpected webhook: %+v", response.Webhook)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminDeliveriesHandler(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	trace := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	store := NewMemoryStore("hpc-webhook.dccn.nl", "443")
+	if err := store.AddDelivery("delivery1", hash, "2019-03-11T19:44:44+01:00", DeliveryStatusSubmitted, trace, "github"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddDelivery("delivery2", hash, "2019-03-11T19:45:44+01:00", DeliveryStatusFailed, "", "github"); err != nil {
+		t.Fatal(err)
+	}
+	app := &API{Store: store, AdminToken: "admintoken"}
+
+	cases := []struct {
+		query              string
+		expectedStatus     int
+		expectedDeliveries []string
+	}{
+		{"", http.StatusOK, []string{"delivery1", "delivery2"}},
+		{"?trace=" + trace, http.StatusOK, []string{"delivery1"}},
+		{"?webhook=" + hash + "&status=" + DeliveryStatusFailed, http.StatusOK, []string{"delivery2"}},
+		{"?trace=invalid", http.StatusNotFound, nil},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", "/admin/deliveries"+c.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer admintoken")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminDeliveriesHandler)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("Test case %d: handler returned wrong status code: got %v want %v", i, status, c.expectedStatus)
+			continue
+		}
+		if c.expectedStatus != http.StatusOK {
+			continue
+		}
+		var response AdminDeliveriesResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		var deliveries []string
+		for _, d := range response.Deliveries {
+			deliveries = append(deliveries, d.Delivery)
+		}
+		if !reflect.DeepEqual(deliveries, c.expectedDeliveries) {
+			t.Errorf("Test case %d: expected deliveries %v, but got %v", i, c.expectedDeliveries, deliveries)
+		}
+	}
+}
+
+func TestPurgePayloads(t *testing.T) {
+	payloadsDir := path.Join("..", "..", "test", "results", "data", "payloads")
+	defer func() {
+		if err := os.RemoveAll(payloadsDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// A stale payload of two users, a fresh one that may still be coalescing,
+	// and a stale one of which the delivery is still pending
+	now := time.Now()
+	payloads := []struct {
+		username string
+		delivery string
+		modified time.Time
+	}{
+		{"dccnuser", "delivery1", now.Add(-2 * time.Hour)},
+		{"dccnuser", "delivery2", now},
+		{"otheruser", "delivery3", now.Add(-2 * time.Hour)},
+		{"otheruser", "delivery4", now.Add(-2 * time.Hour)},
+	}
+	pending := map[string]bool{"delivery4": true}
+	for _, p := range payloads {
+		filename := path.Join(payloadsDir, p.username, p.delivery)
+		if err := os.MkdirAll(path.Dir(filename), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, p.modified, p.modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := purgePayloads(payloadsDir, "dccnuser", now.Add(-time.Hour), pending)
+	if err != nil || purged != 1 {
+		t.Errorf("Expected 1 payload of the user purged, but got %d (%v)", purged, err)
+	}
+	purged, err = purgePayloads(payloadsDir, "", now.Add(-time.Hour), pending)
+	if err != nil || purged != 1 {
+		t.Errorf("Expected 1 payload of the other user purged, but got %d (%v)", purged, err)
+	}
+	if _, err := os.Stat(path.Join(payloadsDir, "dccnuser", "delivery2")); err != nil {
+		t.Errorf("Expected the fresh payload to be kept, but got %s", err)
+	}
+	if _, err := os.Stat(path.Join(payloadsDir, "otheruser", "delivery4")); err != nil {
+		t.Errorf("Expected the payload of the pending delivery to be kept, but got %s", err)
+	}
+
+	if _, err := purgePayloads(payloadsDir, "..", now, pending); err == nil {
+		t.Errorf("Expected an error for an invalid username")
+	}
+}
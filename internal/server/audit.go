@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditSourceJanitor is the source of the actions of the janitor in the audit trail
+const AuditSourceJanitor = "janitor"
+
+// AuditSourceResume is the source of the deliveries resumed at startup in the audit trail
+const AuditSourceResume = "resume"
+
+// maxAuditFieldLength is the size of the detail and source columns of the audit trail, in characters
+const maxAuditFieldLength = 255
+
+// requestSource returns the address a request originates from.
+// As the server usually runs behind a reverse proxy, the forwarded addresses are included.
+func requestSource(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return fmt.Sprintf("%s via %s", forwarded, host)
+	}
+	return host
+}
+
+// Shorten a text to fit in a column of the audit trail, without splitting a character
+func truncateAuditField(s string) string {
+	if utf8.RuneCountInString(s) <= maxAuditFieldLength {
+		return s
+	}
+	return string([]rune(s)[:maxAuditFieldLength])
+}
+
+// Record an action in the audit trail, and in the audit log file when configured.
+// Failures are logged only.
+func (a *API) audit(hash string, username string, action string, detail string, source string, now time.Time) {
+	a.addAudit(AuditRecord{
+		Hash:     hash,
+		Username: username,
+		Action:   action,
+		Detail:   truncateAuditField(detail),
+		Source:   truncateAuditField(source),
+		Created:  now.Format(time.RFC3339),
+	})
+}
+
+// Record a delivery in the audit trail, with the trace it is processed in
+func (a *API) auditDelivery(hash string, username string, detail string, source string, trace string, now time.Time) {
+	a.addAudit(AuditRecord{
+		Hash:     hash,
+		Username: username,
+		Action:   AuditActionDeliver,
+		Detail:   truncateAuditField(detail),
+		Source:   truncateAuditField(source),
+		Trace:    trace,
+		Created:  now.Format(time.RFC3339),
+	})
+}
+
+func (a *API) addAudit(record AuditRecord) {
+	if err := a.store().AddAudit(record); err != nil {
+		log.Error(err)
+	}
+
+	if a.AuditLog == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	a.auditLogMutex.Lock()
+	defer a.auditLogMutex.Unlock()
+	if _, err := a.AuditLog.Write(append(line, '\n')); err != nil {
+		log.Error(err)
+	}
+}
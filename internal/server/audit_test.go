@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectAudit expects an action to be recorded in the audit trail
+func expectAudit(mock sqlmock.Sqlmock, hash string, username string, action string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, username, action, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), AnyTimeString{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestRequestSource(t *testing.T) {
+	cases := []struct {
+		remoteAddr     string
+		forwardedFor   string
+		expectedSource string
+	}{
+		{"192.168.1.10:51234", "", "192.168.1.10"},
+		{"[2001:db8::1]:51234", "", "2001:db8::1"},
+		{"10.0.0.2:443", "131.174.44.1", "131.174.44.1 via 10.0.0.2"},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("POST", "/webhook", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+
+		if source := requestSource(req); source != c.expectedSource {
+			t.Errorf("Expected source '%s', but got '%s'", c.expectedSource, source)
+		}
+	}
+}
+
+func TestTruncateAuditField(t *testing.T) {
+	cases := []struct {
+		field          string
+		expectedResult string
+	}{
+		{"131.174.44.1", "131.174.44.1"},
+		{strings.Repeat("a", 300), strings.Repeat("a", 255)},
+		{strings.Repeat("é", 255), strings.Repeat("é", 255)}, // 510 bytes, but 255 characters
+		{strings.Repeat("é", 300), strings.Repeat("é", 255)},
+	}
+
+	for i, c := range cases {
+		result := truncateAuditField(c.field)
+		if result != c.expectedResult || !utf8.ValidString(result) {
+			t.Errorf("Test case %d: expected '%s', but got '%s'", i, c.expectedResult, result)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	now := time.Date(2019, 3, 11, 19, 44, 44, 0, time.UTC)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var auditLog bytes.Buffer
+	api := API{
+		DB:       db,
+		AuditLog: &auditLog,
+	}
+	app := &api
+
+	// Long details are shortened to fit in the audit trail
+	detail := strings.Repeat("x", 300)
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, "dccnuser", AuditActionAdd, detail[:255], "192.168.1.10", "", now.Format(time.RFC3339)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	app.audit(hash, "dccnuser", AuditActionAdd, detail, "192.168.1.10", now)
+
+	var record AuditRecord
+	if err := json.Unmarshal(auditLog.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a JSON line in the audit log, but got '%s': %s", auditLog.String(), err)
+	}
+	expected := AuditRecord{
+		Hash:     hash,
+		Username: "dccnuser",
+		Action:   AuditActionAdd,
+		Detail:   detail[:255],
+		Source:   "192.168.1.10",
+		Created:  now.Format(time.RFC3339),
+	}
+	if record != expected {
+		t.Errorf("Expected audit log record %+v, but got %+v", expected, record)
+	}
+	if !strings.HasSuffix(auditLog.String(), "}\n") {
+		t.Errorf("Expected the audit log record to end with a newline")
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetAuditRows(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	filter := AuditFilter{
+		Username: "dccnuser",
+		From:     "2019-03-11T00:00:00Z",
+		To:       "2019-03-12T00:00:00Z",
+	}
+	rows := sqlmock.NewRows([]string{"id", "hash", "username", "action", "detail", "source", "trace", "created"}).
+		AddRow(1, hash, "dccnuser", AuditActionAdd, "group dccngroup", "192.168.1.10", "                                ", "2019-03-11T19:44:44Z").
+		AddRow(2, "                                    ", "dccnuser", AuditActionList, "1 webhooks", "192.168.1.10", "                                ", "2019-03-11T19:45:00Z")
+	mock.ExpectQuery(`^SELECT id, hash, username, action, detail, source, trace, created FROM hpc_webhook_audit WHERE username = \$1 AND created >= \$2 AND created < \$3 ORDER BY id$`).
+		WithArgs(filter.Username, filter.From, filter.To).
+		WillReturnRows(rows)
+
+	records, err := getAuditRows(db, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Hash != hash || records[1].Hash != "" || records[1].Action != AuditActionList || records[0].Trace != "" {
+		t.Errorf("Unexpected audit records %+v", records)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultCertificateValiditySeconds is the lifetime of the user certificates signed by the server,
+// unless configured otherwise
+const DefaultCertificateValiditySeconds = 5 * 60
+
+// certificateClockSkew is the period before signing from which a user certificate is valid,
+// to allow for clocks of the relay node running behind
+const certificateClockSkew = time.Minute
+
+// usesCertificates checks if the server authenticates with user certificates signed by a CA,
+// in which case its public key is not added to the authorized keys of users
+func (a *API) usesCertificates() bool {
+	return a.CAKeyFilename != "" || a.CASocket != ""
+}
+
+// agentSigners returns the keys held by the ssh-agent listening on the given socket.
+// The connection has to be closed when the keys are no longer used.
+func agentSigners(socket string) ([]ssh.Signer, net.Conn, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if len(signers) == 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("no keys in ssh-agent at '%s'", socket)
+	}
+	return signers, conn, nil
+}
+
+// certificateSigner returns a signer presenting a short-lived user certificate for the key of the signer.
+// The certificate is only valid for the given user and is restricted to the given forced command and source addresses, if set.
+func certificateSigner(signer ssh.Signer, caSigner ssh.Signer, username string, command string, sourceAddress string, validity time.Duration, now time.Time) (ssh.Signer, error) {
+	certificate := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s:%s", AuthorizedKeyMarker, username),
+		ValidPrincipals: []string{username},
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+	certificate.CriticalOptions = make(map[string]string)
+	if command != "" {
+		certificate.CriticalOptions["force-command"] = command
+	}
+	if sourceAddress != "" {
+		certificate.CriticalOptions["source-address"] = sourceAddress
+	}
+
+	err := certificate.SignCert(rand.Reader, caSigner)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(certificate, signer)
+}
+
+// sshSigners returns the signers to authenticate to the relay node with.
+// The server keys are taken from ssh-agent when configured, and from the private key files otherwise.
+// With a CA, each key presents a user certificate signed for the user of the webhook.
+// The returned function releases the connections to ssh-agent.
+func sshSigners(conf executeConfiguration, now time.Time) ([]ssh.Signer, func(), error) {
+	var conns []net.Conn
+	closeConns := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	var signers []ssh.Signer
+	passphrase, err := readPassphrase(conf.passphraseFilename)
+	if err != nil {
+		return nil, closeConns, err
+	}
+	if conf.agentSocket != "" {
+		agentKeys, conn, err := agentSigners(conf.agentSocket)
+		if err != nil {
+			return nil, closeConns, err
+		}
+		conns = append(conns, conn)
+		signers = agentKeys
+	} else {
+		signer, err := loadSigner(conf.privateKeyFilename, passphrase)
+		if err != nil {
+			return nil, closeConns, err
+		}
+		signers = append(signers, signer)
+
+		// Try the previous key as well while a key rotation is in progress
+		if conf.previousKeyFilename != "" {
+			previousSigner, err := loadSigner(conf.previousKeyFilename, passphrase)
+			if err != nil {
+				return nil, closeConns, err
+			}
+			signers = append(signers, previousSigner)
+		}
+	}
+
+	if conf.caKeyFilename == "" && conf.caSocket == "" {
+		return signers, closeConns, nil
+	}
+
+	// Sign a user certificate with the CA key, held by the server or by an external signer
+	var caSigner ssh.Signer
+	if conf.caSocket != "" {
+		caKeys, conn, err := agentSigners(conf.caSocket)
+		if err != nil {
+			return nil, closeConns, err
+		}
+		conns = append(conns, conn)
+		caSigner = caKeys[0]
+	} else {
+		caPassphrase, err := readPassphrase(conf.caPassphraseFilename)
+		if err != nil {
+			return nil, closeConns, err
+		}
+		caSigner, err = loadSigner(conf.caKeyFilename, caPassphrase)
+		if err != nil {
+			return nil, closeConns, err
+		}
+	}
+
+	var certSigners []ssh.Signer
+	for _, signer := range signers {
+		certSigner, err := certificateSigner(signer, caSigner, conf.username, conf.submitCommand, conf.sourceAddress, conf.certificateValidity, now)
+		if err != nil {
+			return nil, closeConns, err
+		}
+		certSigners = append(certSigners, certSigner)
+	}
+	return certSigners, closeConns, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves an ssh-agent holding the given key on a socket in the given directory
+func serveAgent(t *testing.T, dir string, key ed25519.PrivateKey) (string, func()) {
+	keyring := agent.NewKeyring()
+	err := keyring.Add(agent.AddedKey{PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := path.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return socket, func() { listener.Close() }
+}
+
+func TestSSHSigners(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	err := os.MkdirAll(keyDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(keyDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	privateKeyFilename := path.Join(keyDir, "hpc-webhook")
+	err = generateKeyPair(KeyTypeEd25519, privateKeyFilename, path.Join(keyDir, "hpc-webhook.pub"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The CA key is encrypted with a passphrase of its own
+	caPassphraseFilename := path.Join(keyDir, "ca-passphrase")
+	err = ioutil.WriteFile(caPassphraseFilename, []byte("ca-secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyFilename := path.Join(keyDir, "ca")
+	err = generateKeyPair(KeyTypeEd25519, caKeyFilename, path.Join(keyDir, "ca.pub"), []byte("ca-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := loadSigner(caKeyFilename, []byte("ca-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, agentKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSocket, stopAgent := serveAgent(t, keyDir, agentKey)
+	defer stopAgent()
+	agentPublicKey, err := ssh.NewPublicKey(agentKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var testCases = []struct {
+		conf        executeConfiguration
+		certificate bool
+		publicKey   ssh.PublicKey
+	}{
+		{
+			conf:        executeConfiguration{privateKeyFilename: privateKeyFilename, username: "dccnuser"},
+			certificate: false,
+		},
+		{
+			conf:        executeConfiguration{agentSocket: agentSocket, username: "dccnuser"},
+			certificate: false,
+			publicKey:   agentPublicKey,
+		},
+		{
+			conf: executeConfiguration{
+				privateKeyFilename:   privateKeyFilename,
+				caKeyFilename:        caKeyFilename,
+				caPassphraseFilename: caPassphraseFilename,
+				certificateValidity:  5 * time.Minute,
+				sourceAddress:        "10.0.0.0/8,192.168.1.5",
+				submitCommand:        "hpc-webhook-submit",
+				username:             "dccnuser",
+			},
+			certificate: true,
+		},
+		{
+			conf: executeConfiguration{
+				agentSocket:          agentSocket,
+				caKeyFilename:        caKeyFilename,
+				caPassphraseFilename: caPassphraseFilename,
+				certificateValidity:  5 * time.Minute,
+				submitCommand:        "hpc-webhook-submit",
+				username:             "dccnuser",
+			},
+			certificate: true,
+			publicKey:   agentPublicKey,
+		},
+	}
+
+	for i, testCase := range testCases {
+		signers, closeSigners, err := sshSigners(testCase.conf, now)
+		if err != nil {
+			closeSigners()
+			t.Fatalf("Test case %d: expected no error, but got '%s'", i, err)
+		}
+		if len(signers) != 1 {
+			closeSigners()
+			t.Fatalf("Test case %d: expected a single signer, but got %d", i, len(signers))
+		}
+
+		publicKey := signers[0].PublicKey()
+		certificate, ok := publicKey.(*ssh.Certificate)
+		if ok != testCase.certificate {
+			t.Errorf("Test case %d: expected certificate %v, but got %v", i, testCase.certificate, ok)
+		}
+		if ok {
+			checker := ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return string(auth.Marshal()) == string(caSigner.PublicKey().Marshal())
+				},
+				Clock:                    func() time.Time { return now },
+				SupportedCriticalOptions: []string{"force-command", "source-address"},
+			}
+			if _, err := checker.Authenticate(fakeConnMetadata{user: "dccnuser"}, certificate); err != nil {
+				t.Errorf("Test case %d: expected a valid certificate, but got '%s'", i, err)
+			}
+			if _, err := checker.Authenticate(fakeConnMetadata{user: "otheruser"}, certificate); err == nil {
+				t.Errorf("Test case %d: expected the certificate to be invalid for another user", i)
+			}
+			if sourceAddress := certificate.CriticalOptions["source-address"]; sourceAddress != testCase.conf.sourceAddress {
+				t.Errorf("Test case %d: expected source address '%s', but got '%s'", i, testCase.conf.sourceAddress, sourceAddress)
+			}
+			if command := certificate.CriticalOptions["force-command"]; command != "hpc-webhook-submit" {
+				t.Errorf("Test case %d: expected forced command 'hpc-webhook-submit', but got '%s'", i, command)
+			}
+			publicKey = certificate.Key
+		}
+		if testCase.publicKey != nil && string(publicKey.Marshal()) != string(testCase.publicKey.Marshal()) {
+			t.Errorf("Test case %d: expected the key of ssh-agent", i)
+		}
+		closeSigners()
+	}
+}
+
+// fakeConnMetadata is the connection of a user, for checking certificates
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c fakeConnMetadata) User() string {
+	return c.user
+}
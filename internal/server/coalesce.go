@@ -0,0 +1,65 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxCoalesceSeconds is the longest coalescing window a webhook can be configured with
+const MaxCoalesceSeconds = 3600
+
+// coalescedDelivery is the delivery waiting for the coalescing window of its webhook to close
+type coalescedDelivery struct {
+	conf  executeConfiguration
+	timer *time.Timer
+}
+
+// coalescer collapses bursts of deliveries for the same webhook into a single submission
+type coalescer struct {
+	mu      sync.Mutex
+	pending map[string]*coalescedDelivery
+}
+
+// add queues a delivery for the given webhook.
+// The first delivery opens a coalescing window of the given duration.
+// Deliveries arriving within the window replace the pending one, which is handed to supersede.
+// When the window closes, the newest delivery is handed to submit.
+func (c *coalescer) add(webhookID string, window time.Duration, conf executeConfiguration, submit func(executeConfiguration), supersede func(executeConfiguration)) {
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[string]*coalescedDelivery)
+	}
+	if p, ok := c.pending[webhookID]; ok {
+		superseded := p.conf
+		p.conf = conf
+		c.mu.Unlock()
+		supersede(superseded)
+		return
+	}
+	p := &coalescedDelivery{conf: conf}
+	c.pending[webhookID] = p
+	p.timer = time.AfterFunc(window, func() {
+		c.mu.Lock()
+		p := c.pending[webhookID]
+		delete(c.pending, webhookID)
+		c.mu.Unlock()
+		submit(p.conf)
+	})
+	c.mu.Unlock()
+}
+
+// stop closes the coalescing windows without submitting, and returns the pending deliveries.
+// Deliveries of which the window has just closed are still handed to submit.
+func (c *coalescer) stop() []executeConfiguration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var stopped []executeConfiguration
+	for webhookID, p := range c.pending {
+		if p.timer.Stop() {
+			stopped = append(stopped, p.conf)
+			delete(c.pending, webhookID)
+		}
+	}
+	return stopped
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	window := 100 * time.Millisecond
+
+	var mu sync.Mutex
+	var submitted []string
+	var superseded []string
+	done := make(chan struct{})
+
+	submit := func(conf executeConfiguration) {
+		mu.Lock()
+		submitted = append(submitted, conf.deliveryID)
+		mu.Unlock()
+		close(done)
+	}
+	supersede := func(conf executeConfiguration) {
+		mu.Lock()
+		superseded = append(superseded, conf.deliveryID)
+		mu.Unlock()
+	}
+
+	var c coalescer
+	for _, deliveryID := range []string{"delivery1", "delivery2", "delivery3"} {
+		c.add(webhookID, window, executeConfiguration{webhookID: webhookID, deliveryID: deliveryID}, submit, supersede)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * window):
+		t.Fatalf("Expected a submission after the coalescing window closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(submitted) != 1 || submitted[0] != "delivery3" {
+		t.Errorf("Expected only the newest delivery to be submitted, but got %v", submitted)
+	}
+	if len(superseded) != 2 || superseded[0] != "delivery1" || superseded[1] != "delivery2" {
+		t.Errorf("Expected the older deliveries to be superseded, but got %v", superseded)
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("Expected no pending deliveries, but got %d", len(c.pending))
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 // ConfigurationRequest stores one row of webhook information
@@ -15,6 +18,58 @@ type ConfigurationRequest struct {
 	Groupname   string `json:"groupname"`
 	Username    string `json:"username"`
 	Description string `json:"description"`
+
+	CoalesceSeconds int    `json:"coalesceSeconds"` // Deliveries within this many seconds are collapsed into one submission
+	Concurrency     string `json:"concurrency"`     // Policy when the previous job is still active: allow, skip or cancel
+	Events          string `json:"events"`          // Comma-separated list of events that trigger the webhook (empty for all)
+	QsubOptions     string `json:"qsubOptions"`     // Extra options passed to qsub
+	Expires         string `json:"expires"`         // RFC3339 time after which the webhook is removed (empty for never)
+}
+
+// ConfigurationUpdateRequest stores the changes to a registered webhook.
+// Fields that are left out are not changed.
+type ConfigurationUpdateRequest struct {
+	Hash            string  `json:"hash"`
+	Groupname       string  `json:"groupname"`
+	Username        string  `json:"username"`
+	Enabled         *bool   `json:"enabled,omitempty"`
+	Description     *string `json:"description,omitempty"`
+	CoalesceSeconds *int    `json:"coalesceSeconds,omitempty"`
+	Concurrency     *string `json:"concurrency,omitempty"`
+	Events          *string `json:"events,omitempty"`
+	QsubOptions     *string `json:"qsubOptions,omitempty"`
+}
+
+// hasSettings tells whether the request changes anything besides the enabled state
+func (conf ConfigurationUpdateRequest) hasSettings() bool {
+	return conf.Description != nil ||
+		conf.CoalesceSeconds != nil ||
+		conf.Concurrency != nil ||
+		conf.Events != nil ||
+		conf.QsubOptions != nil
+}
+
+// apply copies the changed settings and enabled state onto the registered webhook
+func (conf ConfigurationUpdateRequest) apply(item Item) Item {
+	if conf.Description != nil {
+		item.Description = *conf.Description
+	}
+	if conf.CoalesceSeconds != nil {
+		item.CoalesceSeconds = *conf.CoalesceSeconds
+	}
+	if conf.Concurrency != nil {
+		item.Concurrency = concurrencyOrDefault(*conf.Concurrency)
+	}
+	if conf.Events != nil {
+		item.Events = *conf.Events
+	}
+	if conf.QsubOptions != nil {
+		item.QsubOptions = *conf.QsubOptions
+	}
+	if conf.Enabled != nil {
+		item.Enabled = *conf.Enabled
+	}
+	return item
 }
 
 // ConfigurationResponse contains the complete webhook payload URL
@@ -27,9 +82,31 @@ type ConfigurationInfoResponse struct {
 	Webhook Item `json:"webhook"`
 }
 
-// ConfigurationListResponse contains the list of regstered webhooks for a certain user
+// ConfigurationListResponse contains a page of the list of regstered webhooks for a certain user,
+// and the cursor to request the next page with (empty for the last page)
 type ConfigurationListResponse struct {
-	Webhooks []Item `json:"webhooks"`
+	Webhooks   []Item `json:"webhooks"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ConfigurationUpdateResponse contains the webhook after it has been updated
+type ConfigurationUpdateResponse struct {
+	Webhook Item `json:"webhook"`
+}
+
+// ConfigurationRotateResponse contains the webhook with its new payload URL,
+// and the time until which the previous payload URL is still accepted
+type ConfigurationRotateResponse struct {
+	Webhook         Item   `json:"webhook"`
+	PreviousExpires string `json:"previousExpires"`
+}
+
+// ConfigurationTestResponse contains the results of the steps of the test of a webhook,
+// which passed when every step passed
+type ConfigurationTestResponse struct {
+	Webhook string     `json:"webhook"`
+	Passed  bool       `json:"passed"`
+	Steps   []TestStep `json:"steps"`
 }
 
 // ConfigurationDeleteResponse contains the webhook that has been deleted
@@ -37,6 +114,14 @@ type ConfigurationDeleteResponse struct {
 	Webhook string `json:"webhook"`
 }
 
+// Apply the default concurrency policy when none is given
+func concurrencyOrDefault(concurrency string) string {
+	if concurrency == "" {
+		return ConcurrencyAllow
+	}
+	return concurrency
+}
+
 func parseConfigurationAddRequest(req *http.Request) (ConfigurationRequest, error) {
 	var configuration ConfigurationRequest
 	var err error
@@ -60,6 +145,8 @@ func parseConfigurationAddRequest(req *http.Request) (ConfigurationRequest, erro
 		return configuration, err
 	}
 
+	// Store the expiry time in the same form as the times it is compared with
+	configuration.Expires, err = normalizeExpires(configuration.Expires)
 	return configuration, err
 }
 
@@ -89,12 +176,41 @@ func parseConfigurationInfoRequest(req *http.Request) (ConfigurationRequest, err
 	return configuration, err
 }
 
-func parseConfigurationListRequest(req *http.Request) (ConfigurationRequest, error) {
+func parseConfigurationListRequest(req *http.Request) (ConfigurationRequest, ListOptions, error) {
 	var configuration ConfigurationRequest
+	var options ListOptions
 	var err error
 
 	// Check the URL path
 	if !isValidConfigurationListURLPath(req.URL.Path) {
+		return configuration, options, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
+	}
+
+	// Obtain the configuration
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&configuration)
+	if err != nil {
+		return configuration, options, errors.New("invalid JSON body")
+	}
+
+	// Validate the configuration
+	validateHash := false
+	err = validateConfigurationRequest(configuration, validateHash)
+	if err != nil {
+		return configuration, options, err
+	}
+
+	// Obtain the page, order and filters from the query
+	options, err = parseListOptions(req)
+	return configuration, options, err
+}
+
+func parseConfigurationDeleteRequest(req *http.Request) (ConfigurationRequest, error) {
+	var configuration ConfigurationRequest
+	var err error
+
+	// Check the URL path
+	if !isValidConfigurationDeleteURLPath(req.URL.Path) {
 		return configuration, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
 	}
 
@@ -106,7 +222,7 @@ func parseConfigurationListRequest(req *http.Request) (ConfigurationRequest, err
 	}
 
 	// Validate the configuration
-	validateHash := false
+	validateHash := true
 	err = validateConfigurationRequest(configuration, validateHash)
 	if err != nil {
 		return configuration, err
@@ -115,12 +231,72 @@ func parseConfigurationListRequest(req *http.Request) (ConfigurationRequest, err
 	return configuration, err
 }
 
-func parseConfigurationDeleteRequest(req *http.Request) (ConfigurationRequest, error) {
+func parseConfigurationRotateRequest(req *http.Request) (ConfigurationRequest, error) {
 	var configuration ConfigurationRequest
 	var err error
 
 	// Check the URL path
-	if !isValidConfigurationDeleteURLPath(req.URL.Path) {
+	if !isValidConfigurationRotateURLPath(req.URL.Path) {
+		return configuration, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
+	}
+
+	// Obtain the configuration
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&configuration)
+	if err != nil {
+		return configuration, errors.New("invalid JSON body")
+	}
+
+	// Validate the configuration
+	validateHash := true
+	err = validateConfigurationRequest(configuration, validateHash)
+	if err != nil {
+		return configuration, err
+	}
+
+	return configuration, err
+}
+
+func parseConfigurationDoctorRequest(req *http.Request) (ConfigurationRequest, bool, error) {
+	var configuration ConfigurationRequest
+	var err error
+
+	// Check the URL path
+	if !isValidConfigurationDoctorURLPath(req.URL.Path) {
+		return configuration, false, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
+	}
+
+	// Obtain the configuration
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&configuration)
+	if err != nil {
+		return configuration, false, errors.New("invalid JSON body")
+	}
+
+	// Validate the configuration
+	validateHash := false
+	err = validateConfigurationRequest(configuration, validateHash)
+	if err != nil {
+		return configuration, false, err
+	}
+
+	// Obtain whether the problems are to be repaired from the query
+	repair := false
+	if s := req.URL.Query().Get("repair"); s != "" {
+		repair, err = strconv.ParseBool(s)
+		if err != nil {
+			return configuration, false, fmt.Errorf("invalid repair '%s'", s)
+		}
+	}
+	return configuration, repair, nil
+}
+
+func parseConfigurationTestRequest(req *http.Request) (ConfigurationRequest, error) {
+	var configuration ConfigurationRequest
+	var err error
+
+	// Check the URL path
+	if !isValidConfigurationTestURLPath(req.URL.Path) {
 		return configuration, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
 	}
 
@@ -141,13 +317,40 @@ func parseConfigurationDeleteRequest(req *http.Request) (ConfigurationRequest, e
 	return configuration, err
 }
 
+func parseConfigurationUpdateRequest(req *http.Request) (ConfigurationUpdateRequest, error) {
+	var configuration ConfigurationUpdateRequest
+	var err error
+
+	// Check the URL path
+	if !isValidConfigurationUpdateURLPath(req.URL.Path) {
+		return configuration, fmt.Errorf("invalid URL path '%s'", req.URL.Path)
+	}
+
+	// Obtain the configuration
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&configuration)
+	if err != nil {
+		return configuration, errors.New("invalid JSON body")
+	}
+
+	// Validate the configuration
+	err = validateConfigurationUpdateRequest(configuration)
+	if err != nil {
+		return configuration, err
+	}
+
+	return configuration, err
+}
+
 // ConfigurationAddHandler handles a HTTP PUT request
 // to register a certain webhook with hash, groupname, and username in its body
 func (a *API) ConfigurationAddHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
 	// Check method
 	if !strings.EqualFold(req.Method, "PUT") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Printf("%s Error 405 - Method not allowed: invalid method: %s\n", time.Now().Format(time.RFC3339), req.Method)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
 		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
 		return
 	}
@@ -156,33 +359,23 @@ func (a *API) ConfigurationAddHandler(w http.ResponseWriter, req *http.Request)
 	configuration, err := parseConfigurationAddRequest(req)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
-	// Add key to authorized keys
-	err = addAuthorizedPublicKey(a.HomeDir, configuration.Groupname, configuration.Username, a.PublicKeyFilename)
+	// Add key to authorized keys and a row in the database
+	err = a.registerWebhook(configuration)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
-	// Add a row in the database
-	err = addRow(a.DB,
-		configuration.Hash,
-		configuration.Groupname,
-		configuration.Username,
-		configuration.Description,
-		time.Now().Format(time.RFC3339))
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
-		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		return
-	}
+	// Record the registration
+	logger.WithField("webhook", configuration.Hash).Info("Webhook added")
+	a.audit(configuration.Hash, configuration.Username, AuditActionAdd, fmt.Sprintf("group %s", configuration.Groupname), requestSource(req), time.Now())
 
 	// Succes
 	webhookPayloadURL := fmt.Sprintf("https://%s:%s/webhook/%s", a.HPCWebhookHost, a.HPCWebhookExternalPort, configuration.Hash)
@@ -201,13 +394,49 @@ func (a *API) ConfigurationAddHandler(w http.ResponseWriter, req *http.Request)
 	return
 }
 
+// registerWebhook adds the server key to the authorized keys of the user and the webhook to the database,
+// while the authorized keys of the user are locked, so the key cannot be revoked before the webhook is added
+func (a *API) registerWebhook(configuration ConfigurationRequest) error {
+	unlock, err := a.lockAuthorizedKeys(configuration.Groupname, configuration.Username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Add key to authorized keys, unless the server authenticates with user certificates
+	if !a.usesCertificates() {
+		_, publicKeyFilename := a.serverIdentity()
+		err = addAuthorizedPublicKey(a.HomeDir, configuration.Groupname, configuration.Username, publicKeyFilename, a.AuthorizedKeyFrom, a.AuthorizedKeyCommand)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add a row in the database
+	return a.store().AddWebhook(Item{
+		Hash:            configuration.Hash,
+		Groupname:       configuration.Groupname,
+		Username:        configuration.Username,
+		Description:     configuration.Description,
+		Created:         time.Now().Format(time.RFC3339),
+		CoalesceSeconds: configuration.CoalesceSeconds,
+		Concurrency:     concurrencyOrDefault(configuration.Concurrency),
+		Events:          configuration.Events,
+		QsubOptions:     configuration.QsubOptions,
+		Token:           configuration.Hash, // The public token equals the hash until it is rotated
+		Expires:         configuration.Expires,
+	})
+}
+
 // ConfigurationInfoHandler handles a HTTP GET request
 // to obtain detailed information about a specific webhook
 func (a *API) ConfigurationInfoHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
 	// Check method
 	if !strings.EqualFold(req.Method, "GET") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Printf("%s Error 405 - Method not allowed: invalid method: %s\n", time.Now().Format(time.RFC3339), req.Method)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
 		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
 		return
 	}
@@ -216,21 +445,24 @@ func (a *API) ConfigurationInfoHandler(w http.ResponseWriter, req *http.Request)
 	configuration, err := parseConfigurationInfoRequest(req)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
 	// Get the item
-	list, err := getRow(a.DB, a.HPCWebhookHost, a.HPCWebhookExternalPort, configuration.Hash, configuration.Groupname, configuration.Username)
+	list, err := a.store().GetWebhook(configuration.Hash, configuration.Groupname, configuration.Username)
 	if err != nil || len(list) == 0 {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 	item := list[0]
 
+	// Record the request
+	a.audit(configuration.Hash, configuration.Username, AuditActionInfo, "", requestSource(req), time.Now())
+
 	// Succes
 	configurationInfoResponse := ConfigurationInfoResponse{
 		Webhook: item,
@@ -244,42 +476,47 @@ func (a *API) ConfigurationInfoHandler(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
-	fmt.Printf("%+v\n", string(js))
 	return
 }
 
 // ConfigurationListHandler handles a HTTP GET request
-// to obtain all webhooks for a certain user
+// to obtain a page of the webhooks for a certain user, ordered and filtered by the query
 func (a *API) ConfigurationListHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
 	// Check method
 	if !strings.EqualFold(req.Method, "GET") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Printf("%s Error 405 - Method not allowed: invalid method: %s\n", time.Now().Format(time.RFC3339), req.Method)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
 		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
 		return
 	}
 
 	// Parse and validate the request
-	configuration, err := parseConfigurationListRequest(req)
+	configuration, options, err := parseConfigurationListRequest(req)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
 	// Get the list of webhooks
-	list, err := getListRows(a.DB, a.HPCWebhookHost, a.HPCWebhookExternalPort, configuration.Groupname, configuration.Username)
+	list, nextCursor, err := a.store().ListWebhooks(configuration.Groupname, configuration.Username, options)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
+	// Record the request
+	a.audit("", configuration.Username, AuditActionList, fmt.Sprintf("%d webhooks", len(list)), requestSource(req), time.Now())
+
 	// Succes
 	configurationListResponse := ConfigurationListResponse{
-		Webhooks: list,
+		Webhooks:   list,
+		NextCursor: nextCursor,
 	}
 	js, err := json.Marshal(configurationListResponse)
 	if err != nil {
@@ -290,17 +527,18 @@ func (a *API) ConfigurationListHandler(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
-	fmt.Printf("%+v\n", string(js))
 	return
 }
 
 // ConfigurationDeleteHandler handles a HTTP DELETE request
 // to delete a certain webhook for a certain user
 func (a *API) ConfigurationDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
 	// Check method
 	if !strings.EqualFold(req.Method, "DELETE") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Printf("%s Error 405 - Method not allowed: invalid method: %s\n", time.Now().Format(time.RFC3339), req.Method)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
 		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
 		return
 	}
@@ -309,20 +547,30 @@ func (a *API) ConfigurationDeleteHandler(w http.ResponseWriter, req *http.Reques
 	configuration, err := parseConfigurationDeleteRequest(req)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
 	// Delete a row in the database
-	err = deleteRow(a.DB, configuration.Hash, configuration.Groupname, configuration.Username)
+	err = a.store().DeleteWebhook(configuration.Hash, configuration.Groupname, configuration.Username)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		fmt.Println(err)
+		logger.Warn(err)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
 		return
 	}
 
+	// Record the removal
+	logger.WithField("webhook", configuration.Hash).Info("Webhook deleted")
+	a.audit(configuration.Hash, configuration.Username, AuditActionDelete, "", requestSource(req), time.Now())
+
+	// Revoke the access of the server when the user has no webhooks left
+	err = a.revokeUnusedAuthorizedPublicKey(configuration.Hash, configuration.Groupname, configuration.Username, requestSource(req), time.Now())
+	if err != nil {
+		logger.Error(err)
+	}
+
 	// Succes
 	configurationDeleteResponse := ConfigurationDeleteResponse{
 		Webhook: configuration.Hash,
@@ -338,3 +586,256 @@ func (a *API) ConfigurationDeleteHandler(w http.ResponseWriter, req *http.Reques
 	w.Write(js)
 	return
 }
+
+// ConfigurationUpdateHandler handles a HTTP PATCH request
+// to update the settings of a certain webhook for a certain user in place, or to enable or disable it
+func (a *API) ConfigurationUpdateHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	// Check method
+	if !strings.EqualFold(req.Method, "PATCH") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Parse and validate the request
+	configuration, err := parseConfigurationUpdateRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Update the description, filters, scheduler options and enabled state at once
+	err = a.store().UpdateWebhook(configuration)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Record the changes
+	now := time.Now()
+	if configuration.hasSettings() {
+		logger.WithField("webhook", configuration.Hash).Info("Webhook updated")
+		a.audit(configuration.Hash, configuration.Username, AuditActionUpdate, "", requestSource(req), now)
+	}
+	if configuration.Enabled != nil {
+		logger.WithField("webhook", configuration.Hash).Infof("Webhook enabled: %t", *configuration.Enabled)
+		action := AuditActionDisable
+		if *configuration.Enabled {
+			action = AuditActionEnable
+		}
+		a.audit(configuration.Hash, configuration.Username, action, "", requestSource(req), now)
+	}
+
+	// Get the updated item
+	list, err := a.store().GetWebhook(configuration.Hash, configuration.Groupname, configuration.Username)
+	if err != nil || len(list) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	configurationUpdateResponse := ConfigurationUpdateResponse{
+		Webhook: list[0],
+	}
+	js, err := json.Marshal(configurationUpdateResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	return
+}
+
+// ConfigurationRotateHandler handles a HTTP POST request
+// to issue a new public token for the payload URL of a certain webhook for a certain user.
+// The previous token remains valid during the token grace period.
+func (a *API) ConfigurationRotateHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	// Check method
+	if !strings.EqualFold(req.Method, "POST") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Parse and validate the request
+	configuration, err := parseConfigurationRotateRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Replace the public token
+	now := time.Now()
+	previousExpires := formatExpires(now.Add(time.Duration(a.TokenGracePeriodSeconds) * time.Second))
+	err = a.store().RotateToken(configuration.Hash, configuration.Groupname, configuration.Username, uuid.New().String(), previousExpires)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	logger.WithField("webhook", configuration.Hash).Info("Webhook token rotated")
+
+	// Record the rotation
+	a.audit(configuration.Hash, configuration.Username, AuditActionRotate, fmt.Sprintf("previous token valid until %s", previousExpires), requestSource(req), now)
+
+	// Clean up tokens of earlier rotations
+	err = a.store().DeleteExpiredTokens(formatExpires(now))
+	if err != nil {
+		logger.Error(err)
+	}
+
+	// Get the updated item
+	list, err := a.store().GetWebhook(configuration.Hash, configuration.Groupname, configuration.Username)
+	if err != nil || len(list) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Succes
+	configurationRotateResponse := ConfigurationRotateResponse{
+		Webhook:         list[0],
+		PreviousExpires: previousExpires,
+	}
+	js, err := json.Marshal(configurationRotateResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	return
+}
+
+// ConfigurationTestHandler handles a HTTP POST request
+// to test a certain webhook for a certain user: every step of the execution of its script is performed,
+// except for the submission itself, and the result of each step is returned.
+func (a *API) ConfigurationTestHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+	ctx, span := startRequestSpan(req, "webhook.test")
+	defer span.End()
+
+	// Check method
+	if !strings.EqualFold(req.Method, "POST") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Parse and validate the request
+	configuration, err := parseConfigurationTestRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Get the item
+	list, err := a.store().GetWebhook(configuration.Hash, configuration.Groupname, configuration.Username)
+	if err != nil || len(list) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Perform the steps of the execution of the script, as for a delivery
+	conf := a.withServerIdentity(a.newExecuteConfiguration(list[0], uuid.New().String()))
+	steps := testScript(ctx, a.Connector, conf)
+	last := steps[len(steps)-1]
+	passed := last.Passed && last.Step == TestStepPayload
+
+	// Record the test
+	result := "passed"
+	if !passed {
+		result = fmt.Sprintf("failed at %s: %s", last.Step, last.Error)
+	}
+	logger.WithField("webhook", configuration.Hash).Infof("Webhook tested: %s", result)
+	a.audit(configuration.Hash, configuration.Username, AuditActionTest, result, requestSource(req), time.Now())
+
+	// Succes
+	configurationTestResponse := ConfigurationTestResponse{
+		Webhook: configuration.Hash,
+		Passed:  passed,
+		Steps:   steps,
+	}
+	js, err := json.Marshal(configurationTestResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	return
+}
+
+// ConfigurationDoctorHandler handles a HTTP POST request
+// to check the webhooks of a certain user against the home directory of the user.
+// The problems found are repaired when the query has repair=true.
+func (a *API) ConfigurationDoctorHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	// Check method
+	if !strings.EqualFold(req.Method, "POST") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Parse and validate the request
+	configuration, repair, err := parseConfigurationDoctorRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+
+	// Check the webhooks, and repair them if requested
+	report, err := a.doctor(configuration.Groupname, configuration.Username, repair, requestSource(req))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		logger.Warn(err)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	logger.WithField("user", configuration.Username).Infof("Webhooks checked: %d problems found", len(report.Problems))
+
+	// Succes
+	js, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	return
+}
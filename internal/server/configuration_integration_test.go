@@ -3,12 +3,14 @@ package server
 import (
 	"bytes"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 )
@@ -42,7 +44,7 @@ func setupTestCase(testConfig testConfiguration) error {
 	if err != nil {
 		return fmt.Errorf("error %s when creating %s dir", err, testConfig.keyDir)
 	}
-	err = generateKeyPair(testConfig.privateKeyFilename, testConfig.publicKeyFilename)
+	err = generateKeyPair(KeyTypeRSA, testConfig.privateKeyFilename, testConfig.publicKeyFilename, nil)
 	if err != nil {
 		return err
 	}
@@ -167,8 +169,8 @@ func TestConfigurationAddHandler(t *testing.T) {
 			HPCWebhookHost:         "hpc-webhook.dccn.nl",
 			HPCWebhookInternalPort: "5111",
 			HPCWebhookExternalPort: "443",
-			PrivateKeyFilename:     testConfig.publicKeyFilename,
-			PublicKeyFilename:      testConfig.privateKeyFilename,
+			PrivateKeyFilename:     testConfig.privateKeyFilename,
+			PublicKeyFilename:      testConfig.publicKeyFilename,
 		}
 
 		app := &api
@@ -188,13 +190,24 @@ func TestConfigurationAddHandler(t *testing.T) {
 		}
 
 		if c.expectedResult {
-			sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
+			sqlmock.NewRows(itemColumnNames).
 				AddRow(1,
 					c.configuration.Hash,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					"2019-03-11T19:44:44+01:00")
+					"2019-03-11T19:44:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					c.configuration.Hash,
+					nil)
+
+			// No key rotation has taken place
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+				WillReturnRows(sqlmock.NewRows(keyRotationColumnNames))
 
 			mock.ExpectBegin()
 			mock.ExpectExec("INSERT INTO hpc_webhook").
@@ -202,9 +215,16 @@ func TestConfigurationAddHandler(t *testing.T) {
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					AnyTimeString{}).
+					AnyTimeString{},
+					c.configuration.CoalesceSeconds,
+					ConcurrencyAllow,
+					c.configuration.Events,
+					c.configuration.QsubOptions,
+					c.configuration.Hash,
+					nil).
 				WillReturnResult(sqlmock.NewResult(1, 1))
 			mock.ExpectCommit()
+			expectAudit(mock, c.configuration.Hash, c.configuration.Username, AuditActionAdd)
 		}
 
 		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -261,7 +281,7 @@ func TestConfigurationInfoHandler(t *testing.T) {
 				"Content-Type": "application/json; charset=utf-8",
 			},
 			expectedStatus: 200,
-			expectedString: `{"webhook":{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"description","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001"}}`,
+			expectedString: `{"webhook":{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"description","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001","coalesceSeconds":0,"concurrency":"allow","enabled":true,"events":"","qsubOptions":""}}`,
 			expectedResult: true, // No error
 		},
 		{
@@ -338,8 +358,8 @@ func TestConfigurationInfoHandler(t *testing.T) {
 			HPCWebhookHost:         "hpc-webhook.dccn.nl",
 			HPCWebhookInternalPort: "5111",
 			HPCWebhookExternalPort: "443",
-			PrivateKeyFilename:     testConfig.publicKeyFilename,
-			PublicKeyFilename:      testConfig.privateKeyFilename,
+			PrivateKeyFilename:     testConfig.privateKeyFilename,
+			PublicKeyFilename:      testConfig.publicKeyFilename,
 		}
 
 		app := &api
@@ -359,17 +379,25 @@ func TestConfigurationInfoHandler(t *testing.T) {
 		}
 
 		if c.expectedResult {
-			expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
+			expectedRows := sqlmock.NewRows(itemColumnNames).
 				AddRow(1,
 					c.configuration.Hash,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
 					"2019-03-11T19:44:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					c.configuration.Hash,
+					nil,
 				)
-			mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook").
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
 				WithArgs(c.configuration.Hash, c.configuration.Groupname, c.configuration.Username).
 				WillReturnRows(expectedRows)
+			expectAudit(mock, c.configuration.Hash, c.configuration.Username, AuditActionInfo)
 		}
 
 		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -426,7 +454,7 @@ func TestConfigurationListHandler(t *testing.T) {
 				"Content-Type": "application/json; charset=utf-8",
 			},
 			expectedStatus: 200,
-			expectedString: `{"webhooks":[{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001"},{"hash":"550e8400-e29b-41d4-a716-446655440002","groupname":"groupname","username":"username","description":"","created":"2019-03-11T19:45:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440002"}]}`,
+			expectedString: `{"webhooks":[{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001","coalesceSeconds":0,"concurrency":"allow","enabled":true,"events":"","qsubOptions":""},{"hash":"550e8400-e29b-41d4-a716-446655440002","groupname":"groupname","username":"username","description":"","created":"2019-03-11T19:45:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440002","coalesceSeconds":0,"concurrency":"allow","enabled":true,"events":"","qsubOptions":""}]}`,
 			expectedResult: true, // No error
 		},
 		{
@@ -446,6 +474,23 @@ func TestConfigurationListHandler(t *testing.T) {
 			expectedString: `Error 404 - Not found: invalid URL path '/configuration/nonexisting'`,
 			expectedResult: false, // No error
 		},
+		{
+			method:    "GET",
+			configURL: "/configuration?limit=0",
+			configuration: ConfigurationRequest{
+				Hash:        "",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "",
+			},
+			testData: `{"hash": "", "groupname": "groupname", "username": "username", "description": ""}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid limit '0': expected 1 to 1000`,
+			expectedResult: false, // Invalid page size
+		},
 		{
 			method:    "POST",
 			configURL: "/configuration",
@@ -503,8 +548,8 @@ func TestConfigurationListHandler(t *testing.T) {
 			HPCWebhookHost:         "hpc-webhook.dccn.nl",
 			HPCWebhookInternalPort: "5111",
 			HPCWebhookExternalPort: "443",
-			PrivateKeyFilename:     testConfig.publicKeyFilename,
-			PublicKeyFilename:      testConfig.privateKeyFilename,
+			PrivateKeyFilename:     testConfig.privateKeyFilename,
+			PublicKeyFilename:      testConfig.publicKeyFilename,
 		}
 
 		app := &api
@@ -526,22 +571,39 @@ func TestConfigurationListHandler(t *testing.T) {
 		if c.expectedResult {
 			hash1 := "550e8400-e29b-41d4-a716-446655440001"
 			hash2 := "550e8400-e29b-41d4-a716-446655440002"
-			expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
+			expectedRows := sqlmock.NewRows(append(itemColumnNames, "last_triggered")).
 				AddRow(1,
 					hash1,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					"2019-03-11T19:44:44+01:00").
+					"2019-03-11T19:44:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					hash1,
+					nil,
+					nil).
 				AddRow(2,
 					hash2,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					"2019-03-11T19:45:44+01:00")
-			mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook").
-				WithArgs(c.configuration.Groupname, c.configuration.Username).
+					"2019-03-11T19:45:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					hash2,
+					nil,
+					nil)
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+				WithArgs(c.configuration.Groupname, c.configuration.Username, DefaultListLimit+1).
 				WillReturnRows(expectedRows)
+			expectAudit(mock, "", c.configuration.Username, AuditActionList)
 		}
 
 		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -675,8 +737,8 @@ func TestConfigurationDeleteHandler(t *testing.T) {
 			HPCWebhookHost:         "hpc-webhook.dccn.nl",
 			HPCWebhookInternalPort: "5111",
 			HPCWebhookExternalPort: "443",
-			PrivateKeyFilename:     testConfig.publicKeyFilename,
-			PublicKeyFilename:      testConfig.privateKeyFilename,
+			PrivateKeyFilename:     testConfig.privateKeyFilename,
+			PublicKeyFilename:      testConfig.publicKeyFilename,
 		}
 
 		app := &api
@@ -698,25 +760,45 @@ func TestConfigurationDeleteHandler(t *testing.T) {
 		if c.expectedResult {
 			hash1 := c.configuration.Hash
 			hash2 := "550e8400-e29b-41d4-a716-446655440002"
-			sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
+			sqlmock.NewRows(itemColumnNames).
 				AddRow(1,
 					c.configuration.Hash,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					"2019-03-11T19:44:44+01:00").
+					"2019-03-11T19:44:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					c.configuration.Hash,
+					nil).
 				AddRow(2,
 					hash2,
 					c.configuration.Groupname,
 					c.configuration.Username,
 					c.configuration.Description,
-					"2019-03-11T19:45:44+01:00")
+					"2019-03-11T19:45:44+01:00",
+					0,
+					"allow",
+					true,
+					"",
+					"",
+					hash2,
+					nil)
 
 			mock.ExpectBegin()
 			mock.ExpectExec("DELETE FROM hpc_webhook").
 				WithArgs(hash1, c.configuration.Groupname, c.configuration.Username).
 				WillReturnResult(sqlmock.NewResult(1, 1))
 			mock.ExpectCommit()
+			expectAudit(mock, hash1, c.configuration.Username, AuditActionDelete)
+
+			// The user has webhooks left, so the server keeps its access
+			mock.ExpectQuery("^SELECT COUNT").
+				WithArgs(c.configuration.Groupname, c.configuration.Username).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
 		}
 
 		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -749,3 +831,553 @@ func TestConfigurationDeleteHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigurationUpdateHandler(t *testing.T) {
+	cases := []struct {
+		method         string
+		configURL      string
+		configuration  ConfigurationRequest
+		testData       string
+		headerInfo     map[string]string
+		updateSettings bool
+		updateEnabled  bool
+		updateArgs     []driver.Value // Values set by the update, in the order of the columns
+		expectedStatus int
+		expectedString string
+		expectedResult bool
+	}{
+		{
+			method:    "PATCH",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "description",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "enabled": false}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			updateEnabled:  true,
+			updateArgs:     []driver.Value{false},
+			expectedStatus: 200,
+			expectedString: `{"webhook":{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"description","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001","coalesceSeconds":0,"concurrency":"allow","enabled":false,"events":"","qsubOptions":""}}`,
+			expectedResult: true, // No error
+		},
+		{
+			method:    "PATCH",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "new description",
+				Events:      "push",
+				QsubOptions: "-l walltime=00:10:00",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "description": "new description", "events": "push", "qsubOptions": "-l walltime=00:10:00"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			updateSettings: true,
+			updateArgs:     []driver.Value{"new description", "push", "-l walltime=00:10:00"},
+			expectedStatus: 200,
+			expectedString: `{"webhook":{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"new description","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001","coalesceSeconds":0,"concurrency":"allow","enabled":true,"events":"push","qsubOptions":"-l walltime=00:10:00"}}`,
+			expectedResult: true, // No error
+		},
+		{
+			method:    "PATCH",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "new description",
+				Concurrency: ConcurrencySkip,
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "description": "new description", "concurrency": "skip", "enabled": false}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			updateSettings: true,
+			updateEnabled:  true,
+			updateArgs:     []driver.Value{"new description", ConcurrencySkip, false},
+			expectedStatus: 200,
+			expectedString: `{"webhook":{"hash":"550e8400-e29b-41d4-a716-446655440001","groupname":"groupname","username":"username","description":"new description","created":"2019-03-11T19:44:44+01:00","url":"https://hpc-webhook.dccn.nl:443/webhook/550e8400-e29b-41d4-a716-446655440001","coalesceSeconds":0,"concurrency":"skip","enabled":false,"events":"","qsubOptions":""}}`,
+			expectedResult: true, // Settings and enabled state in a single update
+		},
+		{
+			method:    "PATCH",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "description",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "qsubOptions": "-l walltime=00:10:00; rm -rf ~"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid configuration update request: invalid qsub options`,
+			expectedResult: false, // Invalid qsub options
+		},
+		{
+			method:    "PATCH",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "description",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid configuration update request: nothing to update`,
+			expectedResult: false, // Nothing to update
+		},
+		{
+			method:    "PATCH",
+			configURL: "/configuration/nonexisting",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "description",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "enabled": false}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid URL path '/configuration/nonexisting'`,
+			expectedResult: false, // Invalid URL path
+		},
+		{
+			method:    "POST",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "groupname",
+				Username:    "username",
+				Description: "description",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username", "enabled": false}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 405,
+			expectedString: `Error 405 - Method not allowed: invalid method: POST`,
+			expectedResult: false, // Invalid method
+		},
+	}
+
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+
+	err := setupTestCase(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for _, c := range cases {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		api := API{
+			DB: db,
+			Connector: FakeConnector{
+				Description: "fake SSH connection to relay node",
+			},
+			DataDir:                testConfig.dataDir,
+			HomeDir:                testConfig.homeDir,
+			RelayNode:              "relaynode.dccn.nl",
+			HPCWebhookHost:         "hpc-webhook.dccn.nl",
+			HPCWebhookInternalPort: "5111",
+			HPCWebhookExternalPort: "443",
+			PrivateKeyFilename:     testConfig.privateKeyFilename,
+			PublicKeyFilename:      testConfig.publicKeyFilename,
+		}
+
+		app := &api
+
+		// Obtain the test data
+		b := bytes.NewBuffer([]byte(c.testData))
+
+		// Make a new HTTP PATCH request with this body
+		req, err := http.NewRequest(c.method, c.configURL, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Modify the header
+		for key, value := range c.headerInfo {
+			req.Header.Set(key, value)
+		}
+
+		if c.updateArgs != nil {
+			mock.ExpectBegin()
+			mock.ExpectExec("^UPDATE hpc_webhook SET").
+				WithArgs(append(c.updateArgs, c.configuration.Hash, c.configuration.Groupname, c.configuration.Username)...).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		if c.updateSettings {
+			expectAudit(mock, c.configuration.Hash, c.configuration.Username, AuditActionUpdate)
+		}
+		if c.updateEnabled {
+			expectAudit(mock, c.configuration.Hash, c.configuration.Username, AuditActionDisable)
+		}
+
+		if c.expectedResult {
+			expectedRows := sqlmock.NewRows(itemColumnNames).
+				AddRow(1,
+					c.configuration.Hash,
+					c.configuration.Groupname,
+					c.configuration.Username,
+					c.configuration.Description,
+					"2019-03-11T19:44:44+01:00",
+					0,
+					concurrencyOrDefault(c.configuration.Concurrency),
+					!c.updateEnabled,
+					c.configuration.Events,
+					c.configuration.QsubOptions,
+					c.configuration.Hash,
+					nil,
+				)
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+				WithArgs(c.configuration.Hash, c.configuration.Groupname, c.configuration.Username).
+				WillReturnRows(expectedRows)
+		}
+
+		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ConfigurationUpdateHandler)
+
+		// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+		// directly and pass in our Request and ResponseRecorder.
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, c.expectedStatus)
+			return
+		}
+
+		// Check the expected string
+		if rr.Body.String() != c.expectedString {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), c.expectedString)
+			return
+		}
+
+		if c.expectedResult {
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		}
+	}
+}
+
+func TestConfigurationRotateHandler(t *testing.T) {
+	newToken := "660e8400-e29b-41d4-a716-446655440002"
+
+	cases := []struct {
+		method         string
+		configURL      string
+		configuration  ConfigurationRequest
+		testData       string
+		headerInfo     map[string]string
+		expectedStatus int
+		expectedString string
+		expectedResult bool
+	}{
+		{
+			method:    "POST",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001/rotate",
+			configuration: ConfigurationRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "groupname",
+				Username:  "username",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 200,
+			expectedString: "https://hpc-webhook.dccn.nl:443/webhook/" + newToken,
+			expectedResult: true, // No error
+		},
+		{
+			method:    "POST",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001/rotate",
+			configuration: ConfigurationRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "groupname",
+				Username:  "username",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid configuration request: username missing`,
+			expectedResult: false, // Username missing
+		},
+		{
+			method:    "POST",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			configuration: ConfigurationRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "groupname",
+				Username:  "username",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid URL path '/configuration/550e8400-e29b-41d4-a716-446655440001'`,
+			expectedResult: false, // Invalid URL path
+		},
+		{
+			method:    "PUT",
+			configURL: "/configuration/550e8400-e29b-41d4-a716-446655440001/rotate",
+			configuration: ConfigurationRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "groupname",
+				Username:  "username",
+			},
+			testData: `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedStatus: 405,
+			expectedString: `Error 405 - Method not allowed: invalid method: PUT`,
+			expectedResult: false, // Invalid method
+		},
+	}
+
+	for _, c := range cases {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		api := API{
+			DB:                      db,
+			HPCWebhookHost:          "hpc-webhook.dccn.nl",
+			HPCWebhookInternalPort:  "5111",
+			HPCWebhookExternalPort:  "443",
+			TokenGracePeriodSeconds: 3600,
+		}
+
+		app := &api
+
+		// Obtain the test data
+		b := bytes.NewBuffer([]byte(c.testData))
+
+		// Make a new HTTP POST request with this body
+		req, err := http.NewRequest(c.method, c.configURL, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Modify the header
+		for key, value := range c.headerInfo {
+			req.Header.Set(key, value)
+		}
+
+		if c.expectedResult {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO hpc_webhook_token").
+				WithArgs(AnyTimeString{}, c.configuration.Hash, c.configuration.Groupname, c.configuration.Username).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^UPDATE hpc_webhook SET token").
+				WithArgs(sqlmock.AnyArg(), c.configuration.Hash, c.configuration.Groupname, c.configuration.Username).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+				WithArgs(c.configuration.Hash, c.configuration.Username, AuditActionRotate, sqlmock.AnyArg(), sqlmock.AnyArg(), "", AnyTimeString{}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			mock.ExpectBegin()
+			mock.ExpectExec("^DELETE FROM hpc_webhook_token").
+				WithArgs(AnyTimeString{}).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+
+			expectedRows := sqlmock.NewRows(itemColumnNames).
+				AddRow(1, c.configuration.Hash, c.configuration.Groupname, c.configuration.Username, "", "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", newToken, nil)
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+				WithArgs(c.configuration.Hash, c.configuration.Groupname, c.configuration.Username).
+				WillReturnRows(expectedRows)
+		}
+
+		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ConfigurationRotateHandler)
+
+		// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+		// directly and pass in our Request and ResponseRecorder.
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, c.expectedStatus)
+			return
+		}
+
+		if !c.expectedResult {
+			// Check the expected string
+			if rr.Body.String() != c.expectedString {
+				t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), c.expectedString)
+			}
+			continue
+		}
+
+		// Check the new payload URL, the previous one expires after the grace period
+		var response ConfigurationRotateResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Webhook.URL != c.expectedString {
+			t.Errorf("handler returned unexpected URL: got %v want %v", response.Webhook.URL, c.expectedString)
+		}
+		if _, err := time.Parse(time.RFC3339, response.PreviousExpires); err != nil {
+			t.Errorf("handler returned unexpected expiry time '%s': %s", response.PreviousExpires, err)
+		}
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestConfigurationTestHandler(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	cases := []struct {
+		method         string
+		configURL      string
+		testData       string
+		expectedStatus int
+		expectedString string
+	}{
+		{
+			method:         "POST",
+			configURL:      "/configuration/550e8400-e29b-41d4-a716-446655440001/test",
+			testData:       `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			expectedStatus: 200,
+		},
+		{
+			method:         "POST",
+			configURL:      "/configuration/660e8400-e29b-41d4-a716-446655440002/test",
+			testData:       `{"hash": "660e8400-e29b-41d4-a716-446655440002", "groupname": "groupname", "username": "username"}`,
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: <nil>`, // Unknown webhook
+		},
+		{
+			method:         "POST",
+			configURL:      "/configuration/550e8400-e29b-41d4-a716-446655440001/rotate",
+			testData:       `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid URL path '/configuration/550e8400-e29b-41d4-a716-446655440001/rotate'`,
+		},
+		{
+			method:         "GET",
+			configURL:      "/configuration/550e8400-e29b-41d4-a716-446655440001/test",
+			testData:       `{"hash": "550e8400-e29b-41d4-a716-446655440001", "groupname": "groupname", "username": "username"}`,
+			expectedStatus: 405,
+			expectedString: `Error 405 - Method not allowed: invalid method: GET`,
+		},
+	}
+
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+	if err := setupTestCase(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The working directory is created at registration
+	if err := os.MkdirAll(path.Join(testConfig.homeDir, "groupname", "username", WebhooksWorkDir, hash), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	api := API{
+		Store:              NewMemoryStore("hpc-webhook.dccn.nl", "443"),
+		Connector:          checkConnector{output: `{"script": "/home/groupname/username/test.sh"}`},
+		HomeDir:            testConfig.homeDir,
+		RelayNode:          "relaynode.dccn.nl",
+		PrivateKeyFilename: testConfig.privateKeyFilename,
+		PublicKeyFilename:  testConfig.publicKeyFilename,
+	}
+	if err := api.Store.AddWebhook(Item{Hash: hash, Groupname: "groupname", Username: "username", Token: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.configURL, bytes.NewBuffer([]byte(c.testData)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.ConfigurationTestHandler).ServeHTTP(rr, req)
+
+		if rr.Code != c.expectedStatus {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, c.expectedStatus)
+			continue
+		}
+		if c.expectedStatus != 200 {
+			if rr.Body.String() != c.expectedString {
+				t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), c.expectedString)
+			}
+			continue
+		}
+
+		// Every step passed, up to the placement of the payload
+		var response ConfigurationTestResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if !response.Passed || response.Webhook != hash || len(response.Steps) != 5 {
+			t.Errorf("handler returned unexpected result: %+v", response)
+		}
+	}
+}
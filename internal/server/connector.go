@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -10,6 +12,7 @@ type Connector interface {
 	NewSession(client *ssh.Client) (*ssh.Session, error)
 	Run(session *ssh.Session, command string) error
 	CombinedOutput(session *ssh.Session, command string) ([]byte, error)
+	OutputWithStdin(session *ssh.Session, command string, stdin []byte) ([]byte, error)
 	CloseSession(session *ssh.Session) error
 	CloseConnection(client *ssh.Client)
 }
@@ -39,6 +42,12 @@ func (c SSHConnector) CombinedOutput(session *ssh.Session, command string) ([]by
 	return session.CombinedOutput(command)
 }
 
+// OutputWithStdin makes it possible to mock a remote command reading its input from stdin
+func (c SSHConnector) OutputWithStdin(session *ssh.Session, command string, stdin []byte) ([]byte, error) {
+	session.Stdin = bytes.NewReader(stdin)
+	return session.Output(command)
+}
+
 // CloseSession makes it possible to mock the closing of a session
 func (c SSHConnector) CloseSession(session *ssh.Session) error {
 	return session.Close()
@@ -28,6 +28,10 @@ func (fc FakeConnector) CombinedOutput(session *ssh.Session, command string) ([]
 	return nil, nil
 }
 
+func (fc FakeConnector) OutputWithStdin(session *ssh.Session, command string, stdin []byte) ([]byte, error) {
+	return []byte("{}"), nil
+}
+
 func (fc FakeConnector) CloseSession(session *ssh.Session) error {
 	var err error
 	return err
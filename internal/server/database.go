@@ -4,34 +4,37 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 
 	// Postgres driver
 	_ "github.com/lib/pq"
 )
 
-// InitDB initializes the database
+// InitDB initializes the database.
+// A database that is not reachable yet is logged only, the server reports not to be ready until it is.
 func InitDB(dataSourceName string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", dataSourceName)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	if err = db.Ping(); err != nil {
-		log.Panic(err)
+	if err := db.Ping(); err != nil {
+		log.Warnf("Database is not reachable: %s", err)
 	}
 
-	return db, err
+	return db, nil
 }
 
-func addRow(db *sql.DB, hash string, groupname string, username string, description string, created string) error {
-	if !isValidWebhookID(hash) {
+func addRow(db *sql.DB, item Item) error {
+	if !isValidWebhookID(item.Hash) {
 		return errors.New("invalid webhook id")
 	}
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return databaseError("addRow", err)
 	}
 
 	defer func() {
@@ -43,10 +46,13 @@ func addRow(db *sql.DB, hash string, groupname string, username string, descript
 		}
 	}()
 
-	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook (hash, groupname, username, description, created) VALUES ($1, $2, $3, $4, $5)")
+	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook (hash, groupname, username, description, created, coalesce_seconds, concurrency, events, qsub_options, token, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)")
 
-	if _, err = tx.Exec(sqlStatement, hash, groupname, username, description, created); err != nil {
-		return err
+	// Webhooks without an expiry date never expire
+	expires := sql.NullString{String: item.Expires, Valid: item.Expires != ""}
+
+	if _, err = tx.Exec(sqlStatement, item.Hash, item.Groupname, item.Username, item.Description, item.Created, item.CoalesceSeconds, item.Concurrency, item.Events, item.QsubOptions, item.Token, expires); err != nil {
+		return databaseError("addRow", err)
 	}
 
 	return err
@@ -59,7 +65,7 @@ func deleteRow(db *sql.DB, hash string, groupname string, username string) error
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return databaseError("deleteRow", err)
 	}
 
 	defer func() {
@@ -74,12 +80,116 @@ func deleteRow(db *sql.DB, hash string, groupname string, username string) error
 	sqlStatement := fmt.Sprintf("DELETE FROM hpc_webhook WHERE hash = $1 AND groupname = $2 AND username = $3")
 
 	if _, err = tx.Exec(sqlStatement, hash, groupname, username); err != nil {
-		return err
+		return databaseError("deleteRow", err)
 	}
 
 	return err
 }
 
+// Update the settings and the enabled state of a webhook, only those given in the request
+func updateRow(db *sql.DB, update ConfigurationUpdateRequest) error {
+	if !isValidWebhookID(update.Hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	var assignments []string
+	var args []interface{}
+	if update.Description != nil {
+		args = append(args, *update.Description)
+		assignments = append(assignments, fmt.Sprintf("description = $%d", len(args)))
+	}
+	if update.CoalesceSeconds != nil {
+		args = append(args, *update.CoalesceSeconds)
+		assignments = append(assignments, fmt.Sprintf("coalesce_seconds = $%d", len(args)))
+	}
+	if update.Concurrency != nil {
+		args = append(args, concurrencyOrDefault(*update.Concurrency))
+		assignments = append(assignments, fmt.Sprintf("concurrency = $%d", len(args)))
+	}
+	if update.Events != nil {
+		args = append(args, *update.Events)
+		assignments = append(assignments, fmt.Sprintf("events = $%d", len(args)))
+	}
+	if update.QsubOptions != nil {
+		args = append(args, *update.QsubOptions)
+		assignments = append(assignments, fmt.Sprintf("qsub_options = $%d", len(args)))
+	}
+	if update.Enabled != nil {
+		args = append(args, *update.Enabled)
+		assignments = append(assignments, fmt.Sprintf("enabled = $%d", len(args)))
+	}
+	if len(assignments) == 0 {
+		return errors.New("nothing to update")
+	}
+	args = append(args, update.Hash, update.Groupname, update.Username)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("updateRow", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("UPDATE hpc_webhook SET %s WHERE hash = $%d AND groupname = $%d AND username = $%d", strings.Join(assignments, ", "), len(args)-2, len(args)-1, len(args))
+
+	var result sql.Result
+	if result, err = tx.Exec(sqlStatement, args...); err != nil {
+		return databaseError("updateRow", err)
+	}
+	err = checkRowsAffected(result)
+
+	return err
+}
+
+func updateRowEnabled(db *sql.DB, hash string, groupname string, username string, enabled bool) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("updateRowEnabled", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("UPDATE hpc_webhook SET enabled = $1 WHERE hash = $2 AND groupname = $3 AND username = $4")
+
+	var result sql.Result
+	if result, err = tx.Exec(sqlStatement, enabled, hash, groupname, username); err != nil {
+		return databaseError("updateRowEnabled", err)
+	}
+	err = checkRowsAffected(result)
+
+	return err
+}
+
+// Check that a statement changed at least one row
+func checkRowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return databaseError("checkRowsAffected", err)
+	}
+	if n == 0 {
+		return errors.New("webhook not found")
+	}
+	return nil
+}
+
 // Item corresponds to a row in the HPC webhook database
 type Item struct {
 	ID          int    `json:"-"` // Do not output this one
@@ -89,26 +199,98 @@ type Item struct {
 	Description string `json:"description"`
 	Created     string `json:"created"`
 	URL         string `json:"url"`
+
+	CoalesceSeconds int    `json:"coalesceSeconds"`
+	Concurrency     string `json:"concurrency"`
+	Enabled         bool   `json:"enabled"`
+	Events          string `json:"events"`
+	QsubOptions     string `json:"qsubOptions"`
+	Token           string `json:"-"`
+	Expires         string `json:"expires,omitempty"`
+	LastTriggered   string `json:"lastTriggered,omitempty"` // Time of the last delivery, only in the listing
 }
 
-// Find the rows with a specific hash (should be 1)
-func getRowHashOnly(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, hash string) ([]Item, error) {
-	rows, err := db.Query("SELECT id, hash, groupname, username, description, created FROM hpc_webhook WHERE hash = $1", hash)
-	if err != nil {
-		return nil, err
+// itemColumns are the hpc_webhook columns selected into an Item, in scan order
+const itemColumns = "id, hash, groupname, username, description, created, coalesce_seconds, concurrency, enabled, events, qsub_options, token, expires"
+
+// Scan the current row into an item, followed by the extra columns that are selected
+func scanItem(rows *sql.Rows, hpcWebhookHost string, hpcWebhookExternalPort string, extra ...interface{}) (Item, error) {
+	p := Item{}
+	var expires sql.NullString
+	dest := append([]interface{}{&p.ID, &p.Hash, &p.Groupname, &p.Username, &p.Description, &p.Created, &p.CoalesceSeconds, &p.Concurrency, &p.Enabled, &p.Events, &p.QsubOptions, &p.Token, &expires}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return p, databaseError("scanItems", err)
 	}
-	defer rows.Close()
+	p.Expires = expires.String
+	p.URL = fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, p.Token)
+	return p, nil
+}
 
+// Scan the selected rows into a list of items
+func scanItems(rows *sql.Rows, hpcWebhookHost string, hpcWebhookExternalPort string) ([]Item, error) {
 	var list []Item
 	for rows.Next() {
-		p := Item{}
-		if err := rows.Scan(&p.ID, &p.Hash, &p.Groupname, &p.Username, &p.Description, &p.Created); err != nil {
+		p, err := scanItem(rows, hpcWebhookHost, hpcWebhookExternalPort)
+		if err != nil {
 			return nil, err
 		}
-		p.URL = fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, p.Hash)
 		list = append(list, p)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("scanItems", err)
+	}
+	return list, nil
+}
+
+// Find the rows of which the expiry date has passed.
+// The expiry dates are compared as strings, which requires them to be stored in the form of formatExpires.
+func getExpiredRows(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, now string) ([]Item, error) {
+	rows, err := db.Query("SELECT "+itemColumns+" FROM hpc_webhook WHERE expires IS NOT NULL AND expires <= $1", now)
+	if err != nil {
+		return nil, databaseError("getExpiredRows", err)
+	}
+	defer rows.Close()
+
+	return scanItems(rows, hpcWebhookHost, hpcWebhookExternalPort)
+}
+
+// Count the webhooks of a specific user
+func countUserRows(db *sql.DB, groupname string, username string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM hpc_webhook WHERE groupname = $1 AND username = $2", groupname, username).Scan(&count)
+	return count, databaseError("countUserRows", err)
+}
+
+// Find the rows with a specific hash (should be 1)
+func getRowHashOnly(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, hash string) ([]Item, error) {
+	rows, err := db.Query("SELECT "+itemColumns+" FROM hpc_webhook WHERE hash = $1", hash)
+	if err != nil {
+		return nil, databaseError("getRowHashOnly", err)
+	}
+	defer rows.Close()
+
+	list, err := scanItems(rows, hpcWebhookHost, hpcWebhookExternalPort)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 1 {
+		return nil, fmt.Errorf("invalid getRow result: list should have length 1 but has length %d", len(list))
+	}
+
+	return list, nil
+}
+
+// Find the rows with a specific public token (should be 1).
+// Previous tokens are accepted until the grace period after their rotation has passed.
+func getRowToken(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, token string, now string) ([]Item, error) {
+	rows, err := db.Query("SELECT "+itemColumns+" FROM hpc_webhook WHERE token = $1 OR hash IN (SELECT hash FROM hpc_webhook_token WHERE token = $1 AND expires > $2)", token, now)
+	if err != nil {
+		return nil, databaseError("getRowToken", err)
+	}
+	defer rows.Close()
+
+	list, err := scanItems(rows, hpcWebhookHost, hpcWebhookExternalPort)
+	if err != nil {
 		return nil, err
 	}
 	if len(list) > 1 {
@@ -120,51 +302,664 @@ func getRowHashOnly(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort st
 
 // Find the rows with a specific hash (should be 1)
 func getRow(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, hash string, groupname string, username string) ([]Item, error) {
-	rows, err := db.Query("SELECT id, hash, groupname, username, description, created FROM hpc_webhook WHERE hash = $1 AND groupname = $2 AND username = $3", hash, groupname, username)
+	rows, err := db.Query("SELECT "+itemColumns+" FROM hpc_webhook WHERE hash = $1 AND groupname = $2 AND username = $3", hash, groupname, username)
+	if err != nil {
+		return nil, databaseError("getRow", err)
+	}
+	defer rows.Close()
+
+	list, err := scanItems(rows, hpcWebhookHost, hpcWebhookExternalPort)
 	if err != nil {
 		return nil, err
 	}
+	if len(list) > 1 {
+		return nil, fmt.Errorf("invalid getRow result: list should have length 1 but has length %d", len(list))
+	}
+
+	return list, nil
+}
+
+// Escape the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Find a page of the rows for a specific groupname, username, with the time of their last delivery.
+// Returns the cursor of the next page, which is empty when there are no more rows.
+func getListRows(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, groupname string, username string, options ListOptions) ([]Item, string, error) {
+	options = options.withDefaults()
+	args := []interface{}{groupname, username}
+	conditions := []string{"groupname = $1", "username = $2"}
+	if options.Description != "" {
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(options.Description))+"%")
+		conditions = append(conditions, fmt.Sprintf(`LOWER(description) LIKE $%d ESCAPE '\'`, len(args)))
+	}
+	if options.Enabled != nil {
+		args = append(args, *options.Enabled)
+		conditions = append(conditions, fmt.Sprintf("enabled = $%d", len(args)))
+	}
+	if options.Provider != "" {
+		args = append(args, options.Provider)
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM hpc_webhook_delivery d WHERE d.hash = hpc_webhook.hash AND d.provider = $%d)", len(args)))
+	}
+
+	// Continue after the last row of the previous page
+	var after []string
+	if options.Cursor != "" {
+		c, err := decodeListCursor(options.Cursor, options.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case options.Sort == ListSortCreated:
+			args = append(args, c.ID)
+			after = append(after, fmt.Sprintf("id > $%d", len(args)))
+		case c.LastTriggered != "":
+			args = append(args, c.LastTriggered, c.ID)
+			after = append(after, fmt.Sprintf("(last_triggered < $%d OR (last_triggered = $%d AND id > $%d) OR last_triggered IS NULL)", len(args)-1, len(args)-1, len(args)))
+		default:
+			args = append(args, c.ID)
+			after = append(after, fmt.Sprintf("last_triggered IS NULL AND id > $%d", len(args)))
+		}
+	}
+
+	order := "id"
+	if options.Sort == ListSortLastTriggered {
+		order = "last_triggered IS NULL, last_triggered DESC, id"
+	}
+
+	sqlStatement := "SELECT " + itemColumns + ", last_triggered FROM (SELECT " + itemColumns +
+		", (SELECT MAX(d.received) FROM hpc_webhook_delivery d WHERE d.hash = hpc_webhook.hash) AS last_triggered" +
+		" FROM hpc_webhook WHERE " + strings.Join(conditions, " AND ") + ") AS w"
+	if len(after) > 0 {
+		sqlStatement += " WHERE " + strings.Join(after, " AND ")
+	}
+	// Select one row more than the page, to find out whether there is a next page
+	args = append(args, options.Limit+1)
+	sqlStatement += fmt.Sprintf(" ORDER BY %s LIMIT $%d", order, len(args))
+
+	rows, err := db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, "", databaseError("getListRows", err)
+	}
 	defer rows.Close()
 
 	var list []Item
 	for rows.Next() {
-		p := Item{}
-		if err := rows.Scan(&p.ID, &p.Hash, &p.Groupname, &p.Username, &p.Description, &p.Created); err != nil {
-			return nil, err
+		var lastTriggered sql.NullString
+		p, err := scanItem(rows, hpcWebhookHost, hpcWebhookExternalPort, &lastTriggered)
+		if err != nil {
+			return nil, "", err
 		}
-		p.URL = fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, p.Hash)
+		p.LastTriggered = lastTriggered.String
 		list = append(list, p)
 	}
-	if rows.Err() != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return nil, "", databaseError("getListRows", err)
 	}
-	if len(list) > 1 {
-		return nil, fmt.Errorf("invalid getRow result: list should have length 1 but has length %d", len(list))
+
+	if len(list) <= options.Limit {
+		return list, "", nil
+	}
+	list = list[:options.Limit]
+	return list, encodeListCursor(options.Sort, list[len(list)-1]), nil
+}
+
+// Delivery states in the delivery history
+const (
+	DeliveryStatusPending     = "pending"     // DeliveryStatusPending denotes a delivery waiting to be submitted
+	DeliveryStatusSubmitting  = "submitting"  // DeliveryStatusSubmitting denotes a delivery of which the job is being submitted
+	DeliveryStatusSubmitted   = "submitted"   // DeliveryStatusSubmitted denotes a delivery that resulted in a job submission
+	DeliveryStatusInterrupted = "interrupted" // DeliveryStatusInterrupted denotes a delivery of which the submission was cut off by the server stopping, the job may have been submitted
+	DeliveryStatusFailed      = "failed"      // DeliveryStatusFailed denotes a delivery of which the submission failed
+	DeliveryStatusSuperseded  = "superseded"  // DeliveryStatusSuperseded denotes a delivery replaced by a newer one within the coalescing window
+	DeliveryStatusSkipped     = "skipped"     // DeliveryStatusSkipped denotes a delivery dropped because the previous job was still active
+)
+
+func addDeliveryRow(db *sql.DB, delivery string, hash string, received string, status string, trace string, provider string) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("addDeliveryRow", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook_delivery (delivery, hash, received, status, trace, provider) VALUES ($1, $2, $3, $4, $5, $6)")
+
+	if _, err = tx.Exec(sqlStatement, delivery, hash, received, status, trace, provider); err != nil {
+		return databaseError("addDeliveryRow", err)
+	}
+
+	return err
+}
+
+func updateDeliveryStatus(db *sql.DB, delivery string, status string, job string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("updateDeliveryStatus", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("UPDATE hpc_webhook_delivery SET status = $1, job = $2 WHERE delivery = $3")
+
+	if _, err = tx.Exec(sqlStatement, status, job, delivery); err != nil {
+		return databaseError("updateDeliveryStatus", err)
+	}
+
+	return err
+}
+
+// Find the job id of the most recent submission of a specific webhook (empty if there is none)
+func getLastJob(db *sql.DB, hash string) (string, error) {
+	rows, err := db.Query("SELECT job FROM hpc_webhook_delivery WHERE hash = $1 AND status = $2 ORDER BY id DESC LIMIT 1", hash, DeliveryStatusSubmitted)
+	if err != nil {
+		return "", databaseError("getLastJob", err)
+	}
+	defer rows.Close()
+
+	var job string
+	for rows.Next() {
+		if err := rows.Scan(&job); err != nil {
+			return "", databaseError("getLastJob", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", databaseError("getLastJob", err)
+	}
+
+	return job, nil
+}
+
+// pendingDelivery is a delivery of which the submission has not finished
+type pendingDelivery struct {
+	Delivery string
+	Hash     string
+	Status   string
+	Trace    string
+}
+
+// Find the deliveries waiting to be submitted, or of which the job is being submitted, oldest first
+func getPendingDeliveries(db *sql.DB) ([]pendingDelivery, error) {
+	rows, err := db.Query("SELECT delivery, hash, status, trace FROM hpc_webhook_delivery WHERE status IN ($1, $2) ORDER BY id",
+		DeliveryStatusPending, DeliveryStatusSubmitting)
+	if err != nil {
+		return nil, databaseError("getPendingDeliveries", err)
+	}
+	defer rows.Close()
+
+	var deliveries []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.Delivery, &d.Hash, &d.Status, &d.Trace); err != nil {
+			return nil, databaseError("getPendingDeliveries", err)
+		}
+		d.Status = strings.TrimSpace(d.Status)
+		d.Trace = strings.TrimSpace(d.Trace)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("getPendingDeliveries", err)
+	}
+
+	return deliveries, nil
+}
+
+// DeliveryRecord is a delivery in the delivery history
+type DeliveryRecord struct {
+	ID       int    `json:"id,omitempty"`
+	Delivery string `json:"delivery"`
+	Hash     string `json:"webhook"`
+	Received string `json:"received"`
+	Status   string `json:"status"`
+	Job      string `json:"job,omitempty"`
+	Trace    string `json:"trace,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// DeliveryFilter selects deliveries in the delivery history, empty fields match any delivery
+type DeliveryFilter struct {
+	Hash   string
+	Status string
+	Trace  string
+}
+
+// Find the deliveries matching a filter, oldest first
+func getDeliveryRows(db *sql.DB, filter DeliveryFilter) ([]DeliveryRecord, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Hash != "" {
+		args = append(args, filter.Hash)
+		conditions = append(conditions, fmt.Sprintf("hash = $%d", len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if filter.Trace != "" {
+		args = append(args, filter.Trace)
+		conditions = append(conditions, fmt.Sprintf("trace = $%d", len(args)))
 	}
 
+	sqlStatement := "SELECT id, delivery, hash, received, status, job, trace, provider FROM hpc_webhook_delivery"
+	if len(conditions) > 0 {
+		sqlStatement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(sqlStatement+" ORDER BY id", args...)
+	if err != nil {
+		return nil, databaseError("getDeliveryRows", err)
+	}
+	defer rows.Close()
+
+	var list []DeliveryRecord
+	for rows.Next() {
+		r := DeliveryRecord{}
+		if err := rows.Scan(&r.ID, &r.Delivery, &r.Hash, &r.Received, &r.Status, &r.Job, &r.Trace, &r.Provider); err != nil {
+			return nil, databaseError("getDeliveryRows", err)
+		}
+		r.Trace = strings.TrimSpace(r.Trace)
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("getDeliveryRows", err)
+	}
 	return list, nil
 }
 
-// Find the rows for a specific groupname, username
-func getListRows(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, groupname string, username string) ([]Item, error) {
-	rows, err := db.Query("SELECT id, hash, groupname, username, description, created FROM hpc_webhook WHERE groupname = $1, username = $2", groupname, username)
+// Replace the public token of a webhook, keeping the previous token valid until it expires
+func rotateToken(db *sql.DB, hash string, groupname string, username string, token string, expires string) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+	if !isValidWebhookID(token) {
+		return errors.New("invalid token")
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return databaseError("rotateToken", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook_token (token, hash, expires) SELECT token, hash, $1 FROM hpc_webhook WHERE hash = $2 AND groupname = $3 AND username = $4")
+
+	var result sql.Result
+	if result, err = tx.Exec(sqlStatement, expires, hash, groupname, username); err != nil {
+		return databaseError("rotateToken", err)
+	}
+	if err = checkRowsAffected(result); err != nil {
+		return err
+	}
+
+	sqlStatement = fmt.Sprintf("UPDATE hpc_webhook SET token = $1 WHERE hash = $2 AND groupname = $3 AND username = $4")
+
+	if _, err = tx.Exec(sqlStatement, token, hash, groupname, username); err != nil {
+		return databaseError("rotateToken", err)
+	}
+
+	return err
+}
+
+// Remove previous tokens of which the grace period has passed
+func deleteExpiredTokens(db *sql.DB, now string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("deleteExpiredTokens", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("DELETE FROM hpc_webhook_token WHERE expires <= $1")
+
+	if _, err = tx.Exec(sqlStatement, now); err != nil {
+		return databaseError("deleteExpiredTokens", err)
+	}
+
+	return err
+}
+
+// Audit actions
+const (
+	AuditActionAdd       = "add"        // AuditActionAdd denotes the registration of a webhook
+	AuditActionInfo      = "info"       // AuditActionInfo denotes a request for the details of a webhook
+	AuditActionList      = "list"       // AuditActionList denotes a request for the webhooks of a user
+	AuditActionUpdate    = "update"     // AuditActionUpdate denotes a change of the settings of a webhook
+	AuditActionEnable    = "enable"     // AuditActionEnable denotes the enabling of a webhook
+	AuditActionRotate    = "rotate"     // AuditActionRotate denotes the rotation of the public token of a webhook
+	AuditActionDisable   = "disable"    // AuditActionDisable denotes the disabling of a webhook
+	AuditActionDelete    = "delete"     // AuditActionDelete denotes the removal of a webhook
+	AuditActionRevokeKey = "revoke-key" // AuditActionRevokeKey denotes the removal of the server public key from the authorized keys of a user
+	AuditActionRepair    = "repair"     // AuditActionRepair denotes the repair of a problem found by the doctor in the home directory of a user
+	AuditActionTest      = "test"       // AuditActionTest denotes a test of a webhook up to the submission of its script, with its result
+	AuditActionDeliver   = "deliver"    // AuditActionDeliver denotes a delivery of a payload, with its result
+)
+
+// AuditRecord is an entry in the audit trail
+type AuditRecord struct {
+	ID       int    `json:"id,omitempty"`
+	Hash     string `json:"webhook"`
+	Username string `json:"username"`
+	Action   string `json:"action"`
+	Detail   string `json:"detail"`
+	Source   string `json:"source"`
+	Trace    string `json:"trace,omitempty"` // Trace of the delivery, if any
+	Created  string `json:"created"`
+}
+
+func addAuditRow(db *sql.DB, hash string, username string, action string, detail string, source string, trace string, created string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("addAuditRow", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook_audit (hash, username, action, detail, source, trace, created) VALUES ($1, $2, $3, $4, $5, $6, $7)")
+
+	if _, err = tx.Exec(sqlStatement, hash, username, action, detail, source, trace, created); err != nil {
+		return databaseError("addAuditRow", err)
+	}
+
+	return err
+}
+
+// AuditFilter selects entries in the audit trail, empty fields match any entry
+type AuditFilter struct {
+	Hash     string
+	Username string
+	Trace    string
+	From     string // Entries created at or after this time
+	To       string // Entries created before this time
+}
+
+// Find the audit entries matching a filter, oldest first
+func getAuditRows(db *sql.DB, filter AuditFilter) ([]AuditRecord, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Hash != "" {
+		args = append(args, filter.Hash)
+		conditions = append(conditions, fmt.Sprintf("hash = $%d", len(args)))
+	}
+	if filter.Username != "" {
+		args = append(args, filter.Username)
+		conditions = append(conditions, fmt.Sprintf("username = $%d", len(args)))
+	}
+	if filter.Trace != "" {
+		args = append(args, filter.Trace)
+		conditions = append(conditions, fmt.Sprintf("trace = $%d", len(args)))
+	}
+	if filter.From != "" {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("created >= $%d", len(args)))
+	}
+	if filter.To != "" {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("created < $%d", len(args)))
+	}
+
+	sqlStatement := "SELECT id, hash, username, action, detail, source, trace, created FROM hpc_webhook_audit"
+	if len(conditions) > 0 {
+		sqlStatement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(sqlStatement+" ORDER BY id", args...)
+	if err != nil {
+		return nil, databaseError("getAuditRows", err)
 	}
 	defer rows.Close()
 
-	var list []Item
+	var list []AuditRecord
 	for rows.Next() {
-		p := Item{}
-		if err := rows.Scan(&p.ID, &p.Hash, &p.Groupname, &p.Username, &p.Description, &p.Created); err != nil {
-			return nil, err
+		r := AuditRecord{}
+		if err := rows.Scan(&r.ID, &r.Hash, &r.Username, &r.Action, &r.Detail, &r.Source, &r.Trace, &r.Created); err != nil {
+			return nil, databaseError("getAuditRows", err)
 		}
-		p.URL = fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, p.Hash)
-		list = append(list, p)
+		r.Hash = strings.TrimSpace(r.Hash)
+		r.Trace = strings.TrimSpace(r.Trace)
+		list = append(list, r)
 	}
-	if rows.Err() != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("getAuditRows", err)
+	}
+	return list, nil
+}
+
+// KeyRotation stores the progress of the replacement of the server key pair
+type KeyRotation struct {
+	ID                         int
+	PrivateKeyFilename         string
+	PublicKeyFilename          string
+	PreviousPrivateKeyFilename string
+	PreviousPublicKeyFilename  string
+	Started                    string
+	Finished                   string // Empty while users are being migrated to the new key
+}
+
+// webhookUser is a user with registered webhooks
+type webhookUser struct {
+	Groupname string
+	Username  string
+}
+
+func addKeyRotation(db *sql.DB, rotation KeyRotation) (int, error) {
+	var id int
+	err := db.QueryRow("INSERT INTO hpc_webhook_key_rotation (private_key, public_key, previous_private_key, previous_public_key, started) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		rotation.PrivateKeyFilename, rotation.PublicKeyFilename, rotation.PreviousPrivateKeyFilename, rotation.PreviousPublicKeyFilename, rotation.Started).Scan(&id)
+	return id, databaseError("addKeyRotation", err)
+}
+
+// Find the most recent key rotation, if any
+func getLatestKeyRotation(db *sql.DB) (KeyRotation, bool, error) {
+	var rotation KeyRotation
+	var finished sql.NullString
+	err := db.QueryRow("SELECT id, private_key, public_key, previous_private_key, previous_public_key, started, finished FROM hpc_webhook_key_rotation ORDER BY id DESC LIMIT 1").
+		Scan(&rotation.ID, &rotation.PrivateKeyFilename, &rotation.PublicKeyFilename, &rotation.PreviousPrivateKeyFilename, &rotation.PreviousPublicKeyFilename, &rotation.Started, &finished)
+	if err == sql.ErrNoRows {
+		return rotation, false, nil
 	}
+	if err != nil {
+		return rotation, false, databaseError("getLatestKeyRotation", err)
+	}
+	rotation.Finished = finished.String
+	return rotation, true, nil
+}
 
+func finishKeyRotation(db *sql.DB, id int, finished string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("finishKeyRotation", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("UPDATE hpc_webhook_key_rotation SET finished = $1 WHERE id = $2")
+
+	if _, err = tx.Exec(sqlStatement, finished, id); err != nil {
+		return databaseError("finishKeyRotation", err)
+	}
+
+	return err
+}
+
+// Record that the new key of a rotation has been added to the authorized keys of a user
+func addKeyMigration(db *sql.DB, rotation int, groupname string, username string, migrated string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("addKeyMigration", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	sqlStatement := fmt.Sprintf("INSERT INTO hpc_webhook_key_migration (rotation, groupname, username, migrated) VALUES ($1, $2, $3, $4)")
+
+	if _, err = tx.Exec(sqlStatement, rotation, groupname, username, migrated); err != nil {
+		return databaseError("addKeyMigration", err)
+	}
+
+	return err
+}
+
+func scanUsers(rows *sql.Rows) ([]webhookUser, error) {
+	var users []webhookUser
+	for rows.Next() {
+		var u webhookUser
+		if err := rows.Scan(&u.Groupname, &u.Username); err != nil {
+			return nil, databaseError("scanUsers", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("scanUsers", err)
+	}
+	return users, nil
+}
+
+// Find all users with registered webhooks
+func getUsers(db *sql.DB) ([]webhookUser, error) {
+	rows, err := db.Query("SELECT DISTINCT groupname, username FROM hpc_webhook ORDER BY groupname, username")
+	if err != nil {
+		return nil, databaseError("getUsers", err)
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// Find the users with registered webhooks that have not been migrated to the new key of a rotation
+func getUnmigratedUsers(db *sql.DB, rotation int) ([]webhookUser, error) {
+	rows, err := db.Query("SELECT DISTINCT groupname, username FROM hpc_webhook WHERE (groupname, username) NOT IN (SELECT groupname, username FROM hpc_webhook_key_migration WHERE rotation = $1) ORDER BY groupname, username", rotation)
+	if err != nil {
+		return nil, databaseError("getUnmigratedUsers", err)
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// WebhookFilter selects webhooks across users, empty fields match any webhook
+type WebhookFilter struct {
+	Groupname string
+	Username  string
+	Enabled   *bool
+}
+
+// Find the rows matching a filter
+func getFilteredRows(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, filter WebhookFilter) ([]Item, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Groupname != "" {
+		args = append(args, filter.Groupname)
+		conditions = append(conditions, fmt.Sprintf("groupname = $%d", len(args)))
+	}
+	if filter.Username != "" {
+		args = append(args, filter.Username)
+		conditions = append(conditions, fmt.Sprintf("username = $%d", len(args)))
+	}
+	if filter.Enabled != nil {
+		args = append(args, *filter.Enabled)
+		conditions = append(conditions, fmt.Sprintf("enabled = $%d", len(args)))
+	}
+
+	sqlStatement := "SELECT " + itemColumns + " FROM hpc_webhook"
+	if len(conditions) > 0 {
+		sqlStatement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(sqlStatement+" ORDER BY id", args...)
+	if err != nil {
+		return nil, databaseError("getFilteredRows", err)
+	}
+	defer rows.Close()
+
+	return scanItems(rows, hpcWebhookHost, hpcWebhookExternalPort)
+}
+
+// UserStats contains the number of webhooks of a user, the deliveries waiting to be submitted,
+// and the failed deliveries since a certain time
+type UserStats struct {
+	Groupname   string `json:"groupname"`
+	Username    string `json:"username"`
+	Webhooks    int    `json:"webhooks"`
+	Queued      int    `json:"queued"`
+	Failures    int    `json:"failures"`
+	LastFailure string `json:"lastFailure,omitempty"`
+}
+
+// Find the delivery statistics of every user with registered webhooks
+func getUserStats(db *sql.DB, since string) ([]UserStats, error) {
+	rows, err := db.Query(`SELECT w.groupname, w.username, COUNT(DISTINCT w.hash),
+		SUM(CASE WHEN d.status = $1 THEN 1 ELSE 0 END),
+		SUM(CASE WHEN d.status = $2 AND d.received >= $3 THEN 1 ELSE 0 END),
+		MAX(CASE WHEN d.status = $2 THEN d.received END)
+		FROM hpc_webhook w LEFT JOIN hpc_webhook_delivery d ON d.hash = w.hash
+		GROUP BY w.groupname, w.username ORDER BY w.groupname, w.username`, DeliveryStatusPending, DeliveryStatusFailed, since)
+	if err != nil {
+		return nil, databaseError("getUserStats", err)
+	}
+	defer rows.Close()
+
+	var list []UserStats
+	for rows.Next() {
+		s := UserStats{}
+		var lastFailure sql.NullString
+		if err := rows.Scan(&s.Groupname, &s.Username, &s.Webhooks, &s.Queued, &s.Failures, &lastFailure); err != nil {
+			return nil, databaseError("getUserStats", err)
+		}
+		s.LastFailure = lastFailure.String
+		list = append(list, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, databaseError("getUserStats", err)
+	}
 	return list, nil
 }
@@ -8,12 +8,22 @@ import (
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 )
 
+// itemColumnNames are the hpc_webhook columns scanned into an Item
+var itemColumnNames = []string{"id", "hash", "groupname", "username", "description", "created", "coalesce_seconds", "concurrency", "enabled", "events", "qsub_options", "token", "expires"}
+
+// keyRotationColumnNames are the hpc_webhook_key_rotation columns scanned into a KeyRotation
+var keyRotationColumnNames = []string{"id", "private_key", "public_key", "previous_private_key", "previous_public_key", "started", "finished"}
+
 func TestAddRow(t *testing.T) {
 	configuration := ConfigurationRequest{
-		Hash:        "550e8400-e29b-41d4-a716-446655440001",
-		Groupname:   "dccngroup",
-		Username:    "dccnuser",
-		Description: "description",
+		Hash:            "550e8400-e29b-41d4-a716-446655440001",
+		Groupname:       "dccngroup",
+		Username:        "dccnuser",
+		Description:     "description",
+		CoalesceSeconds: 30,
+		Concurrency:     ConcurrencySkip,
+		Events:          "push,release",
+		QsubOptions:     "-l walltime=00:10:00",
 	}
 
 	db, mock, err := sqlmock.New()
@@ -27,16 +37,28 @@ func TestAddRow(t *testing.T) {
 		configuration.Groupname,
 		configuration.Username,
 		configuration.Description,
-		"2019-03-11 10:10:00").
+		"2019-03-11 10:10:00",
+		configuration.CoalesceSeconds,
+		configuration.Concurrency,
+		configuration.Events,
+		configuration.QsubOptions,
+		configuration.Hash,
+		nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	if err = addRow(db,
-		configuration.Hash,
-		configuration.Groupname,
-		configuration.Username,
-		configuration.Description,
-		"2019-03-11 10:10:00"); err != nil {
+	if err = addRow(db, Item{
+		Hash:            configuration.Hash,
+		Groupname:       configuration.Groupname,
+		Username:        configuration.Username,
+		Description:     configuration.Description,
+		Created:         "2019-03-11 10:10:00",
+		CoalesceSeconds: configuration.CoalesceSeconds,
+		Concurrency:     configuration.Concurrency,
+		Events:          configuration.Events,
+		QsubOptions:     configuration.QsubOptions,
+		Token:           configuration.Hash,
+	}); err != nil {
 		t.Errorf("error was not expected while adding row: %s", err)
 	}
 
@@ -58,9 +80,9 @@ func TestDeleteRow(t *testing.T) {
 
 	expectedGroupname := "dccngroup"
 	expectedUsername := "dccnuser"
-	sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
-		AddRow(1, hash1, expectedGroupname, expectedUsername, "This is script 1", "2019-03-11 10:10:00").
-		AddRow(2, hash2, expectedGroupname, expectedUsername, "This is script 2", "2019-03-11 10:20:00")
+	sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash1, expectedGroupname, expectedUsername, "This is script 1", "2019-03-11 10:10:00", 0, "allow", true, "", "", hash1, nil).
+		AddRow(2, hash2, expectedGroupname, expectedUsername, "This is script 2", "2019-03-11 10:20:00", 0, "allow", true, "", "", hash2, nil)
 
 	mock.ExpectBegin()
 	mock.ExpectExec("^DELETE FROM hpc_webhook").
@@ -92,10 +114,10 @@ func TestGetRowHashOnly(t *testing.T) {
 	expectedUsername := "dccnuser"
 	expectedDescription := "This is script 1"
 	expectedCreated := "2019-03-11 10:10:00"
-	expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
-		AddRow(1, hash, expectedGroupname, expectedUsername, expectedDescription, expectedCreated)
+	expectedRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, expectedGroupname, expectedUsername, expectedDescription, expectedCreated, 0, "allow", true, "", "", hash, nil)
 
-	mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook WHERE").
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook WHERE").
 		WithArgs(hash).
 		WillReturnRows(expectedRows)
 
@@ -109,7 +131,10 @@ func TestGetRowHashOnly(t *testing.T) {
 			Username:    expectedUsername,
 			Description: expectedDescription,
 			Created:     expectedCreated,
+			Concurrency: "allow",
+			Enabled:     true,
 			URL:         fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, hash),
+			Token:       hash,
 		},
 	}
 
@@ -142,10 +167,10 @@ func TestGetRow(t *testing.T) {
 	expectedUsername := "dccnuser"
 	expectedDescription := "This is script 1"
 	expectedCreated := "2019-03-11 10:10:00"
-	expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
-		AddRow(1, hash, expectedGroupname, expectedUsername, expectedDescription, expectedCreated)
+	expectedRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, expectedGroupname, expectedUsername, expectedDescription, expectedCreated, 0, "allow", true, "", "", hash, nil)
 
-	mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook WHERE").
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook WHERE").
 		WithArgs(hash, expectedGroupname, expectedUsername).
 		WillReturnRows(expectedRows)
 
@@ -159,7 +184,10 @@ func TestGetRow(t *testing.T) {
 			Username:    expectedUsername,
 			Description: expectedDescription,
 			Created:     expectedCreated,
+			Concurrency: "allow",
+			Enabled:     true,
 			URL:         fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, hash),
+			Token:       hash,
 		},
 	}
 
@@ -198,12 +226,12 @@ func TestGetListRows(t *testing.T) {
 	expectedDescription2 := "This is test2"
 	expectedCreated2 := "2019-03-11 11:11:00"
 
-	expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
-		AddRow(1, hash1, expectedGroupname1, expectedUsername1, expectedDescription1, expectedCreated1).
-		AddRow(2, hash2, expectedGroupname2, expectedUsername2, expectedDescription2, expectedCreated2)
+	expectedRows := sqlmock.NewRows(append(itemColumnNames, "last_triggered")).
+		AddRow(1, hash1, expectedGroupname1, expectedUsername1, expectedDescription1, expectedCreated1, 0, "allow", true, "", "", hash1, nil, "2019-03-12 10:10:00").
+		AddRow(2, hash2, expectedGroupname2, expectedUsername2, expectedDescription2, expectedCreated2, 0, "allow", true, "", "", hash2, nil, nil)
 
-	mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook").
-		WithArgs(expectedGroupname1, expectedUsername1).
+	mock.ExpectQuery("^SELECT (.+) FROM \\(SELECT (.+) FROM hpc_webhook WHERE groupname = \\$1 AND username = \\$2\\) AS w ORDER BY id LIMIT \\$3").
+		WithArgs(expectedGroupname1, expectedUsername1, DefaultListLimit+1).
 		WillReturnRows(expectedRows)
 
 	hpcWebhookHost := "hpc-webhook.dccn.nl"
@@ -216,7 +244,12 @@ func TestGetListRows(t *testing.T) {
 			Username:    expectedUsername1,
 			Description: expectedDescription1,
 			Created:     expectedCreated1,
+			Concurrency: "allow",
+			Enabled:     true,
 			URL:         fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, hash1),
+			Token:       hash1,
+
+			LastTriggered: "2019-03-12 10:10:00",
 		},
 		{
 			ID:          2,
@@ -225,14 +258,20 @@ func TestGetListRows(t *testing.T) {
 			Username:    expectedUsername2,
 			Description: expectedDescription2,
 			Created:     expectedCreated2,
+			Concurrency: "allow",
+			Enabled:     true,
 			URL:         fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, hash2),
+			Token:       hash2,
 		},
 	}
 
-	list, err = getListRows(db, hpcWebhookHost, hpcWebhookExternalPort, expectedGroupname1, expectedUsername1)
+	list, nextCursor, err := getListRows(db, hpcWebhookHost, hpcWebhookExternalPort, expectedGroupname1, expectedUsername1, ListOptions{})
 	if err != nil {
 		t.Errorf("error was not expected while getting row: %s", err)
 	}
+	if nextCursor != "" {
+		t.Errorf("Expected no next page, but got cursor '%s'", nextCursor)
+	}
 
 	if !reflect.DeepEqual(list, listExpected) {
 		t.Errorf("Lists are not equal: found length %d, but has %d", len(list), len(listExpected))
@@ -242,3 +281,240 @@ func TestGetListRows(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestAddDeliveryRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	delivery := "7d1c6f2e-5a0b-4c3d-9e8f-0a1b2c3d4e5f"
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	received := "2019-03-11 10:10:00"
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO hpc_webhook_delivery").
+		WithArgs(delivery, hash, received, DeliveryStatusPending, "", "github").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = addDeliveryRow(db, delivery, hash, received, DeliveryStatusPending, "", "github"); err != nil {
+		t.Errorf("error was not expected while adding delivery row: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateDeliveryStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	delivery := "7d1c6f2e-5a0b-4c3d-9e8f-0a1b2c3d4e5f"
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook_delivery SET status").
+		WithArgs(DeliveryStatusSubmitted, "34986226.dccn-l029.dccn.nl", delivery).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = updateDeliveryStatus(db, delivery, DeliveryStatusSubmitted, "34986226.dccn-l029.dccn.nl"); err != nil {
+		t.Errorf("error was not expected while updating delivery status: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetLastJob(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	expectedJob := "34986226.dccn-l029.dccn.nl"
+
+	expectedRows := sqlmock.NewRows([]string{"job"}).AddRow(expectedJob)
+	mock.ExpectQuery("^SELECT job FROM hpc_webhook_delivery WHERE").
+		WithArgs(hash, DeliveryStatusSubmitted).
+		WillReturnRows(expectedRows)
+
+	job, err := getLastJob(db, hash)
+	if err != nil {
+		t.Errorf("error was not expected while getting the last job: %s", err)
+	}
+	if job != expectedJob {
+		t.Errorf("Expected job '%s', but got '%s'", expectedJob, job)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateRowEnabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	expectedGroupname := "dccngroup"
+	expectedUsername := "dccnuser"
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook SET enabled").
+		WithArgs(false, hash, expectedGroupname, expectedUsername).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = updateRowEnabled(db, hash, expectedGroupname, expectedUsername, false); err != nil {
+		t.Errorf("error was not expected while updating row: %s", err)
+	}
+
+	// Updating a non-existing webhook fails
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook SET enabled").
+		WithArgs(false, hash, expectedGroupname, "someotheruser").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if err = updateRowEnabled(db, hash, expectedGroupname, "someotheruser", false); err == nil {
+		t.Errorf("error was expected while updating a non-existing row")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	description := "new description"
+	coalesceSeconds := 60
+	qsubOptions := "-l walltime=00:10:00"
+	enabled := false
+	update := ConfigurationUpdateRequest{
+		Hash:            "550e8400-e29b-41d4-a716-446655440001",
+		Groupname:       "dccngroup",
+		Username:        "dccnuser",
+		Description:     &description,
+		CoalesceSeconds: &coalesceSeconds,
+		QsubOptions:     &qsubOptions,
+		Enabled:         &enabled,
+	}
+
+	// Only the columns in the request are set, in a single statement
+	mock.ExpectBegin()
+	mock.ExpectExec(`^UPDATE hpc_webhook SET description = \$1, coalesce_seconds = \$2, qsub_options = \$3, enabled = \$4 WHERE hash = \$5 AND groupname = \$6 AND username = \$7`).
+		WithArgs(description, coalesceSeconds, qsubOptions, enabled, update.Hash, update.Groupname, update.Username).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = updateRow(db, update); err != nil {
+		t.Errorf("error was not expected while updating row: %s", err)
+	}
+
+	if err = updateRow(db, ConfigurationUpdateRequest{Hash: update.Hash, Groupname: update.Groupname, Username: update.Username}); err == nil {
+		t.Errorf("Expected an error for an update without changes")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetRowToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	token := "660e8400-e29b-41d4-a716-446655440002"
+	now := "2019-03-11T10:10:00Z"
+
+	expectedRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, "dccngroup", "dccnuser", "", "2019-03-11 10:10:00", 0, "allow", true, "", "", token, nil)
+
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook WHERE token = (.+) OR hash IN").
+		WithArgs(token, now).
+		WillReturnRows(expectedRows)
+
+	hpcWebhookHost := "hpc-webhook.dccn.nl"
+	hpcWebhookExternalPort := "443"
+	list, err := getRowToken(db, hpcWebhookHost, hpcWebhookExternalPort, token, now)
+	if err != nil {
+		t.Errorf("error was not expected while getting row: %s", err)
+	}
+	if len(list) != 1 || list[0].Hash != hash {
+		t.Fatalf("Expected webhook '%s', but got %+v", hash, list)
+	}
+
+	// The payload URL contains the public token instead of the hash
+	expectedURL := fmt.Sprintf("https://%s:%s%s/%s", hpcWebhookHost, hpcWebhookExternalPort, WebhookPath, token)
+	if list[0].URL != expectedURL {
+		t.Errorf("Expected URL '%s', but got '%s'", expectedURL, list[0].URL)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	token := "660e8400-e29b-41d4-a716-446655440002"
+	expires := "2019-03-12T10:10:00Z"
+	expectedGroupname := "dccngroup"
+	expectedUsername := "dccnuser"
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_token").
+		WithArgs(expires, hash, expectedGroupname, expectedUsername).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^UPDATE hpc_webhook SET token").
+		WithArgs(token, hash, expectedGroupname, expectedUsername).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = rotateToken(db, hash, expectedGroupname, expectedUsername, token, expires); err != nil {
+		t.Errorf("error was not expected while rotating token: %s", err)
+	}
+
+	// Rotating the token of a non-existing webhook fails
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_token").
+		WithArgs(expires, hash, expectedGroupname, "someotheruser").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if err = rotateToken(db, hash, expectedGroupname, "someotheruser", token, expires); err == nil {
+		t.Errorf("error was expected while rotating the token of a non-existing webhook")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
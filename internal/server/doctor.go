@@ -0,0 +1,250 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Checks of the doctor on the webhooks of a user
+const (
+	DoctorCheckDirectory      = "directory"      // DoctorCheckDirectory checks that the working directory of a webhook exists
+	DoctorCheckScriptPointer  = "scriptPointer"  // DoctorCheckScriptPointer checks that the working directory points to the script of the webhook
+	DoctorCheckScript         = "script"         // DoctorCheckScript checks that the script exists, on the machine of the client
+	DoctorCheckAuthorizedKeys = "authorizedKeys" // DoctorCheckAuthorizedKeys checks that the server public key is in the authorized keys of the user
+	DoctorCheckOwner          = "owner"          // DoctorCheckOwner checks that the files the server writes in the home directory are owned by the user
+	DoctorCheckRegistration   = "registration"   // DoctorCheckRegistration checks that a working directory belongs to a registered webhook, on the machine of the client
+)
+
+// DoctorProblem is a problem found by the doctor, and the outcome of its repair
+type DoctorProblem struct {
+	Webhook  string `json:"webhook,omitempty"` // Webhook with the problem, empty for problems shared by all webhooks of the user
+	Check    string `json:"check"`
+	Path     string `json:"path"` // File or directory with the problem, relative to the home directory of the user unless absolute
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"` // Reason the problem was not repaired, when a repair was requested
+}
+
+// DoctorReport is the result of the doctor on the webhooks of a user
+type DoctorReport struct {
+	Webhooks []string        `json:"webhooks"` // Webhooks registered for the user, which have been checked
+	Problems []DoctorProblem `json:"problems"`
+}
+
+// errNotRepairable is the reason for problems that only the user can repair
+var errNotRepairable = errors.New("cannot be repaired by the server: register the webhook again")
+
+// Add a problem to the report, and repair it if requested and possible
+func (r *DoctorReport) add(problem DoctorProblem, repair bool, fix func() error) {
+	if repair {
+		err := errNotRepairable
+		if fix != nil {
+			err = fix()
+		}
+		if err != nil {
+			problem.Error = err.Error()
+		}
+		problem.Repaired = err == nil
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+// listAllWebhooks returns every webhook of a user, going through all pages of the listing
+func listAllWebhooks(store Store, groupname string, username string) ([]Item, error) {
+	var all []Item
+	options := ListOptions{Limit: MaxListLimit}
+	for {
+		list, nextCursor, err := store.ListWebhooks(groupname, username, options)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, list...)
+		if nextCursor == "" {
+			return all, nil
+		}
+		options.Cursor = nextCursor
+	}
+}
+
+// doctor checks the registered webhooks of a user against the home directory of the user, and repairs the problems if requested.
+//
+// The working directory and script pointer of every webhook, the server public key in the authorized keys,
+// and the ownership of the files the server writes as root are checked. A missing script pointer can only be repaired
+// by registering the webhook again. The script itself is checked by the client, as its path is only known on the cluster.
+func (a *API) doctor(groupname string, username string, repair bool, source string) (DoctorReport, error) {
+	report := DoctorReport{Webhooks: []string{}, Problems: []DoctorProblem{}}
+
+	userDir := path.Join(a.HomeDir, groupname, username)
+	fi, err := os.Stat(userDir)
+	if err != nil {
+		return report, fmt.Errorf("home directory of user %s not found", username)
+	}
+	uid, gid, hasOwner := fileOwner(fi)
+
+	list, err := listAllWebhooks(a.store(), groupname, username)
+	if err != nil {
+		return report, err
+	}
+	if len(list) == 0 {
+		return report, nil
+	}
+
+	// The authorized keys come first, as their repair may create files owned by the server
+	if !a.usesCertificates() {
+		a.doctorAuthorizedKeys(&report, groupname, username, repair)
+	}
+
+	// Files the server writes with its own ownership, which are checked for every webhook
+	owned := []string{".ssh", path.Join(".ssh", "authorized_keys"), WebhooksWorkDir}
+
+	for _, item := range list {
+		report.Webhooks = append(report.Webhooks, item.Hash)
+
+		relativeWorkdir := path.Join(WebhooksWorkDir, item.Hash)
+		workdir := path.Join(userDir, relativeWorkdir)
+		w, err := os.Lstat(workdir)
+		switch {
+		case os.IsNotExist(err):
+			report.add(DoctorProblem{
+				Webhook: item.Hash,
+				Check:   DoctorCheckDirectory,
+				Path:    relativeWorkdir,
+				Problem: "working directory is missing",
+			}, repair, func() error {
+				return os.MkdirAll(workdir, 0755)
+			})
+		case err != nil:
+			return report, err
+		case !w.IsDir():
+			report.add(DoctorProblem{
+				Webhook: item.Hash,
+				Check:   DoctorCheckDirectory,
+				Path:    relativeWorkdir,
+				Problem: "working directory is not a directory",
+			}, repair, nil)
+			continue
+		}
+
+		relativePointer := path.Join(relativeWorkdir, ScriptName)
+		pointer, err := ioutil.ReadFile(path.Join(userDir, relativePointer))
+		switch {
+		case err != nil:
+			report.add(DoctorProblem{
+				Webhook: item.Hash,
+				Check:   DoctorCheckScriptPointer,
+				Path:    relativePointer,
+				Problem: "script pointer is missing",
+			}, repair, nil)
+		case strings.TrimSpace(string(pointer)) == "":
+			report.add(DoctorProblem{
+				Webhook: item.Hash,
+				Check:   DoctorCheckScriptPointer,
+				Path:    relativePointer,
+				Problem: "script pointer is empty",
+			}, repair, nil)
+		}
+
+		owned = append(owned, relativeWorkdir, relativePointer)
+
+		// The payload files of the deliveries, and the single payload file of the webhook written by earlier servers
+		payloads, _ := filepath.Glob(path.Join(workdir, PayLoadName+"*"))
+		for _, payload := range payloads {
+			owned = append(owned, path.Join(relativeWorkdir, path.Base(payload)))
+		}
+	}
+
+	// The payloads are copied by the server as root, which leaves the directories owned by root
+	if hasOwner {
+		for _, relativePath := range owned {
+			p := path.Join(userDir, relativePath)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				continue
+			}
+			if owner, _, ok := fileOwner(fi); ok && owner != uid {
+				report.add(DoctorProblem{
+					Webhook: webhookOfPath(relativePath),
+					Check:   DoctorCheckOwner,
+					Path:    relativePath,
+					Problem: fmt.Sprintf("owned by uid %d instead of uid %d", owner, uid),
+				}, repair, func() error {
+					return os.Lchown(p, uid, gid)
+				})
+			}
+		}
+	}
+
+	if repair {
+		now := time.Now()
+		for _, problem := range report.Problems {
+			if problem.Repaired {
+				a.audit(problem.Webhook, username, AuditActionRepair, fmt.Sprintf("%s: %s", problem.Check, problem.Path), source, now)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// Check that the current server public key is in the authorized keys of the user, with the configured restrictions
+func (a *API) doctorAuthorizedKeys(report *DoctorReport, groupname string, username string, repair bool) {
+	_, publicKeyFilename := a.serverIdentity()
+	fix := func() error {
+		unlock, err := a.lockAuthorizedKeys(groupname, username)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return addAuthorizedPublicKey(a.HomeDir, groupname, username, publicKeyFilename, a.AuthorizedKeyFrom, a.AuthorizedKeyCommand)
+	}
+	problem := DoctorProblem{
+		Check: DoctorCheckAuthorizedKeys,
+		Path:  path.Join(".ssh", "authorized_keys"),
+	}
+
+	publicKeyBytes, err := ioutil.ReadFile(publicKeyFilename)
+	if err != nil {
+		problem.Problem = fmt.Sprintf("server public key cannot be read: %s", err)
+		report.add(problem, repair, nil)
+		return
+	}
+	entry, err := authorizedKeyLine(publicKeyBytes, a.AuthorizedKeyFrom, a.AuthorizedKeyCommand)
+	if err != nil {
+		problem.Problem = fmt.Sprintf("server public key cannot be parsed: %s", err)
+		report.add(problem, repair, nil)
+		return
+	}
+
+	authorizedKeys, err := ioutil.ReadFile(authorizedKeysFilename(a.HomeDir, groupname, username))
+	if err != nil && !os.IsNotExist(err) {
+		problem.Problem = fmt.Sprintf("authorized keys cannot be read: %s", err)
+		report.add(problem, repair, nil)
+		return
+	}
+
+	problem.Problem = "server public key is missing"
+	for _, line := range strings.Split(string(authorizedKeys), "\n") {
+		if line == entry {
+			return
+		}
+		if isServerAuthorizedKey(line, publicKeyBytes) {
+			problem.Problem = "server public key has outdated restrictions"
+		}
+	}
+	report.add(problem, repair, fix)
+}
+
+// webhookOfPath returns the webhook of a path in its working directory, relative to the home directory of the user
+func webhookOfPath(relativePath string) string {
+	parts := strings.Split(relativePath, "/")
+	if len(parts) < 2 || parts[0] != WebhooksWorkDir {
+		return ""
+	}
+	return parts[1]
+}
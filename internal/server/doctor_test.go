@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Obtain the checks of the problems in a doctor report, per webhook
+func doctorChecks(report DoctorReport) map[string][]string {
+	checks := make(map[string][]string)
+	for _, problem := range report.Problems {
+		checks[problem.Webhook] = append(checks[problem.Webhook], problem.Check)
+	}
+	return checks
+}
+
+func TestDoctor(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+	if err := setupTestCase(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	groupname := "dccngroup"
+	username := "dccnuser"
+	healthy := "550e8400-e29b-41d4-a716-446655440001"
+	broken := "550e8400-e29b-41d4-a716-446655440002"
+
+	api := API{
+		Store:                NewMemoryStore("hpc-webhook.dccn.nl", "443"),
+		HomeDir:              testConfig.homeDir,
+		PrivateKeyFilename:   testConfig.privateKeyFilename,
+		PublicKeyFilename:    testConfig.publicKeyFilename,
+		AuthorizedKeyCommand: "hpc-webhook-submit",
+	}
+	for _, hash := range []string{healthy, broken} {
+		if err := api.Store.AddWebhook(Item{Hash: hash, Groupname: groupname, Username: username, Token: hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The home directory of the user is required
+	if _, err := api.doctor(groupname, username, false, ""); err == nil {
+		t.Errorf("Expected an error for a missing home directory")
+	}
+
+	// Only the first webhook has a working directory with a script pointer
+	userDir := path.Join(testConfig.homeDir, groupname, username)
+	workdir := path.Join(userDir, WebhooksWorkDir, healthy)
+	if err := os.MkdirAll(workdir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(workdir, ScriptName), []byte("/home/dccngroup/dccnuser/test.sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The problems are reported without being repaired
+	report, err := api.doctor(groupname, username, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChecks := map[string][]string{
+		"":     {DoctorCheckAuthorizedKeys},
+		broken: {DoctorCheckDirectory, DoctorCheckScriptPointer},
+	}
+	if !reflect.DeepEqual(doctorChecks(report), expectedChecks) || !reflect.DeepEqual(report.Webhooks, []string{healthy, broken}) {
+		t.Errorf("Expected problems %v, but got %+v", expectedChecks, report)
+	}
+	for _, problem := range report.Problems {
+		if problem.Repaired {
+			t.Errorf("Expected no repairs, but got %+v", problem)
+		}
+	}
+
+	// The server can repair all but the script pointer
+	report, err = api.doctor(groupname, username, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		if problem.Repaired != (problem.Check != DoctorCheckScriptPointer) {
+			t.Errorf("Expected only the script pointer to be left, but got %+v", problem)
+		}
+	}
+	report, err = api.doctor(groupname, username, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChecks = map[string][]string{broken: {DoctorCheckScriptPointer}}
+	if !reflect.DeepEqual(doctorChecks(report), expectedChecks) {
+		t.Errorf("Expected problems %v after the repair, but got %+v", expectedChecks, report)
+	}
+
+	// Files left by the server are given to the owner of the home directory
+	if os.Geteuid() != 0 {
+		t.Skip("ownership requires root")
+	}
+	if err := os.Chown(userDir, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	report, err = api.doctor(groupname, username, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := 0
+	for _, problem := range report.Problems {
+		if problem.Check == DoctorCheckOwner && problem.Repaired {
+			owned++
+		}
+	}
+	if owned == 0 {
+		t.Errorf("Expected files owned by root to be repaired, but got %+v", report)
+	}
+	fi, err := os.Stat(workdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, _, _ := fileOwner(fi); uid != 1000 {
+		t.Errorf("Expected the working directory to be owned by uid 1000, but got %d", uid)
+	}
+}
+
+func TestConfigurationDoctorHandler(t *testing.T) {
+	cases := []struct {
+		method         string
+		configURL      string
+		testData       string
+		expectedStatus int
+		expectedString string
+	}{
+		{
+			method:         "POST",
+			configURL:      "/configuration/doctor",
+			testData:       `{"groupname": "groupname", "username": "username"}`,
+			expectedStatus: 200,
+			expectedString: `{"webhooks":[],"problems":[]}`,
+		},
+		{
+			method:         "POST",
+			configURL:      "/configuration/doctor?repair=sure",
+			testData:       `{"groupname": "groupname", "username": "username"}`,
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid repair 'sure'`,
+		},
+		{
+			method:         "POST",
+			configURL:      "/configuration/doctor",
+			testData:       `{"groupname": "groupname"}`,
+			expectedStatus: 404,
+			expectedString: `Error 404 - Not found: invalid configuration request: username missing`,
+		},
+		{
+			method:         "GET",
+			configURL:      "/configuration/doctor",
+			testData:       `{"groupname": "groupname", "username": "username"}`,
+			expectedStatus: 405,
+			expectedString: `Error 405 - Method not allowed: invalid method: GET`,
+		},
+	}
+
+	homeDir := path.Join("..", "..", "test", "results", "home")
+	if err := os.MkdirAll(path.Join(homeDir, "groupname", "username"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(homeDir)
+
+	api := API{
+		Store:   NewMemoryStore("hpc-webhook.dccn.nl", "443"),
+		HomeDir: homeDir,
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.configURL, bytes.NewBuffer([]byte(c.testData)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.ConfigurationDoctorHandler).ServeHTTP(rr, req)
+
+		if rr.Code != c.expectedStatus {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, c.expectedStatus)
+			continue
+		}
+		if c.expectedStatus == 200 {
+			var report DoctorReport
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rr.Body.String() != c.expectedString {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), c.expectedString)
+		}
+	}
+}
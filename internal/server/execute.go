@@ -1,18 +1,33 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"time"
 
+	"github.com/Donders-Institute/hpc-webhook/internal/submit"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
 type executeConfiguration struct {
 	privateKeyFilename       string
+	previousKeyFilename      string // Private key tried as well during a key rotation
+	passphraseFilename       string // Secret file with the passphrase of encrypted private keys
+	agentSocket              string // ssh-agent holding the server keys, used instead of the private key files
+	caKeyFilename            string // CA key signing a short-lived user certificate for the server key
+	caPassphraseFilename     string // Secret file with the passphrase of the encrypted CA key
+	caSocket                 string // ssh-agent holding the CA key, used instead of the CA key file
+	certificateValidity      time.Duration
+	sourceAddress            string // Addresses the server connects from, restricting the use of the user certificate
 	payloadFilename          string
 	targetPayloadDir         string
 	targetPayloadFilename    string
@@ -23,10 +38,20 @@ type executeConfiguration struct {
 	dataDir                  string
 	homeDir                  string
 	webhookID                string
+	deliveryID               string
+	requestID                string // Request that received the delivery, to correlate the log
+	source                   string // Address the delivery originates from
+	concurrency              string
+	previousJobID            string
+	qsubOptions              string
+	submitCommand            string
 	payload                  []byte
 	username                 string
 	groupname                string
 	password                 string
+	spanContext              trace.SpanContext // Span of the request that received the delivery, continued by its processing
+	submitting               func() error      // Records that the job is about to be submitted, so that it is not submitted twice
+	trace                    string            // Trace the delivery is recorded with, returned to its sender
 }
 
 // CopyFile copies a source file to a destination file.
@@ -51,70 +76,272 @@ func CopyFile(src string, dst string) error {
 	return out.Close()
 }
 
-func triggerQsubCommand(c Connector, client *ssh.Client, conf executeConfiguration) error {
+// Concurrency policies for a webhook whose previous job is still queued or running
+const (
+	ConcurrencyAllow  = "allow"  // ConcurrencyAllow submits the new job anyway
+	ConcurrencySkip   = "skip"   // ConcurrencySkip drops the new delivery
+	ConcurrencyCancel = "cancel" // ConcurrencyCancel deletes the previous job and submits the new one
+)
+
+// errPreviousJobActive is returned when a delivery is skipped because of the concurrency policy
+var errPreviousJobActive = errors.New("previous job is still active")
+
+// Send a structured request to the forced command of the server key on the relay node
+func sendSubmitRequest(ctx context.Context, c Connector, client *ssh.Client, conf executeConfiguration, req submit.Request) (rsp submit.Response, err error) {
+	_, span := startSpan(ctx, "ssh.session", attribute.String("submit.action", req.Action))
+	defer func() { endSpan(span, err) }()
+
 	session, err := c.NewSession(client)
 	if err != nil {
-		return err
+		return rsp, err
 	}
 	defer c.CloseSession(session)
 
-	// Grab the path to the user script
-	contents, err := ioutil.ReadFile(conf.userScriptPathFilename)
+	data, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return rsp, err
 	}
-	userScriptFilename := string(contents)
 
-	// Go the correct folder and run the qsub command from there
-	command := fmt.Sprintf(`bash -l -c "cd ~/%s/%s/ && qsub -F %s %s"`, WebhooksWorkDir, conf.webhookID, conf.targetPayloadFilename, userScriptFilename)
-	fmt.Println(command)
-	err = c.Run(session, command)
+	// The forced command reports failures in its response, and exits with an error
+	command := conf.submitCommand
+	if command == "" {
+		command = submit.Command
+	}
+	output, runErr := c.OutputWithStdin(session, command, data)
+	if err := json.Unmarshal(output, &rsp); err != nil {
+		if runErr != nil {
+			return rsp, runErr
+		}
+		return rsp, fmt.Errorf("invalid response of %s: %s", command, err)
+	}
+	if rsp.Error != "" {
+		return rsp, errors.New(rsp.Error)
+	}
+	return rsp, runErr
+}
+
+func triggerQsubCommand(ctx context.Context, c Connector, client *ssh.Client, conf executeConfiguration) (string, error) {
+	ctx, span := startSpan(ctx, "qsub")
+	rsp, err := sendSubmitRequest(ctx, c, client, conf, submit.Request{
+		Action:      submit.ActionSubmit,
+		WebhookID:   conf.webhookID,
+		DeliveryID:  conf.deliveryID,
+		QsubOptions: conf.qsubOptions,
+		Payload:     path.Base(conf.targetPayloadFilename),
+	})
 	if err != nil {
-		return err
+		endSpan(span, err)
+		return "", err
 	}
-	return err
+	span.SetAttributes(attribute.String("job.id", rsp.JobID))
+	endSpan(span, nil)
+	return rsp.JobID, err
 }
 
-// ExecuteScript triggers a qsub command on the HPC cluster
-func ExecuteScript(c Connector, conf executeConfiguration) error {
-	// Configure the SSH connection
-	privateKey, err := ioutil.ReadFile(conf.privateKeyFilename)
+// Check if the job with the given id is still queued or running on the HPC cluster
+func jobIsActive(ctx context.Context, c Connector, client *ssh.Client, conf executeConfiguration, jobID string) (bool, error) {
+	if !isValidJobID(jobID) {
+		return false, fmt.Errorf("invalid job id '%s'", jobID)
+	}
+
+	rsp, err := sendSubmitRequest(ctx, c, client, conf, submit.Request{
+		Action:     submit.ActionStatus,
+		DeliveryID: conf.deliveryID,
+		JobID:      jobID,
+	})
 	if err != nil {
+		return false, err
+	}
+	return rsp.Active, nil
+}
+
+// Delete the job with the given id from the HPC cluster
+func cancelJob(ctx context.Context, c Connector, client *ssh.Client, conf executeConfiguration, jobID string) error {
+	if !isValidJobID(jobID) {
+		return fmt.Errorf("invalid job id '%s'", jobID)
+	}
+
+	_, err := sendSubmitRequest(ctx, c, client, conf, submit.Request{
+		Action:     submit.ActionCancel,
+		DeliveryID: conf.deliveryID,
+		JobID:      jobID,
+	})
+	return err
+}
+
+// Apply the concurrency policy of the webhook to its previous job
+func applyConcurrencyPolicy(ctx context.Context, c Connector, client *ssh.Client, conf executeConfiguration) error {
+	if conf.previousJobID == "" || conf.concurrency == "" || conf.concurrency == ConcurrencyAllow {
+		return nil
+	}
+
+	active, err := jobIsActive(ctx, c, client, conf, conf.previousJobID)
+	if err != nil || !active {
 		return err
 	}
-	signer, _ := ssh.ParsePrivateKey(privateKey)
+
+	switch conf.concurrency {
+	case ConcurrencySkip:
+		return errPreviousJobActive
+	case ConcurrencyCancel:
+		return cancelJob(ctx, c, client, conf, conf.previousJobID)
+	}
+	return nil
+}
+
+// Connect to the relay node as the user, with the given keys of the server
+func dialRelayNode(ctx context.Context, c Connector, conf executeConfiguration, signers []ssh.Signer) (*ssh.Client, error) {
 	clientConfig := &ssh.ClientConfig{
 		User: conf.username,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 			return nil
 		},
 		Timeout: time.Duration(conf.connectionTimeoutSeconds) * time.Second,
 	}
 
-	// Start an SSH session on the relay node
 	remoteServer := fmt.Sprintf("%s:22", conf.relayNodeName)
+	_, span := startSpan(ctx, "ssh.dial", attribute.String("net.peer.name", conf.relayNodeName))
+	dialStart := time.Now()
 	client, err := c.NewClient(remoteServer, clientConfig)
+	observeDuration(sshDialDuration, dialStart, err)
+	endSpan(span, err)
+	return client, err
+}
+
+// ExecuteScript triggers a qsub command on the HPC cluster and returns the job id.
+// The SSH connection and the submission are traced as children of the span in the context.
+func ExecuteScript(ctx context.Context, c Connector, conf executeConfiguration) (string, error) {
+	jobsInFlight.Inc()
+	defer jobsInFlight.Dec()
+
+	// Configure the SSH connection
+	signers, closeSigners, err := sshSigners(conf, time.Now())
+	defer closeSigners()
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// Start an SSH session on the relay node
+	client, err := dialRelayNode(ctx, c, conf, signers)
+	if err != nil {
+		return "", err
 	}
 	defer c.CloseConnection(client)
 
+	// Skip the delivery or cancel the previous job when it is still active
+	err = applyConcurrencyPolicy(ctx, c, client, conf)
+	if err != nil {
+		return "", err
+	}
+
 	// Copy the payload to HPC webhooks folder
 	err = os.MkdirAll(conf.targetPayloadDir, os.ModePerm)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = CopyFile(conf.payloadFilename, conf.targetPayloadFilename)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// Record the submission first, the job may exist even when the server stops before it has the job id
+	if conf.submitting != nil {
+		if err := conf.submitting(); err != nil {
+			return "", err
+		}
 	}
 
 	// Trigger the qsub command
-	err = triggerQsubCommand(c, client, conf)
+	qsubStart := time.Now()
+	jobID, err := triggerQsubCommand(ctx, c, client, conf)
+	observeDuration(qsubDuration, qsubStart, err)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return err
+	return jobID, err
+}
+
+// Steps of the test of a webhook, in the order in which ExecuteScript performs them
+const (
+	TestStepKeys          = "keys"          // TestStepKeys loads the keys the server authenticates with
+	TestStepSSH           = "ssh"           // TestStepSSH connects to the relay node as the user
+	TestStepScriptPointer = "scriptPointer" // TestStepScriptPointer resolves the script pointer in the working directory of the webhook
+	TestStepScript        = "script"        // TestStepScript checks that the script exists on the cluster
+	TestStepPayload       = "payload"       // TestStepPayload places a payload in the working directory of the webhook
+)
+
+// TestStep is the result of a step of the test of a webhook
+type TestStep struct {
+	Step   string `json:"step"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// testScript performs the steps of ExecuteScript up to the submission, and returns their results.
+// The test stops at the first step that fails. The concurrency policy is not applied, as it may cancel a job,
+// and the payload placement is checked with a file that is removed again, so a running job keeps its payload.
+func testScript(ctx context.Context, c Connector, conf executeConfiguration) []TestStep {
+	var steps []TestStep
+	step := func(name string, detail string, err error) bool {
+		s := TestStep{Step: name, Passed: err == nil, Detail: detail}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		steps = append(steps, s)
+		return err == nil
+	}
+
+	// Load the keys of the server
+	signers, closeSigners, err := sshSigners(conf, time.Now())
+	defer closeSigners()
+	if !step(TestStepKeys, fmt.Sprintf("%d keys", len(signers)), err) {
+		return steps
+	}
+
+	// Authenticate as the user on the relay node
+	client, err := dialRelayNode(ctx, c, conf, signers)
+	if !step(TestStepSSH, fmt.Sprintf("%s@%s", conf.username, conf.relayNodeName), err) {
+		return steps
+	}
+	defer c.CloseConnection(client)
+
+	// Resolve the script pointer and check the script, without submitting it
+	rsp, err := sendSubmitRequest(ctx, c, client, conf, submit.Request{
+		Action:     submit.ActionCheck,
+		WebhookID:  conf.webhookID,
+		DeliveryID: conf.deliveryID,
+	})
+	if rsp.Script == "" {
+		if err == nil {
+			err = errors.New("no script in the response of the relay node")
+		}
+		step(TestStepScriptPointer, "", err)
+		return steps
+	}
+	step(TestStepScriptPointer, rsp.Script, nil)
+	if !step(TestStepScript, rsp.Script, err) {
+		return steps
+	}
+
+	// Place a payload next to the ones of the deliveries. The working directory is created at registration,
+	// a test does not repair it: a missing directory is reported, as the doctor can repair it.
+	probe := path.Join(conf.targetPayloadDir, fmt.Sprintf(".%s-%s", PayLoadName, conf.deliveryID))
+	fi, err := os.Stat(conf.targetPayloadDir)
+	switch {
+	case os.IsNotExist(err):
+		err = errors.New("working directory is missing")
+	case err == nil && !fi.IsDir():
+		err = errors.New("working directory is not a directory")
+	}
+	if err == nil {
+		err = ioutil.WriteFile(probe, []byte("{}"), 0644)
+	}
+	if err == nil {
+		err = os.Remove(probe)
+	}
+	step(TestStepPayload, path.Join(WebhooksWorkDir, conf.webhookID), err)
+	return steps
 }
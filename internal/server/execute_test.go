@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"reflect"
 	"testing"
 	"time"
 
@@ -126,7 +128,7 @@ func TestTriggerQsubCommand(t *testing.T) {
 		homeDir:                  homeDir,
 	}
 
-	err = triggerQsubCommand(fc, client, executeConfig)
+	_, err = triggerQsubCommand(context.Background(), fc, client, executeConfig)
 	if err != nil {
 		t.Errorf("Expected no error, but got '%+v'", err.Error())
 	}
@@ -181,13 +183,9 @@ func TestExecuteScript(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error writing key dir")
 	}
-	err = ioutil.WriteFile(publicKeyFilename, []byte("test"), 0644)
+	err = generateKeyPair(KeyTypeEd25519, privateKeyFilename, publicKeyFilename, nil)
 	if err != nil {
-		t.Errorf("Error writing public key")
-	}
-	err = ioutil.WriteFile(privateKeyFilename, []byte("test"), 0600)
-	if err != nil {
-		t.Errorf("Error writing private key")
+		t.Errorf("Error writing key pair")
 	}
 	defer func() {
 		err = os.RemoveAll(keyDir) // clean up when done
@@ -231,13 +229,156 @@ func TestExecuteScript(t *testing.T) {
 		dataDir:                dataDir,
 		homeDir:                homeDir,
 	}
+	submitting := false
+	executeConfig.submitting = func() error {
+		submitting = true
+		return nil
+	}
 
 	// Execute the script
 	fc := FakeConnector{
 		Description: "fake SSH connection",
 	}
-	err = ExecuteScript(fc, executeConfig)
+	_, err = ExecuteScript(context.Background(), fc, executeConfig)
 	if err != nil {
 		t.Errorf("Expected no error, but got '%+v'", err.Error())
 	}
+	if !submitting {
+		t.Errorf("Expected the submission to be recorded before the job is submitted")
+	}
+}
+
+func TestApplyConcurrencyPolicy(t *testing.T) {
+	fc := FakeConnector{
+		Description: "fake SSH connection",
+	}
+
+	cases := []struct {
+		concurrency   string
+		previousJobID string
+		expectedError error
+	}{
+		{
+			concurrency:   ConcurrencyAllow,
+			previousJobID: "34986226.dccn-l029.dccn.nl",
+			expectedError: nil, // Always submit
+		},
+		{
+			concurrency:   ConcurrencySkip,
+			previousJobID: "",
+			expectedError: nil, // No previous job
+		},
+		{
+			concurrency:   ConcurrencySkip,
+			previousJobID: "34986226.dccn-l029.dccn.nl",
+			expectedError: nil, // The fake qstat does not report the job as active
+		},
+	}
+
+	for _, c := range cases {
+		conf := executeConfiguration{
+			concurrency:   c.concurrency,
+			previousJobID: c.previousJobID,
+		}
+		err := applyConcurrencyPolicy(context.Background(), fc, nil, conf)
+		if err != c.expectedError {
+			t.Errorf("Expected error '%v' for policy '%s', but got '%v'", c.expectedError, c.concurrency, err)
+		}
+	}
+}
+
+// checkConnector answers the requests to the forced command with a fixed output
+type checkConnector struct {
+	FakeConnector
+	output string
+}
+
+func (cc checkConnector) OutputWithStdin(session *ssh.Session, command string, stdin []byte) ([]byte, error) {
+	return []byte(cc.output), nil
+}
+
+func TestTestScript(t *testing.T) {
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	deliveryID := "660e8400-e29b-41d4-a716-446655440002"
+	keyDir := path.Join("..", "..", "test", "results", "testScript", "keys")
+	homeDir := path.Join("..", "..", "test", "results", "testScript", "home")
+	privateKeyFilename := path.Join(keyDir, "hpc-webhook")
+	targetPayloadDir := path.Join(homeDir, "dccngroup", "dccnuser", WebhooksWorkDir, webhookID)
+
+	err := os.MkdirAll(keyDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path.Join("..", "..", "test", "results", "testScript"))
+	err = generateKeyPair(KeyTypeEd25519, privateKeyFilename, privateKeyFilename+".pub", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		output        string
+		workdir       bool // Create the working directory before the test
+		expectedSteps []string
+		expectedError string // Error of the last step
+	}{
+		{
+			output:        `{"script": "/home/dccngroup/dccnuser/test.sh"}`,
+			expectedSteps: []string{TestStepKeys, TestStepSSH, TestStepScriptPointer, TestStepScript, TestStepPayload},
+			expectedError: "working directory is missing",
+		},
+		{
+			output:        `{"script": "/home/dccngroup/dccnuser/test.sh"}`,
+			workdir:       true,
+			expectedSteps: []string{TestStepKeys, TestStepSSH, TestStepScriptPointer, TestStepScript, TestStepPayload},
+		},
+		{
+			output:        `{"error": "unknown webhook '550e8400-e29b-41d4-a716-446655440001'"}`,
+			expectedSteps: []string{TestStepKeys, TestStepSSH, TestStepScriptPointer},
+			expectedError: "unknown webhook '550e8400-e29b-41d4-a716-446655440001'",
+		},
+		{
+			output:        `{"script": "/home/dccngroup/dccnuser/test.sh", "error": "script '/home/dccngroup/dccnuser/test.sh' not found"}`,
+			expectedSteps: []string{TestStepKeys, TestStepSSH, TestStepScriptPointer, TestStepScript},
+			expectedError: "script '/home/dccngroup/dccnuser/test.sh' not found",
+		},
+	}
+
+	for i, c := range cases {
+		if c.workdir {
+			if err := os.MkdirAll(targetPayloadDir, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conf := executeConfiguration{
+			privateKeyFilename: privateKeyFilename,
+			targetPayloadDir:   targetPayloadDir,
+			username:           "dccnuser",
+			relayNodeName:      "relaynode.dccn.nl",
+			webhookID:          webhookID,
+			deliveryID:         deliveryID,
+		}
+		steps := testScript(context.Background(), checkConnector{output: c.output}, conf)
+
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.Step)
+		}
+		if !reflect.DeepEqual(names, c.expectedSteps) {
+			t.Errorf("Test case %d: expected steps %v, but got %+v", i, c.expectedSteps, steps)
+			continue
+		}
+		last := steps[len(steps)-1]
+		if last.Passed != (c.expectedError == "") || last.Error != c.expectedError {
+			t.Errorf("Test case %d: expected error '%s' at the last step, but got %+v", i, c.expectedError, last)
+		}
+		if _, err := os.Stat(targetPayloadDir); last.Step == TestStepPayload && !last.Passed && !os.IsNotExist(err) {
+			t.Errorf("Test case %d: expected the test not to create the working directory", i)
+		}
+	}
+
+	// The payload is placed in the working directory, and removed again
+	files, err := ioutil.ReadDir(targetPayloadDir)
+	if err != nil || len(files) != 0 {
+		t.Errorf("Expected an empty working directory, but got %v and error '%v'", files, err)
+	}
 }
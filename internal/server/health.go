@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultRelayProbeSeconds is the period for which the result of the SSH probe of the relay node is reused,
+// unless configured otherwise
+const DefaultRelayProbeSeconds = 60
+
+// readinessTimeout bounds the time a readiness check may take
+const readinessTimeout = 5 * time.Second
+
+// ReadinessResponse contains the result of every readiness check: "ok" or the error
+type ReadinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// relayProbe caches the result of the last SSH probe of the relay node
+type relayProbe struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+	running chan struct{} // Closed when the running probe has finished, nil when no probe is running
+}
+
+// Check that the database accepts connections
+func (a *API) checkDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	return a.store().Ping(ctx)
+}
+
+// Check that the server can load its current private key, or obtain its keys from ssh-agent
+func (a *API) checkPrivateKey() error {
+	if a.AgentSocket != "" {
+		_, conn, err := agentSigners(a.AgentSocket)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	privateKeyFilenames, _ := a.serverIdentity()
+	passphrase, err := readPassphrase(a.KeyPassphraseFilename)
+	if err != nil {
+		return err
+	}
+	_, err = loadSigner(privateKeyFilenames[0], passphrase)
+	return err
+}
+
+// Check that the relay node accepts SSH connections, by logging in as the test user.
+// The result is reused for the probe period, to avoid a connection for every readiness request.
+// A single probe runs at a time, concurrent requests wait for its result.
+func (a *API) checkRelayNode(now time.Time) error {
+	p := &a.relayProbe
+	p.mu.Lock()
+	period := time.Duration(a.RelayProbeSeconds) * time.Second
+	if !p.checked.IsZero() && now.Before(p.checked.Add(period)) {
+		defer p.mu.Unlock()
+		return p.err
+	}
+	if running := p.running; running != nil {
+		p.mu.Unlock()
+		select {
+		case <-running:
+		case <-time.After(readinessTimeout):
+			return errors.New("probe of the relay node is still running")
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.err
+	}
+	running := make(chan struct{})
+	p.running = running
+	p.mu.Unlock()
+
+	// The probe runs without the lock, so the dial does not block the requests reading the cache
+	err := a.probeRelayNode()
+
+	p.mu.Lock()
+	p.checked = now
+	p.err = err
+	p.running = nil
+	p.mu.Unlock()
+	close(running)
+	return err
+}
+
+// Log in on the relay node as the test user
+func (a *API) probeRelayNode() error {
+	clientConfig := &ssh.ClientConfig{
+		User: a.RelayNodeTestUser,
+		Auth: []ssh.AuthMethod{ssh.Password(a.RelayNodeTestUserPassword)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Timeout: time.Duration(a.ConnectionTimeoutSeconds) * time.Second,
+	}
+	client, err := a.Connector.NewClient(fmt.Sprintf("%s:22", a.RelayNode), clientConfig)
+	if err == nil {
+		a.Connector.CloseConnection(client)
+	}
+	return err
+}
+
+// HealthzHandler handles a HTTP GET request to check that the server process is alive
+func (a *API) HealthzHandler(w http.ResponseWriter, req *http.Request) {
+	// Check method
+	if !strings.EqualFold(req.Method, "GET") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Succes
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK")
+}
+
+// ReadyzHandler handles a HTTP GET request to check that the server is able to process deliveries:
+// the database is reachable and the private key is readable.
+// The relay node is probed as well when a test user is configured.
+func (a *API) ReadyzHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+
+	// Check method
+	if !strings.EqualFold(req.Method, "GET") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
+		return
+	}
+
+	// Run the checks
+	checks := map[string]func() error{
+		"database":   a.checkDatabase,
+		"privateKey": a.checkPrivateKey,
+	}
+	if a.RelayNodeTestUser != "" {
+		checks["relayNode"] = func() error { return a.checkRelayNode(time.Now()) }
+	}
+
+	readinessResponse := ReadinessResponse{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	for name, check := range checks {
+		if err := check(); err != nil {
+			readinessResponse.Ready = false
+			readinessResponse.Checks[name] = err.Error()
+			logger.WithField("check", name).Warnf("Not ready: %s", err)
+			continue
+		}
+		readinessResponse.Checks[name] = "ok"
+	}
+
+	js, err := json.Marshal(readinessResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if readinessResponse.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(js)
+}
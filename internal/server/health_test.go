@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/ssh"
+)
+
+// refusingConnector is a relay node that refuses every connection, counting the attempts
+type refusingConnector struct {
+	FakeConnector
+	attempts *int
+}
+
+func (rc refusingConnector) NewClient(remote string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	*rc.attempts++
+	return nil, errors.New("connection refused")
+}
+
+// slowConnector is a relay node that refuses connections once it is released, counting the attempts
+type slowConnector struct {
+	FakeConnector
+	attempts *int32
+	release  chan struct{}
+}
+
+func (sc slowConnector) NewClient(remote string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	atomic.AddInt32(sc.attempts, 1)
+	<-sc.release
+	return nil, errors.New("connection refused")
+}
+
+func TestHealthzHandler(t *testing.T) {
+	api := API{}
+	app := &api
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.HealthzHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	err := os.MkdirAll(keyDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(keyDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	privateKeyFilename := path.Join(keyDir, "hpc-webhook")
+	err = generateKeyPair(KeyTypeEd25519, privateKeyFilename, path.Join(keyDir, "hpc-webhook.pub"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		privateKeyFilename string
+		relayNodeTestUser  string
+		expectedStatus     int
+		expectedChecks     map[string]string
+	}{
+		{
+			privateKeyFilename: privateKeyFilename,
+			expectedStatus:     http.StatusOK,
+			expectedChecks:     map[string]string{"database": "ok", "privateKey": "ok"},
+		},
+		{
+			privateKeyFilename: privateKeyFilename,
+			relayNodeTestUser:  "testuser",
+			expectedStatus:     http.StatusServiceUnavailable,
+			expectedChecks:     map[string]string{"database": "ok", "privateKey": "ok", "relayNode": "connection refused"},
+		},
+		{
+			privateKeyFilename: path.Join(keyDir, "missing"),
+			expectedStatus:     http.StatusServiceUnavailable,
+		},
+	}
+
+	for i, c := range cases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+		mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "private_key", "public_key", "previous_private_key", "previous_public_key", "started", "finished"}))
+
+		attempts := 0
+		api := API{
+			DB:                 db,
+			Connector:          refusingConnector{attempts: &attempts},
+			RelayNode:          "relaynode.dccn.nl",
+			RelayNodeTestUser:  c.relayNodeTestUser,
+			PrivateKeyFilename: c.privateKeyFilename,
+		}
+		app := &api
+
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ReadyzHandler)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("Test case %d: handler returned wrong status code: got %v want %v: %s", i, status, c.expectedStatus, rr.Body.String())
+			continue
+		}
+
+		var response ReadinessResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Ready != (c.expectedStatus == http.StatusOK) {
+			t.Errorf("Test case %d: expected ready %v, but got %v", i, !response.Ready, response.Ready)
+		}
+		for name, result := range c.expectedChecks {
+			if response.Checks[name] != result {
+				t.Errorf("Test case %d: expected check %s '%s', but got '%s'", i, name, result, response.Checks[name])
+			}
+		}
+	}
+}
+
+func TestCheckRelayNode(t *testing.T) {
+	attempts := 0
+	api := API{
+		Connector:         refusingConnector{attempts: &attempts},
+		RelayNode:         "relaynode.dccn.nl",
+		RelayNodeTestUser: "testuser",
+		RelayProbeSeconds: 60,
+	}
+	app := &api
+
+	// The result of the probe is reused within the probe period
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(30 * time.Second), now.Add(90 * time.Second)} {
+		if err := app.checkRelayNode(at); err == nil {
+			t.Errorf("Expected the probe to fail")
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 connection attempts, but got %d", attempts)
+	}
+}
+
+func TestCheckRelayNodeConcurrent(t *testing.T) {
+	var attempts int32
+	release := make(chan struct{})
+	api := API{
+		Connector:         slowConnector{attempts: &attempts, release: release},
+		RelayNode:         "relaynode.dccn.nl",
+		RelayNodeTestUser: "testuser",
+		RelayProbeSeconds: 60,
+	}
+	app := &api
+
+	// Concurrent requests share a single probe
+	now := time.Now()
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() { errs <- app.checkRelayNode(now) }()
+	}
+	for atomic.LoadInt32(&attempts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("Expected the probe to fail")
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 connection attempt, but got %d", attempts)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultJanitorIntervalSeconds is the period between two runs of the janitor,
+// unless configured otherwise
+const DefaultJanitorIntervalSeconds = 60 * 60
+
+// Janitor removes the webhooks of which the expiry date has passed at startup, and periodically afterwards
+func (a *API) Janitor(interval time.Duration) {
+	if err := a.removeExpiredWebhooks(time.Now()); err != nil {
+		log.Error(err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := a.removeExpiredWebhooks(now); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Disable and remove the webhooks of which the expiry date has passed.
+// The server public key is removed from the authorized keys of users that have no webhooks left.
+func (a *API) removeExpiredWebhooks(now time.Time) error {
+	list, err := a.store().ExpiredWebhooks(formatExpires(now))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range list {
+		if err := a.removeExpiredWebhook(item, now); err != nil {
+			log.WithField("webhook", item.Hash).Errorf("Error removing expired webhook: %s", err)
+		}
+	}
+	return nil
+}
+
+// Disable and remove a single expired webhook, and record each action in the audit trail
+func (a *API) removeExpiredWebhook(item Item, now time.Time) error {
+	detail := fmt.Sprintf("expired at %s", item.Expires)
+
+	err := a.store().SetWebhookEnabled(item.Hash, item.Groupname, item.Username, false)
+	if err != nil {
+		return err
+	}
+	a.audit(item.Hash, item.Username, AuditActionDisable, detail, AuditSourceJanitor, now)
+
+	err = a.store().DeleteWebhook(item.Hash, item.Groupname, item.Username)
+	if err != nil {
+		return err
+	}
+	a.audit(item.Hash, item.Username, AuditActionDelete, detail, AuditSourceJanitor, now)
+	log.WithField("webhook", item.Hash).Info("Expired webhook removed")
+
+	// Revoke the access of the server when the user has no webhooks left
+	return a.revokeUnusedAuthorizedPublicKey(item.Hash, item.Groupname, item.Username, AuditSourceJanitor, now)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRemoveExpiredWebhooks(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+
+	err := setupTestCase(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	groupname := "dccngroup"
+	username := "dccnuser"
+	expires := "2019-03-12T10:10:00Z"
+	now := time.Date(2019, 3, 13, 10, 10, 0, 0, time.UTC)
+
+	// The user has authorized the server and another key
+	otherKey := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC0 someone@somewhere"
+	err = addAuthorizedPublicKey(testConfig.homeDir, groupname, username, testConfig.publicKeyFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeysFilename := path.Join(testConfig.homeDir, groupname, username, ".ssh", "authorized_keys")
+	fp, err := os.OpenFile(authorizedKeysFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteString(otherKey + "\n")
+	fp.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	api := API{
+		DB:                     db,
+		HomeDir:                testConfig.homeDir,
+		HPCWebhookHost:         "hpc-webhook.dccn.nl",
+		HPCWebhookExternalPort: "443",
+		PublicKeyFilename:      testConfig.publicKeyFilename,
+	}
+
+	expiredRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, groupname, username, "", "2019-03-11T10:10:00Z", 0, "allow", true, "", "", hash, expires)
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook WHERE expires").
+		WithArgs(formatExpires(now)).
+		WillReturnRows(expiredRows)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook SET enabled").
+		WithArgs(false, hash, groupname, username).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, username, AuditActionDisable, "expired at "+expires, AuditSourceJanitor, "", now.Format(time.RFC3339)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM hpc_webhook").
+		WithArgs(hash, groupname, username).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, username, AuditActionDelete, "expired at "+expires, AuditSourceJanitor, "", now.Format(time.RFC3339)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectQuery("^SELECT COUNT").
+		WithArgs(groupname, username).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+		WillReturnRows(sqlmock.NewRows(keyRotationColumnNames))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_audit").
+		WithArgs(hash, username, AuditActionRevokeKey, sqlmock.AnyArg(), AuditSourceJanitor, "", now.Format(time.RFC3339)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = api.removeExpiredWebhooks(now); err != nil {
+		t.Errorf("error was not expected while removing expired webhooks: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// Only the public key of the server is removed
+	publicKey, err := ioutil.ReadFile(testConfig.publicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeys, err := ioutil.ReadFile(authorizedKeysFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(authorizedKeys), strings.TrimSpace(string(publicKey))) {
+		t.Errorf("Expected the server public key to be removed from '%s'", authorizedKeysFilename)
+	}
+	if !strings.Contains(string(authorizedKeys), otherKey) {
+		t.Errorf("Expected other keys to be kept in '%s'", authorizedKeysFilename)
+	}
+}
+
+func TestJanitorAtStartup(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	api := API{
+		Store:   NewMemoryStore("hpc-webhook.dccn.nl", "443"),
+		HomeDir: path.Join("..", "..", "test", "results", "home"),
+	}
+	err := api.Store.AddWebhook(Item{Hash: hash, Groupname: "dccngroup", Username: "dccnuser", Token: hash, Expires: "2019-03-12T10:10:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The webhook expired while the server was down, and is removed before the first tick
+	go api.Janitor(time.Hour)
+	for i := 0; i < 100; i++ {
+		if count, err := api.Store.CountWebhooks("dccngroup", "dccnuser"); err == nil && count == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the expired webhook to be removed at startup")
+}
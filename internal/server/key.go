@@ -1,16 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,21 +28,45 @@ func checkFile(filename string) (bool, error) {
 	return true, nil
 }
 
-func generateKeyPair(savePrivateFileTo string, savePublicFileTo string) error {
-	bitSize := 4096
+// Types of the server key pair
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// generateKeyPair generates a server key pair of the given type.
+// With a passphrase, the private key is encrypted and saved in OpenSSH format.
+func generateKeyPair(keyType string, savePrivateFileTo string, savePublicFileTo string, passphrase []byte) error {
+	var privateKey crypto.PrivateKey
+	var publicKey crypto.PublicKey
+	switch keyType {
+	case KeyTypeRSA:
+		rsaKey, err := generatePrivateKey(4096)
+		if err != nil {
+			return err
+		}
+		privateKey, publicKey = rsaKey, &rsaKey.PublicKey
+	case KeyTypeEd25519:
+		ed25519Public, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		log.Info("Private key generated")
+		privateKey, publicKey = ed25519Key, ed25519Public
+	default:
+		return fmt.Errorf("unsupported key type '%s'", keyType)
+	}
 
-	privateKey, err := generatePrivateKey(bitSize)
+	publicKeyBytes, err := generatePublicKey(publicKey)
 	if err != nil {
 		return err
 	}
 
-	publicKeyBytes, err := generatePublicKey(&privateKey.PublicKey)
+	privateKeyBytes, err := encodePrivateKey(privateKey, passphrase)
 	if err != nil {
 		return err
 	}
 
-	privateKeyBytes := encodePrivateKeyToPEM(privateKey)
-
 	err = writeKeyToFile(privateKeyBytes, savePrivateFileTo)
 	if err != nil {
 		return err
@@ -63,10 +94,30 @@ func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 		return nil, err
 	}
 
-	log.Println("Private Key generated")
+	log.Info("Private key generated")
 	return privateKey, nil
 }
 
+// encodePrivateKey encodes a private key in PEM format.
+// RSA keys without a passphrase keep the PKCS#1 format, all other keys use the OpenSSH format.
+func encodePrivateKey(privateKey crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok && len(passphrase) == 0 {
+		return encodePrivateKeyToPEM(rsaKey), nil
+	}
+
+	var privBlock *pem.Block
+	var err error
+	if len(passphrase) == 0 {
+		privBlock, err = ssh.MarshalPrivateKey(privateKey, AuthorizedKeyMarker)
+	} else {
+		privBlock, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, AuthorizedKeyMarker, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(privBlock), nil
+}
+
 // encodePrivateKeyToPEM encodes Private Key from RSA to PEM format
 func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
 	// Get ASN.1 DER format
@@ -85,20 +136,80 @@ func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
 	return privatePEM
 }
 
-// generatePublicKey takes a rsa.PublicKey and return bytes suitable for writing to .pub file
-// returns in the format "ssh-rsa ..."
-func generatePublicKey(privatekey *rsa.PublicKey) ([]byte, error) {
-	publicRsaKey, err := ssh.NewPublicKey(privatekey)
+// generatePublicKey takes a public key and return bytes suitable for writing to .pub file
+// returns in the format "ssh-rsa ..." or "ssh-ed25519 ..."
+func generatePublicKey(publickey crypto.PublicKey) ([]byte, error) {
+	sshPublicKey, err := ssh.NewPublicKey(publickey)
 	if err != nil {
 		return nil, err
 	}
 
-	pubKeyBytes := ssh.MarshalAuthorizedKey(publicRsaKey)
+	pubKeyBytes := ssh.MarshalAuthorizedKey(sshPublicKey)
 
-	log.Println("Public key generated")
+	log.Info("Public key generated")
 	return pubKeyBytes, nil
 }
 
+// readPassphrase reads the passphrase of the server private key from a secret file.
+// Without a file there is no passphrase.
+func readPassphrase(passphraseFilename string) ([]byte, error) {
+	if passphraseFilename == "" {
+		return nil, nil
+	}
+	passphrase, err := ioutil.ReadFile(passphraseFilename)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(passphrase, "\r\n"), nil
+}
+
+// loadSigner reads and parses a private key in PKCS#1, PKCS#8 or OpenSSH format,
+// decrypting it with the passphrase when it is protected
+func loadSigner(privateKeyFilename string, passphrase []byte) (ssh.Signer, error) {
+	privateKey, err := ioutil.ReadFile(privateKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("private key '%s' is encrypted, but no passphrase is configured", privateKeyFilename)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key '%s': %s", privateKeyFilename, err)
+	}
+	return signer, nil
+}
+
+// ValidateKeyPair checks that the private key can be loaded and belongs to the public key
+func ValidateKeyPair(privateKeyFilename string, publicKeyFilename string, passphraseFilename string) error {
+	passphrase, err := readPassphrase(passphraseFilename)
+	if err != nil {
+		return err
+	}
+	signer, err := loadSigner(privateKeyFilename, passphrase)
+	if err != nil {
+		return err
+	}
+
+	publicKeyBytes, err := ioutil.ReadFile(publicKeyFilename)
+	if err != nil {
+		return err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(publicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key '%s': %s", publicKeyFilename, err)
+	}
+
+	if !bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+		return fmt.Errorf("private key '%s' does not match public key '%s'", privateKeyFilename, publicKeyFilename)
+	}
+	return nil
+}
+
 // writePemToFile writes keys to a file
 func writeKeyToFile(keyBytes []byte, saveFileTo string) error {
 	err := ioutil.WriteFile(saveFileTo, keyBytes, 0600)
@@ -106,33 +217,263 @@ func writeKeyToFile(keyBytes []byte, saveFileTo string) error {
 		return err
 	}
 
-	log.Printf("Key saved to: %s", saveFileTo)
+	log.Infof("Key saved to: %s", saveFileTo)
 	return nil
 }
 
-func addAuthorizedPublicKey(homeDir string, groupname string, username string, publicKeyFilename string) error {
+// AuthorizedKeyMarker is the comment identifying the server public key in the authorized keys of a user
+const AuthorizedKeyMarker = "hpc-webhook-server"
+
+// authorizedKeyOptions are the restrictions that always apply to the server public key
+const authorizedKeyOptions = "no-agent-forwarding,no-port-forwarding,no-pty,no-X11-forwarding"
+
+// authorizedKeysFilename returns the path of the authorized keys of a user
+func authorizedKeysFilename(homeDir string, groupname string, username string) string {
+	return path.Join(homeDir, groupname, username, ".ssh", "authorized_keys")
+}
+
+// authorizedKeyLine returns the authorized keys entry for the server public key.
+// The key is restricted to connections from the given host pattern and to the given forced command, if set.
+func authorizedKeyLine(publicKeyBytes []byte, from string, command string) (string, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(publicKeyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	var options []string
+	if from != "" {
+		options = append(options, fmt.Sprintf("from=\"%s\"", from))
+	}
+	if command != "" {
+		options = append(options, fmt.Sprintf("command=\"%s\"", command))
+	}
+	options = append(options, authorizedKeyOptions)
+
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	return fmt.Sprintf("%s %s %s", strings.Join(options, ","), key, AuthorizedKeyMarker), nil
+}
+
+// isServerAuthorizedKey checks if an authorized keys entry is one of the given server public key.
+// Entries are recognised by their key, so this includes the unmarked entries of earlier versions,
+// while the entries of another server key are left alone during a key rotation.
+func isServerAuthorizedKey(line string, publicKeyBytes []byte) bool {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(publicKeyBytes)
+	if err != nil {
+		return false
+	}
+	entryKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(entryKey.Marshal(), publicKey.Marshal())
+}
+
+// Remove the entries of the server public key from the authorized keys, and return the remaining lines
+func withoutServerAuthorizedKeys(authorizedKeys []byte, publicKeyBytes []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(authorizedKeys), "\n") {
+		if line == "" || isServerAuthorizedKey(line, publicKeyBytes) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Add the server public key to the authorized keys of a user.
+// Adding the key is idempotent: an existing entry of the same key is replaced.
+func addAuthorizedPublicKey(homeDir string, groupname string, username string, publicKeyFilename string, from string, command string) error {
 	sshDir := path.Join(homeDir, groupname, username, ".ssh")
 	err := os.MkdirAll(sshDir, os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	authorizedKeysFilename := path.Join(sshDir, "authorized_keys")
-	fp, err := os.OpenFile(authorizedKeysFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0655)
+	publicKeyBytes, err := ioutil.ReadFile(publicKeyFilename)
+	if err != nil {
+		return err
+	}
+	entry, err := authorizedKeyLine(publicKeyBytes, from, command)
+	if err != nil {
+		return err
+	}
+
+	filename := authorizedKeysFilename(homeDir, groupname, username)
+	authorizedKeys, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := append(withoutServerAuthorizedKeys(authorizedKeys, publicKeyBytes), entry)
+	return writeAuthorizedKeys(filename, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// Remove the server public key from the authorized keys of a user
+func removeAuthorizedPublicKey(homeDir string, groupname string, username string, publicKeyFilename string) error {
+	filename := authorizedKeysFilename(homeDir, groupname, username)
+	authorizedKeys, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
 
-	// Append the public key to the
 	publicKeyBytes, err := ioutil.ReadFile(publicKeyFilename)
 	if err != nil {
 		return err
 	}
-	_, err = fp.Write(publicKeyBytes)
+
+	var content string
+	if lines := withoutServerAuthorizedKeys(authorizedKeys, publicKeyBytes); len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	return writeAuthorizedKeys(filename, []byte(content))
+}
+
+// fileOwner returns the user and group id owning a file, if the file system provides them
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// writeAuthorizedKeys replaces the authorized keys of a user with a temporary file that is renamed into place,
+// so a crash or a full disk never leaves them truncated. The mode and owner of the existing file are kept;
+// a new file is only readable by the owner of its directory.
+func writeAuthorizedKeys(filename string, content []byte) (err error) {
+	mode := os.FileMode(0600)
+	owner, err := os.Stat(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(filename)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		mode = fi.Mode()
+		owner = fi
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(filename), ".authorized_keys-")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
 
-	return err
+	if _, err = tmp.Write(content); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(owner); ok {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// userLocks serializes the changes to the authorized keys of each user within the server,
+// together with the registrations that decide whether the server key is needed
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// authorizedKeysLocks are the locks of the authorized keys of the users
+var authorizedKeysLocks userLocks
+
+// lock locks the authorized keys of a user, and returns the function unlocking them
+func (l *userLocks) lock(groupname string, username string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	key := path.Join(groupname, username)
+	m, ok := l.locks[key]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[key] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+// lockAuthorizedKeys locks the authorized keys of a user, and returns the function unlocking them.
+// Besides the goroutines of the server, a lock file in the data dir excludes other processes
+// changing the authorized keys, such as the rotate-keys command.
+func (a *API) lockAuthorizedKeys(groupname string, username string) (func(), error) {
+	unlock := authorizedKeysLocks.lock(groupname, username)
+
+	lockDir := path.Join(a.DataDir, "locks", groupname)
+	err := os.MkdirAll(lockDir, 0700)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(path.Join(lockDir, username), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		unlock()
+		return nil, err
+	}
+
+	return func() {
+		// Closing the file releases the lock
+		lockFile.Close()
+		unlock()
+	}, nil
+}
+
+// Remove the server public key from the authorized keys of a user that has no webhooks left,
+// and record it in the audit trail
+func (a *API) revokeUnusedAuthorizedPublicKey(hash string, groupname string, username string, source string, now time.Time) error {
+	// A webhook registered between the count and the removal would lose the key it needs
+	unlock, err := a.lockAuthorizedKeys(groupname, username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	count, err := a.store().CountWebhooks(groupname, username)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, publicKeyFilename := range a.serverPublicKeys() {
+		err = removeAuthorizedPublicKey(a.HomeDir, groupname, username, publicKeyFilename)
+		if err != nil {
+			return err
+		}
+	}
+	a.audit(hash, username, AuditActionRevokeKey, "no webhooks left", source, now)
+	log.WithField("user", username).Info("Server public key removed")
+
+	return nil
 }
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestAddAuthorizedPublicKey(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+
+	err := setupTestCase(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	groupname := "dccngroup"
+	username := "dccnuser"
+	filename := authorizedKeysFilename(testConfig.homeDir, groupname, username)
+
+	publicKey, err := ioutil.ReadFile(testConfig.publicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unrestricted entry of an earlier version and a key of the user
+	otherKey := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC0 someone@somewhere"
+	err = os.MkdirAll(path.Dir(filename), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filename, append([]byte(otherKey+"\n"), publicKey...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filename, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding the key twice results in a single restricted entry
+	for i := 0; i < 2; i++ {
+		err = addAuthorizedPublicKey(testConfig.homeDir, groupname, username, testConfig.publicKeyFilename, "10.0.0.1", "hpc-webhook-submit")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	authorizedKeys, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(authorizedKeys)), "\n")
+	if len(lines) != 2 || lines[0] != otherKey {
+		t.Fatalf("Expected the key of the user and a single server entry, but got:\n%s", authorizedKeys)
+	}
+
+	entry := lines[1]
+	if !strings.HasPrefix(entry, `from="10.0.0.1",command="hpc-webhook-submit",no-agent-forwarding,no-port-forwarding,no-pty,no-X11-forwarding ssh-rsa `) {
+		t.Errorf("Expected a restricted server entry, but got '%s'", entry)
+	}
+	if !strings.HasSuffix(entry, " "+AuthorizedKeyMarker) {
+		t.Errorf("Expected the server entry to be marked with '%s', but got '%s'", AuthorizedKeyMarker, entry)
+	}
+
+	// Removing the key leaves the key of the user
+	err = removeAuthorizedPublicKey(testConfig.homeDir, groupname, username, testConfig.publicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedKeys, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(authorizedKeys) != otherKey+"\n" {
+		t.Errorf("Expected only the key of the user, but got:\n%s", authorizedKeys)
+	}
+
+	// The file is replaced with its mode, without leaving temporary files
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode %v to be kept, but got %v", os.FileMode(0640), fi.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(path.Dir(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only the authorized keys in %s, but got %d files", path.Dir(filename), len(files))
+	}
+}
+
+func TestValidateKeyPair(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	err := os.MkdirAll(keyDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(keyDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	passphraseFilename := path.Join(keyDir, "passphrase")
+	err = ioutil.WriteFile(passphraseFilename, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKeyFilename := path.Join(keyDir, "other.pub")
+	err = generateKeyPair(KeyTypeEd25519, path.Join(keyDir, "other"), otherPublicKeyFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		keyType            string
+		passphrase         []byte
+		passphraseFilename string
+		otherPublicKey     bool
+		expectedError      string
+	}{
+		{KeyTypeRSA, nil, "", false, ""},
+		{KeyTypeEd25519, nil, "", false, ""},
+		{KeyTypeEd25519, []byte("secret"), passphraseFilename, false, ""},
+		{KeyTypeRSA, []byte("secret"), passphraseFilename, false, ""},
+		{KeyTypeEd25519, []byte("secret"), "", false, "is encrypted, but no passphrase is configured"},
+		{KeyTypeEd25519, []byte("wrong"), passphraseFilename, false, "invalid private key"},
+		{KeyTypeEd25519, nil, "", true, "does not match public key"},
+	}
+
+	for i, testCase := range testCases {
+		privateKeyFilename := path.Join(keyDir, "hpc-webhook")
+		publicKeyFilename := path.Join(keyDir, "hpc-webhook.pub")
+		err = generateKeyPair(testCase.keyType, privateKeyFilename, publicKeyFilename, testCase.passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if testCase.otherPublicKey {
+			publicKeyFilename = otherPublicKeyFilename
+		}
+
+		err = ValidateKeyPair(privateKeyFilename, publicKeyFilename, testCase.passphraseFilename)
+		if testCase.expectedError == "" {
+			if err != nil {
+				t.Errorf("Test case %d: expected no error, but got '%s'", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+			t.Errorf("Test case %d: expected error containing '%s', but got '%v'", i, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestLockAuthorizedKeys(t *testing.T) {
+	dataDir := path.Join("..", "..", "test", "results", "locks")
+	defer func() {
+		if err := os.RemoveAll(dataDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	api := API{DataDir: dataDir}
+
+	unlock, err := api.lockAuthorizedKeys("dccngroup", "dccnuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process, such as the rotate-keys command, cannot take the lock meanwhile
+	lockFile, err := os.Open(path.Join(dataDir, "locks", "dccngroup", "dccnuser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Expected the lock to be held, but got '%v'", err)
+	}
+
+	unlock()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("Expected the lock to be released, but got '%s'", err)
+	}
+}
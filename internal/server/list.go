@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Orders of the webhooks of a user in the listing
+const (
+	ListSortCreated       = "created"       // ListSortCreated lists the oldest webhooks first
+	ListSortLastTriggered = "lastTriggered" // ListSortLastTriggered lists the most recently triggered webhooks first, and the ones never triggered last
+)
+
+// DefaultListLimit is the number of webhooks in a page of the listing, unless requested otherwise
+const DefaultListLimit = 100
+
+// MaxListLimit is the largest number of webhooks in a page of the listing
+const MaxListLimit = 1000
+
+// ListOptions selects, orders and pages the webhooks of a user
+type ListOptions struct {
+	Sort        string // ListSortCreated (default) or ListSortLastTriggered
+	Description string // Substring of the description, case-insensitive
+	Enabled     *bool  // Only the enabled or disabled webhooks
+	Provider    string // Only the webhooks with deliveries from this sender, e.g. github
+	Limit       int    // Number of webhooks in the page, DefaultListLimit when 0
+	Cursor      string // Position after the previous page, empty for the first page
+}
+
+// listCursor is the position after the last webhook of a page: its sort key and id
+type listCursor struct {
+	Sort          string `json:"s"`
+	LastTriggered string `json:"t,omitempty"`
+	ID            int    `json:"i"`
+}
+
+// Encode the position after a webhook as an opaque cursor
+func encodeListCursor(sortOrder string, item Item) string {
+	data, _ := json.Marshal(listCursor{Sort: sortOrder, LastTriggered: item.LastTriggered, ID: item.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode a cursor, which must have been issued for the same order of the listing
+func decodeListCursor(cursor string, sortOrder string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Sort != sortOrder {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// Apply the defaults of the listing options
+func (options ListOptions) withDefaults() ListOptions {
+	if options.Sort == "" {
+		options.Sort = ListSortCreated
+	}
+	if options.Limit <= 0 {
+		options.Limit = DefaultListLimit
+	}
+	return options
+}
+
+// Obtain the listing options from the query of a request
+func parseListOptions(req *http.Request) (ListOptions, error) {
+	query := req.URL.Query()
+	options := ListOptions{
+		Sort:        query.Get("sort"),
+		Description: query.Get("description"),
+		Provider:    query.Get("provider"),
+		Cursor:      query.Get("cursor"),
+	}
+
+	if options.Sort != "" && options.Sort != ListSortCreated && options.Sort != ListSortLastTriggered {
+		return options, fmt.Errorf("invalid sort '%s': expected %s or %s", options.Sort, ListSortCreated, ListSortLastTriggered)
+	}
+	if s := query.Get("enabled"); s != "" {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return options, fmt.Errorf("invalid enabled '%s'", s)
+		}
+		options.Enabled = &enabled
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			return options, fmt.Errorf("invalid limit '%s': expected 1 to %d", s, MaxListLimit)
+		}
+		options.Limit = limit
+	}
+
+	options = options.withDefaults()
+	if options.Cursor != "" {
+		if _, err := decodeListCursor(options.Cursor, options.Sort); err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+// Tell whether a webhook comes before another one in the order of the listing
+func listedBefore(sortOrder string, a Item, b Item) bool {
+	if sortOrder == ListSortLastTriggered && a.LastTriggered != b.LastTriggered {
+		if a.LastTriggered == "" || b.LastTriggered == "" {
+			return b.LastTriggered == ""
+		}
+		return a.LastTriggered > b.LastTriggered
+	}
+	return a.ID < b.ID
+}
+
+// Order the selected webhooks and take the page after the cursor, for stores that do not do it themselves.
+// The cursor of the next page is empty when there are no more webhooks.
+func pageItems(items []Item, options ListOptions) ([]Item, string, error) {
+	options = options.withDefaults()
+	sort.SliceStable(items, func(i, j int) bool { return listedBefore(options.Sort, items[i], items[j]) })
+
+	if options.Cursor != "" {
+		c, err := decodeListCursor(options.Cursor, options.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		position := Item{ID: c.ID, LastTriggered: c.LastTriggered}
+		i := sort.Search(len(items), func(i int) bool { return listedBefore(options.Sort, position, items[i]) })
+		items = items[i:]
+	}
+
+	if len(items) <= options.Limit {
+		return items, "", nil
+	}
+	items = items[:options.Limit]
+	return items, encodeListCursor(options.Sort, items[len(items)-1]), nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseListOptions(t *testing.T) {
+	cursor := encodeListCursor(ListSortLastTriggered, Item{ID: 2, LastTriggered: "2019-03-12T10:00:00+01:00"})
+
+	cases := []struct {
+		query          string
+		expectedResult bool
+		expectedLimit  int
+		expectedSort   string
+	}{
+		{"", true, DefaultListLimit, ListSortCreated},
+		{"?limit=10&sort=lastTriggered&cursor=" + cursor, true, 10, ListSortLastTriggered},
+		{"?description=build&enabled=false&provider=github", true, DefaultListLimit, ListSortCreated},
+		{"?sort=name", false, 0, ""},               // Unknown order
+		{"?enabled=sometimes", false, 0, ""},       // Invalid enabled state
+		{"?limit=1001", false, 0, ""},              // Page too large
+		{"?cursor=" + cursor, false, 0, ""},        // Cursor of another order
+		{"?cursor=invalid%20cursor", false, 0, ""}, // Invalid cursor
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", "/configuration"+c.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := parseListOptions(req)
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Test case %d: expected result %v, but got error '%v'", i, c.expectedResult, err)
+			continue
+		}
+		if c.expectedResult && (options.Limit != c.expectedLimit || options.Sort != c.expectedSort) {
+			t.Errorf("Test case %d: expected limit %d and sort %s, but got %+v", i, c.expectedLimit, c.expectedSort, options)
+		}
+	}
+}
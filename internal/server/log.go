@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header carrying the id of a request.
+// An id set by a reverse proxy is kept, otherwise the server assigns one.
+const RequestIDHeader = "X-Request-ID"
+
+// contextKey is the type of the values stored by the server in a request context
+type contextKey string
+
+const loggerContextKey contextKey = "logger"
+
+// SetupLogging sets the level (e.g. "info" or "debug") and the format ("text" or "json") of the server log.
+// Payload contents are only logged at the trace level.
+func SetupLogging(level string, format string) error {
+	if level != "" {
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(l)
+	}
+
+	switch format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format '%s'", format)
+	}
+	return nil
+}
+
+// RequestLogger assigns an id to every request, returns it in the response headers
+// and makes a logger with the id available to the handlers
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := log.WithFields(log.Fields{
+			"request": requestID,
+			"method":  req.Method,
+		})
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), loggerContextKey, logger)))
+	})
+}
+
+// requestLogger returns the logger of a request, or a logger without request id
+// when the request did not pass the RequestLogger
+func requestLogger(req *http.Request) *log.Entry {
+	if logger, ok := req.Context().Value(loggerContextKey).(*log.Entry); ok {
+		return logger
+	}
+	return log.WithField("method", req.Method)
+}
+
+// requestID returns the id assigned to a request by the RequestLogger
+func requestID(req *http.Request) string {
+	if id, ok := requestLogger(req).Data["request"].(string); ok {
+		return id
+	}
+	return ""
+}
+
+// deliveryLogger returns the logger for the background processing of a delivery,
+// correlated with the request that received it
+func deliveryLogger(conf executeConfiguration) *log.Entry {
+	return log.WithFields(log.Fields{
+		"request":  conf.requestID,
+		"delivery": conf.deliveryID,
+		"webhook":  conf.webhookID,
+	})
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func() {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+
+	var testCases = []struct {
+		level          string
+		format         string
+		expectedLevel  log.Level
+		expectedJSON   bool
+		expectedResult bool
+	}{
+		{"", "", log.InfoLevel, false, true},
+		{"debug", "json", log.DebugLevel, true, true},
+		{"loud", "text", log.DebugLevel, true, false}, // Invalid level
+		{"info", "xml", log.InfoLevel, true, false},   // Invalid format
+	}
+
+	for i, testCase := range testCases {
+		err := SetupLogging(testCase.level, testCase.format)
+		if (err == nil) != testCase.expectedResult {
+			t.Errorf("Test case %d: expected result %v, but got error '%v'", i, testCase.expectedResult, err)
+		}
+		if level := log.GetLevel(); level != testCase.expectedLevel {
+			t.Errorf("Test case %d: expected level %s, but got %s", i, testCase.expectedLevel, level)
+		}
+		if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); ok != testCase.expectedJSON {
+			t.Errorf("Test case %d: expected JSON format %v, but got %v", i, testCase.expectedJSON, ok)
+		}
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var testCases = []struct {
+		requestID  string
+		expectedID string
+	}{
+		{"", ""},                             // A new id is assigned
+		{"proxy-1234.abc", "proxy-1234.abc"}, // The id of the reverse proxy is kept
+		{"bad id\n", ""},                     // An invalid id is replaced
+	}
+
+	for i, testCase := range testCases {
+		req, err := http.NewRequest("POST", "/webhook", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if testCase.requestID != "" {
+			req.Header.Set(RequestIDHeader, testCase.requestID)
+		}
+
+		var handlerID string
+		var fields log.Fields
+		handler := RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			handlerID = requestID(req)
+			fields = requestLogger(req).Data
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		responseID := rr.Header().Get(RequestIDHeader)
+		if !isValidRequestID(responseID) || responseID != handlerID {
+			t.Errorf("Test case %d: expected the request id '%s' in the response, but got '%s'", i, handlerID, responseID)
+		}
+		if testCase.expectedID != "" && responseID != testCase.expectedID {
+			t.Errorf("Test case %d: expected request id '%s', but got '%s'", i, testCase.expectedID, responseID)
+		}
+
+		if fields["request"] != responseID || fields["method"] != "POST" {
+			t.Errorf("Test case %d: unexpected log fields %v", i, fields)
+		}
+	}
+}
+
+func TestDeliveryLogger(t *testing.T) {
+	conf := executeConfiguration{
+		requestID:  "request1",
+		deliveryID: "delivery1",
+		webhookID:  "550e8400-e29b-41d4-a716-446655440001",
+		payload:    []byte(`{"secret": "value"}`),
+	}
+
+	logger := deliveryLogger(conf)
+	expected := log.Fields{
+		"request":  "request1",
+		"delivery": "delivery1",
+		"webhook":  "550e8400-e29b-41d4-a716-446655440001",
+	}
+	if len(logger.Data) != len(expected) {
+		t.Errorf("Expected fields %v, but got %v", expected, logger.Data)
+	}
+	for key, value := range expected {
+		if logger.Data[key] != value {
+			t.Errorf("Expected field %s '%v', but got '%v'", key, value, logger.Data[key])
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps the webhooks in memory, for unit tests without a database
+type memoryStore struct {
+	mu                     sync.Mutex
+	hpcWebhookHost         string
+	hpcWebhookExternalPort string
+	lastID                 int
+	webhooks               []Item // Ordered by id
+	deliveries             []memoryDelivery
+	tokens                 []memoryToken
+	audit                  []AuditRecord // Ordered by id
+	rotations              []KeyRotation // Ordered by id
+	migrations             []memoryKeyMigration
+}
+
+// memoryToken is a previous public token of a webhook, which is accepted until it expires
+type memoryToken struct {
+	token   string
+	hash    string
+	expires string
+}
+
+// memoryKeyMigration records that a user has been migrated to the new key of a rotation
+type memoryKeyMigration struct {
+	rotation  int
+	groupname string
+	username  string
+}
+
+// memoryDelivery is a delivery in the history of a memory store
+type memoryDelivery struct {
+	delivery string
+	hash     string
+	received string
+	status   string
+	job      string
+	trace    string
+	provider string
+}
+
+// NewMemoryStore returns an empty store keeping the webhooks in memory
+func NewMemoryStore(hpcWebhookHost string, hpcWebhookExternalPort string) Store {
+	return &memoryStore{
+		hpcWebhookHost:         hpcWebhookHost,
+		hpcWebhookExternalPort: hpcWebhookExternalPort,
+	}
+}
+
+// Check that a webhook has a specific hash and belongs to a specific user
+func isWebhookOf(item Item, hash string, groupname string, username string) bool {
+	return item.Hash == hash && item.Groupname == groupname && item.Username == username
+}
+
+// Find the index of the first webhook that matches, -1 if there is none
+func (s *memoryStore) find(match func(item Item) bool) int {
+	for i, item := range s.webhooks {
+		if match(item) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Select the webhooks that match, with their payload URL
+func (s *memoryStore) filter(match func(item Item) bool) []Item {
+	var list []Item
+	for _, item := range s.webhooks {
+		if match(item) {
+			item.URL = fmt.Sprintf("https://%s:%s%s/%s", s.hpcWebhookHost, s.hpcWebhookExternalPort, WebhookPath, item.Token)
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (s *memoryStore) AddWebhook(item Item) error {
+	if !isValidWebhookID(item.Hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.find(func(p Item) bool { return p.Hash == item.Hash || p.Token == item.Token }) >= 0 {
+		return errors.New("webhook already exists")
+	}
+	s.lastID++
+	item.ID = s.lastID
+	item.Enabled = true
+	item.URL = ""
+	s.webhooks = append(s.webhooks, item)
+	return nil
+}
+
+func (s *memoryStore) GetWebhook(hash string, groupname string, username string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(p Item) bool { return isWebhookOf(p, hash, groupname, username) }), nil
+}
+
+func (s *memoryStore) GetWebhookByHash(hash string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(p Item) bool { return p.Hash == hash }), nil
+}
+
+func (s *memoryStore) GetWebhookByToken(token string, now string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(p Item) bool { return p.Token == token || s.hasToken(p.Hash, token, now) }), nil
+}
+
+// Check that a previous token of a webhook is still accepted
+func (s *memoryStore) hasToken(hash string, token string, now string) bool {
+	for _, t := range s.tokens {
+		if t.hash == hash && t.token == token && t.expires > now {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) ListWebhooks(groupname string, username string, options ListOptions) ([]Item, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	description := strings.ToLower(options.Description)
+	list := s.filter(func(p Item) bool {
+		return p.Groupname == groupname && p.Username == username &&
+			strings.Contains(strings.ToLower(p.Description), description) &&
+			(options.Enabled == nil || p.Enabled == *options.Enabled) &&
+			(options.Provider == "" || s.hasDelivery(p.Hash, options.Provider))
+	})
+	for i := range list {
+		for _, d := range s.deliveries {
+			if d.hash == list[i].Hash && d.received > list[i].LastTriggered {
+				list[i].LastTriggered = d.received
+			}
+		}
+	}
+	return pageItems(list, options)
+}
+
+// Check that a webhook has a delivery from a specific sender
+func (s *memoryStore) hasDelivery(hash string, provider string) bool {
+	for _, d := range s.deliveries {
+		if d.hash == hash && d.provider == provider {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) ExpiredWebhooks(now string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(p Item) bool { return p.Expires != "" && p.Expires <= now }), nil
+}
+
+func (s *memoryStore) CountWebhooks(groupname string, username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.filter(func(p Item) bool { return p.Groupname == groupname && p.Username == username })), nil
+}
+
+func (s *memoryStore) DeleteWebhook(hash string, groupname string, username string) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(func(p Item) bool { return isWebhookOf(p, hash, groupname, username) })
+	if i >= 0 {
+		s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+		s.tokens = s.keepTokens(func(t memoryToken) bool { return t.hash != hash })
+	}
+	return nil
+}
+
+// Select the previous tokens to keep
+func (s *memoryStore) keepTokens(keep func(t memoryToken) bool) []memoryToken {
+	var tokens []memoryToken
+	for _, t := range s.tokens {
+		if keep(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func (s *memoryStore) UpdateWebhook(update ConfigurationUpdateRequest) error {
+	if !isValidWebhookID(update.Hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(func(p Item) bool { return isWebhookOf(p, update.Hash, update.Groupname, update.Username) })
+	if i < 0 {
+		return errors.New("webhook not found")
+	}
+	s.webhooks[i] = update.apply(s.webhooks[i])
+	return nil
+}
+
+func (s *memoryStore) SetWebhookEnabled(hash string, groupname string, username string, enabled bool) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(func(p Item) bool { return isWebhookOf(p, hash, groupname, username) })
+	if i < 0 {
+		return errors.New("webhook not found")
+	}
+	s.webhooks[i].Enabled = enabled
+	return nil
+}
+
+func (s *memoryStore) RotateToken(hash string, groupname string, username string, token string, expires string) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+	if !isValidWebhookID(token) {
+		return errors.New("invalid token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(func(p Item) bool { return isWebhookOf(p, hash, groupname, username) })
+	if i < 0 {
+		return errors.New("webhook not found")
+	}
+	s.tokens = append(s.tokens, memoryToken{token: s.webhooks[i].Token, hash: hash, expires: expires})
+	s.webhooks[i].Token = token
+	return nil
+}
+
+func (s *memoryStore) DeleteExpiredTokens(now string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = s.keepTokens(func(t memoryToken) bool { return t.expires > now })
+	return nil
+}
+
+func (s *memoryStore) AddDelivery(delivery string, hash string, received string, status string, trace string, provider string) error {
+	if !isValidWebhookID(hash) {
+		return errors.New("invalid webhook id")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deliveries {
+		if d.delivery == delivery {
+			return errors.New("delivery already exists")
+		}
+	}
+	s.deliveries = append(s.deliveries, memoryDelivery{
+		delivery: delivery,
+		hash:     hash,
+		received: received,
+		status:   status,
+		trace:    trace,
+		provider: provider,
+	})
+	return nil
+}
+
+func (s *memoryStore) UpdateDelivery(delivery string, status string, job string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.deliveries {
+		if s.deliveries[i].delivery == delivery {
+			s.deliveries[i].status = status
+			s.deliveries[i].job = job
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) LastJob(hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		if d := s.deliveries[i]; d.hash == hash && d.status == DeliveryStatusSubmitted {
+			return d.job, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *memoryStore) PendingDeliveries() ([]pendingDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []pendingDelivery
+	for _, d := range s.deliveries {
+		if d.status == DeliveryStatusPending || d.status == DeliveryStatusSubmitting {
+			deliveries = append(deliveries, pendingDelivery{Delivery: d.delivery, Hash: d.hash, Status: d.status, Trace: d.trace})
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *memoryStore) Deliveries(filter DeliveryFilter) ([]DeliveryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []DeliveryRecord
+	for i, d := range s.deliveries {
+		if (filter.Hash == "" || d.hash == filter.Hash) &&
+			(filter.Status == "" || d.status == filter.Status) &&
+			(filter.Trace == "" || d.trace == filter.Trace) {
+			list = append(list, DeliveryRecord{
+				ID:       i + 1,
+				Delivery: d.delivery,
+				Hash:     d.hash,
+				Received: d.received,
+				Status:   d.status,
+				Job:      d.job,
+				Trace:    d.trace,
+				Provider: d.provider,
+			})
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) AddAudit(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.ID = len(s.audit) + 1
+	s.audit = append(s.audit, record)
+	return nil
+}
+
+func (s *memoryStore) AuditRecords(filter AuditFilter) ([]AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []AuditRecord
+	for _, r := range s.audit {
+		if (filter.Hash == "" || r.Hash == filter.Hash) &&
+			(filter.Username == "" || r.Username == filter.Username) &&
+			(filter.Trace == "" || r.Trace == filter.Trace) &&
+			(filter.From == "" || r.Created >= filter.From) &&
+			(filter.To == "" || r.Created < filter.To) {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) FilterWebhooks(filter WebhookFilter) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(p Item) bool {
+		return (filter.Groupname == "" || p.Groupname == filter.Groupname) &&
+			(filter.Username == "" || p.Username == filter.Username) &&
+			(filter.Enabled == nil || p.Enabled == *filter.Enabled)
+	}), nil
+}
+
+func (s *memoryStore) UserStats(since string) ([]UserStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []UserStats
+	for _, u := range s.users(func(item Item) bool { return true }) {
+		stats := UserStats{Groupname: u.Groupname, Username: u.Username}
+		for _, item := range s.webhooks {
+			if item.Groupname != u.Groupname || item.Username != u.Username {
+				continue
+			}
+			stats.Webhooks++
+			for _, d := range s.deliveries {
+				switch {
+				case d.hash != item.Hash:
+				case d.status == DeliveryStatusPending:
+					stats.Queued++
+				case d.status == DeliveryStatusFailed:
+					if d.received >= since {
+						stats.Failures++
+					}
+					if d.received > stats.LastFailure {
+						stats.LastFailure = d.received
+					}
+				}
+			}
+		}
+		list = append(list, stats)
+	}
+	return list, nil
+}
+
+func (s *memoryStore) AddKeyRotation(rotation KeyRotation) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rotation.ID = len(s.rotations) + 1
+	s.rotations = append(s.rotations, rotation)
+	return rotation.ID, nil
+}
+
+func (s *memoryStore) LatestKeyRotation() (KeyRotation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.rotations) == 0 {
+		return KeyRotation{}, false, nil
+	}
+	return s.rotations[len(s.rotations)-1], true, nil
+}
+
+func (s *memoryStore) FinishKeyRotation(id int, finished string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rotations {
+		if s.rotations[i].ID == id {
+			s.rotations[i].Finished = finished
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AddKeyMigration(rotation int, groupname string, username string, migrated string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isMigrated(rotation, groupname, username) {
+		return errors.New("user already migrated")
+	}
+	s.migrations = append(s.migrations, memoryKeyMigration{rotation: rotation, groupname: groupname, username: username})
+	return nil
+}
+
+// Check that a user has been migrated to the new key of a rotation
+func (s *memoryStore) isMigrated(rotation int, groupname string, username string) bool {
+	for _, m := range s.migrations {
+		if m.rotation == rotation && m.groupname == groupname && m.username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Select the distinct users of the webhooks that match, ordered by group and name
+func (s *memoryStore) users(match func(item Item) bool) []webhookUser {
+	var users []webhookUser
+	seen := make(map[webhookUser]bool)
+	for _, item := range s.webhooks {
+		u := webhookUser{Groupname: item.Groupname, Username: item.Username}
+		if match(item) && !seen[u] {
+			seen[u] = true
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Groupname != users[j].Groupname {
+			return users[i].Groupname < users[j].Groupname
+		}
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (s *memoryStore) Users() ([]webhookUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.users(func(item Item) bool { return true }), nil
+}
+
+func (s *memoryStore) UnmigratedUsers(rotation int) ([]webhookUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.users(func(item Item) bool { return !s.isMigrated(rotation, item.Groupname, item.Username) }), nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
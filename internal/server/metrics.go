@@ -0,0 +1,101 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons for rejecting a webhook delivery, used as label of the rejected deliveries
+const (
+	RejectReasonMethod   = "method"   // RejectReasonMethod is a request with another method than POST
+	RejectReasonURL      = "url"      // RejectReasonURL is a request for an invalid payload URL
+	RejectReasonUnknown  = "unknown"  // RejectReasonUnknown is a delivery for a webhook that does not exist
+	RejectReasonPayload  = "payload"  // RejectReasonPayload is a delivery of which the payload cannot be read
+	RejectReasonDisabled = "disabled" // RejectReasonDisabled is a delivery for a disabled webhook
+	RejectReasonFiltered = "filtered" // RejectReasonFiltered is a delivery for an event the webhook is not interested in
+	RejectReasonInternal = "internal" // RejectReasonInternal is a delivery that cannot be stored by the server
+	RejectReasonShutdown = "shutdown" // RejectReasonShutdown is a delivery received while the server is shutting down
+)
+
+var (
+	deliveriesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hpc_webhook",
+		Name:      "deliveries_received_total",
+		Help:      "Number of webhook deliveries received, per provider.",
+	}, []string{"provider"})
+
+	deliveriesAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hpc_webhook",
+		Name:      "deliveries_accepted_total",
+		Help:      "Number of webhook deliveries accepted for processing, per provider.",
+	}, []string{"provider"})
+
+	deliveriesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hpc_webhook",
+		Name:      "deliveries_rejected_total",
+		Help:      "Number of webhook deliveries rejected, per provider and reason.",
+	}, []string{"provider", "reason"})
+
+	deliveriesQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hpc_webhook",
+		Name:      "deliveries_queued",
+		Help:      "Number of accepted deliveries waiting to be processed, including those within a coalescing window.",
+	})
+
+	jobsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hpc_webhook",
+		Name:      "jobs_in_flight",
+		Help:      "Number of deliveries being submitted to the relay node.",
+	})
+
+	sshDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hpc_webhook",
+		Name:      "ssh_dial_duration_seconds",
+		Help:      "Duration of the SSH connections to the relay node, per result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	qsubDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hpc_webhook",
+		Name:      "qsub_duration_seconds",
+		Help:      "Duration of the job submissions on the relay node, per result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	databaseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hpc_webhook",
+		Name:      "database_errors_total",
+		Help:      "Number of failed database operations, per operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		deliveriesReceived,
+		deliveriesAccepted,
+		deliveriesRejected,
+		deliveriesQueued,
+		jobsInFlight,
+		sshDialDuration,
+		qsubDuration,
+		databaseErrors,
+	)
+}
+
+// Observe the duration of an operation on the relay node since the given start
+func observeDuration(histogram *prometheus.HistogramVec, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	histogram.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// Count a failed database operation, and return the error
+func databaseError(operation string, err error) error {
+	if err != nil {
+		databaseErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExtractWebhookProvider(t *testing.T) {
+	var testCases = []struct {
+		header           string
+		expectedProvider string
+	}{
+		{"X-GitHub-Event", "github"},
+		{"X-Gitea-Event", "gitea"},
+		{"X-Gogs-Event", "gogs"},
+		{"X-Gitlab-Event", "gitlab"},
+		{"", "other"},
+	}
+
+	for _, testCase := range testCases {
+		req, err := http.NewRequest("POST", "/webhook", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if testCase.header != "" {
+			req.Header.Set(testCase.header, "push")
+		}
+		if provider := extractWebhookProvider(req); provider != testCase.expectedProvider {
+			t.Errorf("Expected provider '%s', but got '%s'", testCase.expectedProvider, provider)
+		}
+	}
+}
+
+func TestWebhookHandlerMetrics(t *testing.T) {
+	received := testutil.ToFloat64(deliveriesReceived.WithLabelValues("github"))
+	rejected := testutil.ToFloat64(deliveriesRejected.WithLabelValues("github", RejectReasonURL))
+
+	api := API{}
+	app := &api
+
+	req, err := http.NewRequest("POST", "/webhook/invalid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-GitHub-Event", "push")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.WebhookHandler)
+	handler.ServeHTTP(rr, req)
+
+	if value := testutil.ToFloat64(deliveriesReceived.WithLabelValues("github")); value != received+1 {
+		t.Errorf("Expected %v received deliveries, but got %v", received+1, value)
+	}
+	if value := testutil.ToFloat64(deliveriesRejected.WithLabelValues("github", RejectReasonURL)); value != rejected+1 {
+		t.Errorf("Expected %v rejected deliveries, but got %v", rejected+1, value)
+	}
+}
+
+func TestDatabaseError(t *testing.T) {
+	errors0 := testutil.ToFloat64(databaseErrors.WithLabelValues("getRow"))
+
+	if err := databaseError("getRow", nil); err != nil {
+		t.Errorf("Expected no error, but got '%s'", err)
+	}
+	if value := testutil.ToFloat64(databaseErrors.WithLabelValues("getRow")); value != errors0 {
+		t.Errorf("Expected %v database errors, but got %v", errors0, value)
+	}
+
+	err := errors.New("connection refused")
+	if databaseError("getRow", err) != err {
+		t.Errorf("Expected the error to be returned")
+	}
+	if value := testutil.ToFloat64(databaseErrors.WithLabelValues("getRow")); value != errors0+1 {
+		t.Errorf("Expected %v database errors, but got %v", errors0+1, value)
+	}
+}
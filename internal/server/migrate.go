@@ -0,0 +1,205 @@
+package server
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationFiles are the versioned changes of the database schema, named <version>_<description>.<up|down>.sql.
+// The migrations only create what does not exist yet, so that they can be applied to a database
+// of which the schema was created before the migrations were recorded.
+// A migration of which the statements differ for SQLite has a <version>_<description>.<up|down>.sqlite.sql file
+// replacing the PostgreSQL one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Check the name of a migration file, and extract its version, description and direction
+var migrationFilenameRegex = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.(up|down)(\.sqlite)?\.sql$`)
+
+// migration is a versioned change of the database schema, with the statements to apply and to revert it
+type migration struct {
+	version     int
+	description string
+	up          string
+	down        string
+}
+
+// Read the embedded migrations of a database dialect, ordered by version.
+// Every version from 1 on must have an up and a down migration.
+func loadMigrations(dialect string) ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFilenameRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration filename '%s'", entry.Name())
+		}
+		if match[4] != "" && dialect != StoreSchemeSQLite {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		statements, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, description: match[2]}
+			byVersion[version] = m
+		}
+		// The statements for SQLite take precedence over the common ones, whatever the order of the files
+		switch {
+		case match[3] == "up" && (match[4] != "" || m.up == ""):
+			m.up = string(statements)
+		case match[3] == "down" && (match[4] != "" || m.down == ""):
+			m.down = string(statements)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("missing migration for schema version %d", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration for schema version %d must have an up and a down migration", m.version)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version of the database schema the server works with
+func LatestSchemaVersion() int {
+	migrations, err := loadMigrations(StoreSchemePostgres)
+	if err != nil {
+		return 0
+	}
+	return len(migrations)
+}
+
+// Create the table recording the applied migrations
+func createSchemaMigrations(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations(
+		version     INTEGER PRIMARY KEY,
+		description VARCHAR (255) NOT NULL,
+		applied     TIMESTAMP NOT NULL)`)
+	return databaseError("createSchemaMigrations", err)
+}
+
+// SchemaVersion returns the version of the database schema, 0 when no migration has been applied
+func SchemaVersion(db *sql.DB) (int, error) {
+	if err := createSchemaMigrations(db); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, databaseError("SchemaVersion", err)
+}
+
+// Migrate applies or reverts migrations until the database schema has the given version.
+// The migrations of the dialect of the database are applied, PostgreSQL or SQLite.
+func Migrate(db *sql.DB, target int) error {
+	dialect := databaseDialect(db)
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("invalid schema version %d: expected a version from 0 to %d", target, len(migrations))
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest version %d of the server", version, len(migrations))
+	}
+
+	for ; version < target; version++ {
+		if err := applyMigration(db, dialect, migrations[version], true); err != nil {
+			return err
+		}
+	}
+	for ; version > target; version-- {
+		if err := applyMigration(db, dialect, migrations[version-1], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply or revert a single migration, and record it in the schema migrations.
+// Servers migrating the same database at the same time wait for each other, a migration is applied only once.
+// An SQLite database has a single writer, which needs no lock.
+func applyMigration(db *sql.DB, dialect string, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return databaseError("applyMigration", err)
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	if dialect == StoreSchemePostgres {
+		if _, err = tx.Exec("LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+			return databaseError("applyMigration", err)
+		}
+	}
+	var version int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return databaseError("applyMigration", err)
+	}
+
+	if up {
+		// Another server may have applied the migration meanwhile
+		if version >= m.version {
+			return nil
+		}
+		if _, err = tx.Exec(m.up); err != nil {
+			return fmt.Errorf("error applying migration %d_%s: %s", m.version, m.description, err)
+		}
+		if _, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied) VALUES ($1, $2, $3)",
+			m.version, m.description, time.Now().Format(time.RFC3339)); err != nil {
+			return databaseError("applyMigration", err)
+		}
+		log.Infof("Database schema migrated up to version %d: %s", m.version, m.description)
+		return err
+	}
+
+	if version < m.version {
+		return nil
+	}
+	if _, err = tx.Exec(m.down); err != nil {
+		return fmt.Errorf("error reverting migration %d_%s: %s", m.version, m.description, err)
+	}
+	if _, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.version); err != nil {
+		return databaseError("applyMigration", err)
+	}
+	log.Infof("Database schema migrated down to version %d", m.version-1)
+	return err
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(StoreSchemePostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != LatestSchemaVersion() {
+		t.Errorf("Expected %d migrations, but got %d", LatestSchemaVersion(), len(migrations))
+	}
+
+	// The first version is the original webhook table
+	if migrations[0].description != "create_hpc_webhook" || !strings.Contains(migrations[0].up, "CREATE TABLE IF NOT EXISTS hpc_webhook(") {
+		t.Errorf("Expected version 1 to create the hpc_webhook table, but got %s: %s", migrations[0].description, migrations[0].up)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected version %d, but got %d", i+1, m.version)
+		}
+	}
+
+	// SQLite has the same versions, with its own statements where needed
+	sqliteMigrations, err := loadMigrations(StoreSchemeSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqliteMigrations) != len(migrations) {
+		t.Errorf("Expected %d SQLite migrations, but got %d", len(migrations), len(sqliteMigrations))
+	}
+	if !strings.Contains(sqliteMigrations[0].up, "AUTOINCREMENT") || sqliteMigrations[0].down != migrations[0].down {
+		t.Errorf("Expected version 1 to have its own up migration for SQLite only, but got %s", sqliteMigrations[0].up)
+	}
+}
+
+// Expect the schema migrations table to be created, and report the current version
+func expectSchemaVersion(mock sqlmock.Sqlmock, version int) {
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+}
+
+// Expect a single migration to be applied or reverted, starting from the given version
+func expectMigration(mock sqlmock.Sqlmock, m migration, version int, up bool) {
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+	if up {
+		mock.ExpectExec(regexp.QuoteMeta(m.up)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO schema_migrations").
+			WithArgs(m.version, m.description, AnyTimeString{}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	} else {
+		mock.ExpectExec(regexp.QuoteMeta(m.down)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM schema_migrations").
+			WithArgs(m.version).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func TestMigrate(t *testing.T) {
+	migrations, err := loadMigrations(StoreSchemePostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := len(migrations)
+
+	cases := []struct {
+		version        int
+		target         int
+		expectedResult bool
+	}{
+		{latest - 2, latest, true},     // Apply the missing migrations
+		{latest, latest - 1, true},     // Revert the last migration
+		{latest, latest, true},         // Up to date
+		{latest + 1, latest, false},    // Schema newer than the server
+		{latest, latest + 1, false},    // Unknown target version
+		{latest - 1, latest - 1, true}, // Nothing to do
+	}
+
+	for i, c := range cases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		if c.target >= 0 && c.target <= latest {
+			expectSchemaVersion(mock, c.version)
+		}
+		if c.expectedResult {
+			for version := c.version; version < c.target; version++ {
+				expectMigration(mock, migrations[version], version, true)
+			}
+			for version := c.version; version > c.target; version-- {
+				expectMigration(mock, migrations[version-1], version, false)
+			}
+		}
+
+		err = Migrate(db, c.target)
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Test case %d: expected result %v, but got error '%v'", i, c.expectedResult, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Test case %d: there were unfulfilled expectations: %s", i, err)
+		}
+	}
+}
+
+func TestApplyMigrationConcurrently(t *testing.T) {
+	migrations, err := loadMigrations(StoreSchemePostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Another server applied the migration while waiting for the lock
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectCommit()
+
+	if err := applyMigration(db, StoreSchemePostgres, migrations[0], true); err != nil {
+		t.Errorf("Expected no error, but got '%s'", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
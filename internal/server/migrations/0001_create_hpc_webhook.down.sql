@@ -0,0 +1 @@
+DROP TABLE IF EXISTS hpc_webhook;
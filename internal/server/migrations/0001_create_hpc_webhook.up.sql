@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS hpc_webhook(
+    id          SERIAL PRIMARY KEY,
+    hash        CHAR (36) UNIQUE NOT NULL,
+    groupname   VARCHAR (32) NOT NULL,
+    username    VARCHAR (32) NOT NULL,
+    description VARCHAR (255),
+    created     TIMESTAMP NOT NULL);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS hpc_webhook_delivery;
+ALTER TABLE hpc_webhook DROP COLUMN coalesce_seconds;
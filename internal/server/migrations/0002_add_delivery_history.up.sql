@@ -0,0 +1,7 @@
+ALTER TABLE hpc_webhook ADD COLUMN IF NOT EXISTS coalesce_seconds INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS hpc_webhook_delivery(
+    id          SERIAL PRIMARY KEY,
+    delivery    CHAR (36) UNIQUE NOT NULL,
+    hash        CHAR (36) NOT NULL,
+    received    TIMESTAMP NOT NULL,
+    status      VARCHAR (16) NOT NULL);
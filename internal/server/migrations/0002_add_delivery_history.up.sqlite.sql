@@ -0,0 +1,7 @@
+ALTER TABLE hpc_webhook ADD COLUMN coalesce_seconds INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS hpc_webhook_delivery(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    delivery    CHAR (36) UNIQUE NOT NULL,
+    hash        CHAR (36) NOT NULL,
+    received    TEXT NOT NULL,
+    status      VARCHAR (16) NOT NULL);
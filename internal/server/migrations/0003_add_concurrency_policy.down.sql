@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook_delivery DROP COLUMN IF EXISTS job;
+ALTER TABLE hpc_webhook DROP COLUMN IF EXISTS concurrency;
@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook_delivery DROP COLUMN job;
+ALTER TABLE hpc_webhook DROP COLUMN concurrency;
@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook ADD COLUMN concurrency VARCHAR (8) NOT NULL DEFAULT 'allow';
+ALTER TABLE hpc_webhook_delivery ADD COLUMN job VARCHAR (64) NOT NULL DEFAULT '';
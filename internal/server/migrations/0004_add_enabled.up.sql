@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
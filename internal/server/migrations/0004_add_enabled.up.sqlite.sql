@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook ADD COLUMN enabled BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook DROP COLUMN IF EXISTS qsub_options;
+ALTER TABLE hpc_webhook DROP COLUMN IF EXISTS events;
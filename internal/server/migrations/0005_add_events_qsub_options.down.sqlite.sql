@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook DROP COLUMN qsub_options;
+ALTER TABLE hpc_webhook DROP COLUMN events;
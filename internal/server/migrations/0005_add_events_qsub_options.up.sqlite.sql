@@ -0,0 +1,2 @@
+ALTER TABLE hpc_webhook ADD COLUMN events VARCHAR (255) NOT NULL DEFAULT '';
+ALTER TABLE hpc_webhook ADD COLUMN qsub_options VARCHAR (255) NOT NULL DEFAULT '';
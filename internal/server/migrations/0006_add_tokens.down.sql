@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS hpc_webhook_audit;
+DROP TABLE IF EXISTS hpc_webhook_token;
+ALTER TABLE hpc_webhook DROP COLUMN IF EXISTS token;
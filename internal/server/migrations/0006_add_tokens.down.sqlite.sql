@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS hpc_webhook_audit;
+DROP TABLE IF EXISTS hpc_webhook_token;
+DROP INDEX IF EXISTS hpc_webhook_token_key;
+ALTER TABLE hpc_webhook DROP COLUMN token;
@@ -0,0 +1,23 @@
+-- The public token of existing webhooks is their hash, so their payload URL does not change
+ALTER TABLE hpc_webhook ADD COLUMN IF NOT EXISTS token CHAR (36);
+UPDATE hpc_webhook SET token = hash WHERE token IS NULL;
+ALTER TABLE hpc_webhook ALTER COLUMN token SET NOT NULL;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'hpc_webhook_token_key') THEN
+        ALTER TABLE hpc_webhook ADD CONSTRAINT hpc_webhook_token_key UNIQUE (token);
+    END IF;
+END
+$$;
+CREATE TABLE IF NOT EXISTS hpc_webhook_token(
+    id          SERIAL PRIMARY KEY,
+    token       CHAR (36) UNIQUE NOT NULL,
+    hash        CHAR (36) NOT NULL,
+    expires     TIMESTAMP NOT NULL);
+CREATE TABLE IF NOT EXISTS hpc_webhook_audit(
+    id          SERIAL PRIMARY KEY,
+    hash        CHAR (36) NOT NULL,
+    username    VARCHAR (32) NOT NULL,
+    action      VARCHAR (32) NOT NULL,
+    detail      VARCHAR (255) NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL);
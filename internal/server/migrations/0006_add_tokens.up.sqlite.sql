@@ -0,0 +1,17 @@
+-- The public token of existing webhooks is their hash, so their payload URL does not change.
+-- SQLite cannot add a column without a default value that is not null, nor a unique column.
+ALTER TABLE hpc_webhook ADD COLUMN token CHAR (36) NOT NULL DEFAULT '';
+UPDATE hpc_webhook SET token = hash WHERE token = '';
+CREATE UNIQUE INDEX IF NOT EXISTS hpc_webhook_token_key ON hpc_webhook (token);
+CREATE TABLE IF NOT EXISTS hpc_webhook_token(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    token       CHAR (36) UNIQUE NOT NULL,
+    hash        CHAR (36) NOT NULL,
+    expires     TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS hpc_webhook_audit(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    hash        CHAR (36) NOT NULL,
+    username    VARCHAR (32) NOT NULL,
+    action      VARCHAR (32) NOT NULL,
+    detail      VARCHAR (255) NOT NULL DEFAULT '',
+    created     TEXT NOT NULL);
@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook DROP COLUMN expires;
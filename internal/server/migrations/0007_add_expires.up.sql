@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook ADD COLUMN IF NOT EXISTS expires TIMESTAMP;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS hpc_webhook_key_migration;
+DROP TABLE IF EXISTS hpc_webhook_key_rotation;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS hpc_webhook_key_rotation(
+    id          SERIAL PRIMARY KEY,
+    private_key VARCHAR (255) NOT NULL,
+    public_key  VARCHAR (255) NOT NULL,
+    previous_private_key VARCHAR (255) NOT NULL,
+    previous_public_key VARCHAR (255) NOT NULL,
+    started     TIMESTAMP NOT NULL,
+    finished    TIMESTAMP);
+CREATE TABLE IF NOT EXISTS hpc_webhook_key_migration(
+    id          SERIAL PRIMARY KEY,
+    rotation    INTEGER NOT NULL,
+    groupname   VARCHAR (32) NOT NULL,
+    username    VARCHAR (32) NOT NULL,
+    migrated    TIMESTAMP NOT NULL,
+    UNIQUE (rotation, groupname, username));
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS hpc_webhook_key_rotation(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    private_key VARCHAR (255) NOT NULL,
+    public_key  VARCHAR (255) NOT NULL,
+    previous_private_key VARCHAR (255) NOT NULL,
+    previous_public_key VARCHAR (255) NOT NULL,
+    started     TEXT NOT NULL,
+    finished    TEXT);
+CREATE TABLE IF NOT EXISTS hpc_webhook_key_migration(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    rotation    INTEGER NOT NULL,
+    groupname   VARCHAR (32) NOT NULL,
+    username    VARCHAR (32) NOT NULL,
+    migrated    TEXT NOT NULL,
+    UNIQUE (rotation, groupname, username));
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS hpc_webhook_audit_append_only ON hpc_webhook_audit;
+DROP FUNCTION IF EXISTS hpc_webhook_audit_append_only();
+ALTER TABLE hpc_webhook_audit DROP COLUMN IF EXISTS source;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS hpc_webhook_audit_no_delete;
+DROP TRIGGER IF EXISTS hpc_webhook_audit_no_update;
+ALTER TABLE hpc_webhook_audit DROP COLUMN source;
@@ -0,0 +1,9 @@
+ALTER TABLE hpc_webhook_audit ADD COLUMN IF NOT EXISTS source VARCHAR (255) NOT NULL DEFAULT '';
+CREATE OR REPLACE FUNCTION hpc_webhook_audit_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'hpc_webhook_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS hpc_webhook_audit_append_only ON hpc_webhook_audit;
+CREATE TRIGGER hpc_webhook_audit_append_only BEFORE UPDATE OR DELETE ON hpc_webhook_audit
+    FOR EACH ROW EXECUTE PROCEDURE hpc_webhook_audit_append_only();
@@ -0,0 +1,9 @@
+ALTER TABLE hpc_webhook_audit ADD COLUMN source VARCHAR (255) NOT NULL DEFAULT '';
+CREATE TRIGGER IF NOT EXISTS hpc_webhook_audit_no_update BEFORE UPDATE ON hpc_webhook_audit
+BEGIN
+    SELECT RAISE(ABORT, 'hpc_webhook_audit is append-only');
+END;
+CREATE TRIGGER IF NOT EXISTS hpc_webhook_audit_no_delete BEFORE DELETE ON hpc_webhook_audit
+BEGIN
+    SELECT RAISE(ABORT, 'hpc_webhook_audit is append-only');
+END;
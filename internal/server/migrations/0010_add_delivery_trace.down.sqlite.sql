@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook_delivery DROP COLUMN trace;
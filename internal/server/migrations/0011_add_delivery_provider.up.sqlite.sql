@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook_delivery ADD COLUMN provider VARCHAR (32) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE hpc_webhook_audit DROP COLUMN trace;
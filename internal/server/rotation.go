@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serverIdentity returns the private key files the server authenticates with, newest first,
+// and the public key file that is added to the authorized keys of new users.
+// While a key rotation is in progress, the server tries both the new and the previous key.
+func (a *API) serverIdentity() ([]string, string) {
+	rotation, ok, err := a.store().LatestKeyRotation()
+	if err != nil {
+		log.Error(err)
+	}
+	if err != nil || !ok {
+		return []string{a.PrivateKeyFilename}, a.PublicKeyFilename
+	}
+	if rotation.Finished == "" {
+		return []string{rotation.PrivateKeyFilename, rotation.PreviousPrivateKeyFilename}, rotation.PublicKeyFilename
+	}
+	return []string{rotation.PrivateKeyFilename}, rotation.PublicKeyFilename
+}
+
+// serverPublicKeys returns the public key files that may be present in the authorized keys of users
+func (a *API) serverPublicKeys() []string {
+	rotation, ok, err := a.store().LatestKeyRotation()
+	if err != nil {
+		log.Error(err)
+	}
+	if err != nil || !ok {
+		return []string{a.PublicKeyFilename}
+	}
+	if rotation.Finished == "" {
+		return []string{rotation.PublicKeyFilename, rotation.PreviousPublicKeyFilename}
+	}
+	return []string{rotation.PublicKeyFilename}
+}
+
+// ValidateServerKeys checks the key pairs the server is using, which are the rotated key pairs after a key rotation.
+// During a rotation the previous key pair is checked as well, as both are still in use.
+func (a *API) ValidateServerKeys() error {
+	privateKeyFilenames, _ := a.serverIdentity()
+	publicKeyFilenames := a.serverPublicKeys()
+	for i, privateKeyFilename := range privateKeyFilenames {
+		if i >= len(publicKeyFilenames) {
+			break
+		}
+		if err := ValidateKeyPair(privateKeyFilename, publicKeyFilenames[i], a.KeyPassphraseFilename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultKeyDir returns the directory in which the key pairs of key rotations are stored by default
+func (a *API) DefaultKeyDir() string {
+	return path.Join(a.DataDir, "keys")
+}
+
+// RotateKeys replaces the server key pair by a new one, written to the given files.
+//
+// The new public key is added to the authorized keys of every user with webhooks, and the progress is stored
+// in the database. From then on the server authenticates with the new key, and falls back to the previous one.
+// The previous public key is only removed by FinishKeyRotation, in a separate step.
+// An unfinished rotation is resumed instead of starting a new one.
+// The new private key is encrypted with the configured passphrase, if any.
+func (a *API) RotateKeys(keyType string, privateKeyFilename string, publicKeyFilename string) error {
+	rotation, ok, err := a.store().LatestKeyRotation()
+	if err != nil {
+		return err
+	}
+
+	// Start a new rotation
+	if !ok || rotation.Finished != "" {
+		privateKeyFilenames, previousPublicKeyFilename := a.serverIdentity()
+
+		err = os.MkdirAll(path.Dir(privateKeyFilename), 0700)
+		if err != nil {
+			return err
+		}
+		passphrase, err := readPassphrase(a.KeyPassphraseFilename)
+		if err != nil {
+			return err
+		}
+		err = generateKeyPair(keyType, privateKeyFilename, publicKeyFilename, passphrase)
+		if err != nil {
+			return err
+		}
+
+		rotation = KeyRotation{
+			PrivateKeyFilename:         privateKeyFilename,
+			PublicKeyFilename:          publicKeyFilename,
+			PreviousPrivateKeyFilename: privateKeyFilenames[0],
+			PreviousPublicKeyFilename:  previousPublicKeyFilename,
+			Started:                    time.Now().Format(time.RFC3339),
+		}
+		rotation.ID, err = a.store().AddKeyRotation(rotation)
+		if err != nil {
+			return err
+		}
+		log.WithField("rotation", rotation.ID).Info("Key rotation started")
+	} else {
+		log.WithField("rotation", rotation.ID).Info("Key rotation resumed")
+	}
+
+	// Add the new public key for every user that has not been migrated yet
+	users, err := a.store().UnmigratedUsers(rotation.ID)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, u := range users {
+		err = a.migrateUser(rotation, u)
+		if err != nil {
+			log.WithFields(log.Fields{"rotation": rotation.ID, "user": u.Username}).Errorf("Error migrating user: %s", err)
+			failed++
+			continue
+		}
+		log.WithFields(log.Fields{"rotation": rotation.ID, "user": u.Username}).Info("User migrated")
+	}
+	if failed > 0 {
+		return fmt.Errorf("key rotation %d: %d users not migrated, run the rotation again to retry", rotation.ID, failed)
+	}
+
+	log.WithField("rotation", rotation.ID).Info("Every user has been migrated, finish the key rotation once the server uses the new key")
+	return nil
+}
+
+// Add the new public key of a rotation to the authorized keys of a user, and record the migration of the user
+func (a *API) migrateUser(rotation KeyRotation, u webhookUser) error {
+	unlock, err := a.lockAuthorizedKeys(u.Groupname, u.Username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = addAuthorizedPublicKey(a.HomeDir, u.Groupname, u.Username, rotation.PublicKeyFilename, a.AuthorizedKeyFrom, a.AuthorizedKeyCommand)
+	if err != nil {
+		return err
+	}
+	return a.store().AddKeyMigration(rotation.ID, u.Groupname, u.Username, time.Now().Format(time.RFC3339))
+}
+
+// FinishKeyRotation removes the previous public key of the unfinished key rotation from the authorized keys of all users.
+// It is run separately from RotateKeys, after the server has switched to the new key, e.g. after it has been restarted,
+// so that the submissions that were still authenticating with the previous key are not cut off.
+// It refuses to finish while users have not been migrated to the new key.
+func (a *API) FinishKeyRotation() error {
+	rotation, ok, err := a.store().LatestKeyRotation()
+	if err != nil {
+		return err
+	}
+	if !ok || rotation.Finished != "" {
+		return errors.New("no key rotation in progress")
+	}
+
+	users, err := a.store().UnmigratedUsers(rotation.ID)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("key rotation %d: %d users not migrated, run the rotation again first", rotation.ID, len(users))
+	}
+
+	// Every user has the new key, so the previous public key can be removed
+	users, err = a.store().Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		unlock, err := a.lockAuthorizedKeys(u.Groupname, u.Username)
+		if err != nil {
+			return err
+		}
+		err = removeAuthorizedPublicKey(a.HomeDir, u.Groupname, u.Username, rotation.PreviousPublicKeyFilename)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("key rotation %d: removing the previous key of user %s: %s", rotation.ID, u.Username, err)
+		}
+	}
+
+	err = a.store().FinishKeyRotation(rotation.ID, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	log.WithField("rotation", rotation.ID).Info("Key rotation finished")
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"database/sql/driver"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRotateKeys(t *testing.T) {
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+
+	err := setupTestCase(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	groupname := "dccngroup"
+	username := "dccnuser"
+	newPrivateKeyFilename := path.Join(testConfig.dataDir, "keys", "hpc-webhook-new")
+	newPublicKeyFilename := path.Join(testConfig.dataDir, "keys", "hpc-webhook-new.pub")
+
+	// The user has authorized the current server key
+	err = addAuthorizedPublicKey(testConfig.homeDir, groupname, username, testConfig.publicKeyFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	api := API{
+		DB:                 db,
+		HomeDir:            testConfig.homeDir,
+		DataDir:            testConfig.dataDir,
+		PrivateKeyFilename: testConfig.privateKeyFilename,
+		PublicKeyFilename:  testConfig.publicKeyFilename,
+	}
+
+	// No rotation has taken place before
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+		WillReturnRows(sqlmock.NewRows(keyRotationColumnNames))
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+		WillReturnRows(sqlmock.NewRows(keyRotationColumnNames))
+	mock.ExpectQuery("^INSERT INTO hpc_webhook_key_rotation").
+		WithArgs(newPrivateKeyFilename, newPublicKeyFilename, testConfig.privateKeyFilename, testConfig.publicKeyFilename, AnyTimeString{}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	// Migrate the user to the new key
+	mock.ExpectQuery("^SELECT DISTINCT groupname, username FROM hpc_webhook WHERE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"groupname", "username"}).AddRow(groupname, username))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO hpc_webhook_key_migration").
+		WithArgs(1, groupname, username, AnyTimeString{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = api.RotateKeys(KeyTypeEd25519, newPrivateKeyFilename, newPublicKeyFilename); err != nil {
+		t.Errorf("error was not expected while rotating keys: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// Both keys are authorized until the rotation is finished
+	oldPublicKey, err := ioutil.ReadFile(testConfig.publicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPublicKey, err := ioutil.ReadFile(newPublicKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeys, err := ioutil.ReadFile(authorizedKeysFilename(testConfig.homeDir, groupname, username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(authorizedKeys)), "\n")
+	if len(lines) != 2 || !isServerAuthorizedKey(lines[0], oldPublicKey) || !isServerAuthorizedKey(lines[1], newPublicKey) {
+		t.Errorf("Expected the previous and the new server key to be authorized, but got:\n%s", authorizedKeys)
+	}
+
+	// Finish the rotation in a separate step, removing the previous key
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+		WillReturnRows(sqlmock.NewRows(keyRotationColumnNames).
+			AddRow(1, newPrivateKeyFilename, newPublicKeyFilename, testConfig.privateKeyFilename, testConfig.publicKeyFilename, "2019-03-11T10:10:00Z", nil))
+	mock.ExpectQuery("^SELECT DISTINCT groupname, username FROM hpc_webhook WHERE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"groupname", "username"}))
+	mock.ExpectQuery("^SELECT DISTINCT groupname, username FROM hpc_webhook ORDER BY").
+		WillReturnRows(sqlmock.NewRows([]string{"groupname", "username"}).AddRow(groupname, username))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE hpc_webhook_key_rotation SET finished").
+		WithArgs(AnyTimeString{}, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = api.FinishKeyRotation(); err != nil {
+		t.Errorf("error was not expected while finishing the key rotation: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// Only the new key is authorized
+	authorizedKeys, err = ioutil.ReadFile(authorizedKeysFilename(testConfig.homeDir, groupname, username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(string(authorizedKeys)), "\n")
+	if len(lines) != 1 || !isServerAuthorizedKey(lines[0], newPublicKey) || isServerAuthorizedKey(lines[0], oldPublicKey) {
+		t.Errorf("Expected only the new server key to be authorized, but got:\n%s", authorizedKeys)
+	}
+
+	// The rotated key pair is checked at startup, rather than the configured one
+	api.PrivateKeyFilename = path.Join(testConfig.keyDir, "missing")
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").
+			WillReturnRows(sqlmock.NewRows(keyRotationColumnNames).
+				AddRow(1, newPrivateKeyFilename, newPublicKeyFilename, testConfig.privateKeyFilename, testConfig.publicKeyFilename, "2019-03-11T10:10:00Z", "2019-03-11T10:20:00Z"))
+	}
+	if err = api.ValidateServerKeys(); err != nil {
+		t.Errorf("Expected the rotated key pair to be valid, but got: %s", err)
+	}
+}
+
+func TestServerIdentity(t *testing.T) {
+	cases := []struct {
+		rotation                    []driver.Value
+		expectedPrivateKeyFilenames []string
+		expectedPublicKeyFilename   string
+	}{
+		{
+			rotation:                    nil,
+			expectedPrivateKeyFilenames: []string{"current"},
+			expectedPublicKeyFilename:   "current.pub", // No rotation
+		},
+		{
+			rotation:                    []driver.Value{1, "new", "new.pub", "current", "current.pub", "2019-03-11T10:10:00Z", nil},
+			expectedPrivateKeyFilenames: []string{"new", "current"},
+			expectedPublicKeyFilename:   "new.pub", // Rotation in progress, try both keys
+		},
+		{
+			rotation:                    []driver.Value{1, "new", "new.pub", "current", "current.pub", "2019-03-11T10:10:00Z", "2019-03-11T10:20:00Z"},
+			expectedPrivateKeyFilenames: []string{"new"},
+			expectedPublicKeyFilename:   "new.pub", // Rotation finished
+		},
+	}
+
+	for _, c := range cases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		rows := sqlmock.NewRows(keyRotationColumnNames)
+		if c.rotation != nil {
+			rows.AddRow(c.rotation...)
+		}
+		mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook_key_rotation").WillReturnRows(rows)
+
+		api := API{
+			DB:                 db,
+			PrivateKeyFilename: "current",
+			PublicKeyFilename:  "current.pub",
+		}
+		privateKeyFilenames, publicKeyFilename := api.serverIdentity()
+		if strings.Join(privateKeyFilenames, ",") != strings.Join(c.expectedPrivateKeyFilenames, ",") {
+			t.Errorf("Expected private keys %v, but got %v", c.expectedPrivateKeyFilenames, privateKeyFilenames)
+		}
+		if publicKeyFilename != c.expectedPublicKeyFilename {
+			t.Errorf("Expected public key '%s', but got '%s'", c.expectedPublicKeyFilename, publicKeyFilename)
+		}
+	}
+}
@@ -2,20 +2,23 @@ package server
 
 import (
 	"database/sql"
+	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
 )
 
 // Setup of user's workspace directories and files
 const (
 	WebhooksWorkDir = ".webhook" // WebhooksWorkDir denotes the user's work directory
-	PayLoadName     = "payload"  // PayLoadName is the name of the payload file in user's work directory
+	PayLoadName     = "payload"  // PayLoadName is the prefix of the payload files of the deliveries in user's work directory
 	ScriptName      = "script"   // ScriptName is the name of the script in the user's work directory
 )
 
 // API is used to store the database pointer
 type API struct {
-	DB                        *sql.DB
+	DB                        *sql.DB // Database of the store, nil for the memory store
+	Store                     Store   // Store of the webhooks and their deliveries, the database when not set
 	Connector                 Connector
 	DataDir                   string
 	HomeDir                   string
@@ -28,8 +31,42 @@ type API struct {
 	HPCWebhookExternalPort    string // Port for the outside world
 	PrivateKeyFilename        string
 	PublicKeyFilename         string
+	KeyPassphraseFilename     string // Secret file with the passphrase of the encrypted private keys
+	AgentSocket               string // ssh-agent holding the server keys, used instead of the private key files
+	CAKeyFilename             string // CA key signing short-lived user certificates, instead of using authorized keys
+	CAPassphraseFilename      string // Secret file with the passphrase of the encrypted CA key
+	CASocket                  string // ssh-agent holding the CA key, used instead of the CA key file
+	CertValiditySeconds       int    // Lifetime of the user certificates
+	AuthorizedKeyFrom         string // Host pattern the server connects from, restricting the use of its key
+	AuthorizedKeyCommand      string // Forced command for the server key in the authorized keys of a user
+	TokenGracePeriodSeconds   int    // Period in which the previous public token remains valid after a rotation
+
+	AdminToken       string   // Static token authorizing requests to the admin API
+	AdminClientNames []string // Common names of the client certificates authorized to use the admin API
+
+	AuditLog      io.Writer  // Optional sink receiving every entry of the audit trail as a JSON line
+	auditLogMutex sync.Mutex // Serializes the writes to the audit log
+
+	RelayProbeSeconds int        // Period for which the result of the SSH probe of the relay node is reused
+	relayProbe        relayProbe // Result of the last SSH probe of the relay node
+
+	coalescer  coalescer       // Pending deliveries per webhook within their coalescing window
+	deliveries deliveryTracker // Deliveries accepted for processing in the background, awaited at shutdown
 }
 
+// DefaultTokenGracePeriodSeconds is the period in which the previous public token remains valid after a rotation,
+// unless configured otherwise
+const DefaultTokenGracePeriodSeconds = 24 * 60 * 60
+
+// MetricsPath is the URL path of the Prometheus metrics of the server [GET]
+const MetricsPath = "/metrics"
+
+// HealthzPath is the URL path to check that the server is alive [GET]
+const HealthzPath = "/healthz"
+
+// ReadyzPath is the URL path to check that the server and its dependencies are ready [GET]
+const ReadyzPath = "/readyz"
+
 // WebhookPath is the basic part of the webhook payload URL
 const WebhookPath = "/webhook"
 
@@ -51,6 +88,40 @@ const ConfigurationInfoPath = "/configuration/{webhook}"
 // ConfigurationDeletePath is the URL path to delete a certain webhook [DELETE]
 const ConfigurationDeletePath = "/configuration/{webhook}"
 
+// ConfigurationUpdatePath is the URL path to update a certain webhook, e.g. to enable or disable it [PATCH]
+const ConfigurationUpdatePath = "/configuration/{webhook}"
+
+// ConfigurationRotatePath is the URL path to issue a new public token for a certain webhook [POST]
+const ConfigurationRotatePath = "/configuration/{webhook}/rotate"
+
+// ConfigurationTestPath is the URL path to test a certain webhook up to the submission of its script, without submitting it [POST]
+const ConfigurationTestPath = "/configuration/{webhook}/test"
+
+// ConfigurationDoctorPath is the URL path to check the webhooks of a certain user against the home directory of the user,
+// and repair the problems if requested [POST]
+const ConfigurationDoctorPath = "/configuration/doctor"
+
+// AdminPath is the basic URL path for operating the HPC webhook server
+const AdminPath = "/admin"
+
+// AdminWebhooksPath is the URL path to list the webhooks of all users [GET]
+const AdminWebhooksPath = "/admin/webhooks"
+
+// AdminDisablePath is the URL path to force-disable a certain webhook [POST]
+const AdminDisablePath = "/admin/webhooks/{webhook}/disable"
+
+// AdminUsersPath is the URL path to get the queue depth and recent failures per user [GET]
+const AdminUsersPath = "/admin/users"
+
+// AdminPayloadsPath is the URL path to purge stale payload files [DELETE]
+const AdminPayloadsPath = "/admin/payloads"
+
+// AdminAuditPath is the URL path to query the audit trail by user and time range [GET]
+const AdminAuditPath = "/admin/audit"
+
+// AdminDeliveriesPath is the URL path to query the delivery history by webhook, status and trace [GET]
+const AdminDeliveriesPath = "/admin/deliveries"
+
 // RunsWithinContainer checks if the program runs in a Docker container or not
 func RunsWithinContainer() bool {
 	file, err := ioutil.ReadFile("/proc/1/cgroup")
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultShutdownTimeoutSeconds is the time the submissions in flight are given to finish when the server stops,
+// unless configured otherwise
+const DefaultShutdownTimeoutSeconds = 30
+
+// deliveryTracker keeps track of the deliveries accepted for processing in the background
+type deliveryTracker struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// accept registers a delivery for processing, unless the server is shutting down
+func (t *deliveryTracker) accept() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.inFlight.Add(1)
+	return true
+}
+
+// done marks the end of the processing of an accepted delivery
+func (t *deliveryTracker) done() {
+	t.inFlight.Done()
+}
+
+// isDraining reports whether the server is shutting down
+func (t *deliveryTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain refuses new deliveries from now on
+func (t *deliveryTracker) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// wait waits until the accepted deliveries have been processed, or the context is done
+func (t *deliveryTracker) wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		t.inFlight.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Leave a delivery in the pending queue, keeping its payload, to be submitted when the server starts again
+func (a *API) leavePending(conf executeConfiguration) {
+	deliveriesQueued.Dec()
+	deliveryLogger(conf).Info("Delivery left pending until the server starts again")
+}
+
+// Shutdown stops the processing of deliveries, to be called after the HTTP server stopped accepting requests.
+// Deliveries waiting for their coalescing window to close are left pending, and the submissions in flight
+// are given until the deadline of the context to finish. Those that do not finish in time remain pending as well.
+func (a *API) Shutdown(ctx context.Context) error {
+	a.deliveries.drain()
+	for _, conf := range a.coalescer.stop() {
+		a.leavePending(conf)
+		a.deliveries.done()
+	}
+
+	if err := a.deliveries.wait(ctx); err != nil {
+		return fmt.Errorf("submissions in flight did not finish: %s", err)
+	}
+	return nil
+}
+
+// ResumeDeliveries submits the deliveries that were left pending when the server stopped.
+// Deliveries of which the webhook has been removed or disabled meanwhile, or of which the payload is lost, are marked as failed.
+// Deliveries of which the job was being submitted are marked as interrupted rather than submitted again, since the job may exist.
+func (a *API) ResumeDeliveries() error {
+	deliveries, err := a.store().PendingDeliveries()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		logger := log.WithFields(log.Fields{
+			"delivery": d.Delivery,
+			"webhook":  d.Hash,
+		})
+
+		list, err := a.store().GetWebhookByHash(d.Hash)
+		if err != nil {
+			return err
+		}
+
+		if d.Status == DeliveryStatusSubmitting {
+			logger.Warn("Delivery not resumed: the server stopped while submitting its job")
+			if err := a.store().UpdateDelivery(d.Delivery, DeliveryStatusInterrupted, ""); err != nil {
+				logger.Error(err)
+			}
+			if len(list) > 0 {
+				os.Remove(a.newExecuteConfiguration(list[0], d.Delivery).payloadFilename)
+				a.auditDelivery(d.Hash, list[0].Username, fmt.Sprintf("delivery %s %s: the job may have been submitted", d.Delivery, DeliveryStatusInterrupted), AuditSourceResume, d.Trace, time.Now())
+			}
+			continue
+		}
+
+		var conf executeConfiguration
+		switch {
+		case len(list) == 0:
+			err = fmt.Errorf("webhook '%s' has been removed", d.Hash)
+		case !list[0].Enabled:
+			err = fmt.Errorf("webhook '%s' is disabled", d.Hash)
+		default:
+			conf = a.newExecuteConfiguration(list[0], d.Delivery)
+			conf.source = AuditSourceResume
+			conf.trace = d.Trace
+			_, err = os.Stat(conf.payloadFilename)
+		}
+		if err != nil {
+			logger.Errorf("Delivery not resumed: %s", err)
+			if err := a.store().UpdateDelivery(d.Delivery, DeliveryStatusFailed, ""); err != nil {
+				logger.Error(err)
+			}
+			if len(list) > 0 {
+				a.auditDelivery(d.Hash, list[0].Username, fmt.Sprintf("delivery %s %s: %s", d.Delivery, DeliveryStatusFailed, err), AuditSourceResume, d.Trace, time.Now())
+			}
+			continue
+		}
+
+		if !a.deliveries.accept() {
+			return nil
+		}
+		deliveriesQueued.Inc()
+		logger.Info("Delivery resumed")
+		go a.processWebhook(conf)
+	}
+	return nil
+}
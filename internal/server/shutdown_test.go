@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestShutdown(t *testing.T) {
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	dataDir := path.Join("..", "..", "test", "results", "data")
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dataDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	api := API{
+		DataDir: dataDir,
+	}
+	app := &api
+
+	// A delivery waiting for its coalescing window to close
+	payloadFilename := path.Join(dataDir, "delivery1")
+	err = ioutil.WriteFile(payloadFilename, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := executeConfiguration{
+		webhookID:       webhookID,
+		deliveryID:      "delivery1",
+		payloadFilename: payloadFilename,
+	}
+	if !app.deliveries.accept() {
+		t.Fatalf("Expected the delivery to be accepted")
+	}
+	deliveriesQueued.Inc()
+	app.coalescer.add(webhookID, time.Hour, conf, app.processWebhook, app.supersedeWebhook)
+
+	// A submission in flight
+	if !app.deliveries.accept() {
+		t.Fatalf("Expected the delivery to be accepted")
+	}
+
+	// The submission in flight does not finish before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := app.Shutdown(ctx); err == nil {
+		t.Errorf("Expected an error for the submission in flight")
+	}
+
+	// The coalesced delivery is left pending with its payload
+	if len(app.coalescer.pending) != 0 {
+		t.Errorf("Expected no coalesced deliveries, but got %d", len(app.coalescer.pending))
+	}
+	if _, err := os.Stat(payloadFilename); err != nil {
+		t.Errorf("Expected the payload of the pending delivery to be kept: %s", err)
+	}
+
+	// New deliveries are refused
+	if app.deliveries.accept() {
+		t.Errorf("Expected the delivery to be refused")
+	}
+	req, err := http.NewRequest("POST", "/webhook/"+webhookID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.WebhookHandler)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+
+	// Shutdown completes when the submission in flight finishes
+	app.deliveries.done()
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected no error, but got '%s'", err)
+	}
+}
+
+func TestResumeDeliveries(t *testing.T) {
+	removedHash := "550e8400-e29b-41d4-a716-446655440001"
+	hash := "550e8400-e29b-41d4-a716-446655440002"
+	groupname := "dccngroup"
+	username := "dccnuser"
+
+	keyDir := path.Join("..", "..", "test", "results", "keys")
+	testConfig := testConfiguration{
+		homeDir:            path.Join("..", "..", "test", "results", "home"),
+		dataDir:            path.Join("..", "..", "test", "results", "data"),
+		keyDir:             keyDir,
+		privateKeyFilename: path.Join(keyDir, "hpc-webhook"),
+		publicKeyFilename:  path.Join(keyDir, "hpc-webhook.pub"),
+	}
+	err := setupTestCase(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := teardownTestCase(testConfig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	api := API{
+		DB: db,
+		Connector: FakeConnector{
+			Description: "fake SSH connection to relay node",
+		},
+		DataDir:                testConfig.dataDir,
+		HomeDir:                testConfig.homeDir,
+		RelayNode:              "relaynode.dccn.nl",
+		HPCWebhookHost:         "hpc-webhook.dccn.nl",
+		HPCWebhookInternalPort: "5111",
+		HPCWebhookExternalPort: "443",
+		PrivateKeyFilename:     testConfig.privateKeyFilename,
+		PublicKeyFilename:      testConfig.publicKeyFilename,
+	}
+	app := &api
+
+	// The payload of the delivery that is left pending
+	payloadDir := path.Join(testConfig.dataDir, "payloads", username)
+	err = os.MkdirAll(payloadDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadFilename := path.Join(payloadDir, "delivery2")
+	err = ioutil.WriteFile(payloadFilename, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload of the delivery of which the job was being submitted
+	interruptedPayloadFilename := path.Join(payloadDir, "delivery3")
+	err = ioutil.WriteFile(interruptedPayloadFilename, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("^SELECT delivery, hash, status, trace FROM hpc_webhook_delivery").
+		WithArgs(DeliveryStatusPending, DeliveryStatusSubmitting).
+		WillReturnRows(sqlmock.NewRows([]string{"delivery", "hash", "status", "trace"}).
+			AddRow("delivery1", removedHash, DeliveryStatusPending, "").
+			AddRow("delivery3", hash, DeliveryStatusSubmitting, "").
+			AddRow("delivery2", hash, DeliveryStatusPending, "4bf92f3577b34da6a3ce929d0e0e4736"))
+
+	// The webhook of the first delivery has been removed meanwhile
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+		WithArgs(removedHash).
+		WillReturnRows(sqlmock.NewRows(itemColumnNames))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE hpc_webhook_delivery").
+		WithArgs(DeliveryStatusFailed, "", "delivery1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// The job of the third delivery may have been submitted, so it is not submitted again
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+		WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows(itemColumnNames).
+			AddRow(1, hash, groupname, username, "", "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", hash, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE hpc_webhook_delivery").
+		WithArgs(DeliveryStatusInterrupted, "", "delivery3").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectAudit(mock, hash, username, AuditActionDeliver)
+
+	// The second delivery is submitted again
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+		WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows(itemColumnNames).
+			AddRow(1, hash, groupname, username, "", "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", hash, nil))
+
+	if err := app.ResumeDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(payloadFilename); !os.IsNotExist(err) {
+		t.Errorf("Expected the payload of the resumed delivery to be processed")
+	}
+	if _, err := os.Stat(interruptedPayloadFilename); !os.IsNotExist(err) {
+		t.Errorf("Expected the payload of the interrupted delivery to be removed")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
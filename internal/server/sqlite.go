@@ -0,0 +1,82 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	// SQLite driver
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Obtain the path of the database file from an SQLite data source name: sqlite:<path> or sqlite://<path>
+func sqlitePath(dataSourceName string) string {
+	path := strings.TrimPrefix(dataSourceName, StoreSchemeSQLite+":")
+	return strings.TrimPrefix(path, "//")
+}
+
+// Obtain the dialect of a database, SQLite or otherwise PostgreSQL
+func databaseDialect(db *sql.DB) string {
+	if _, ok := db.Driver().(*sqlite3.SQLiteDriver); ok {
+		return StoreSchemeSQLite
+	}
+	return StoreSchemePostgres
+}
+
+// Open an SQLite database file, and migrate its schema to the latest version.
+// A single server uses the file, so there is no need to postpone the migration.
+func initSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, serialize the statements rather than failing on a locked database
+	db.SetMaxOpenConns(1)
+
+	if err := recordSQLiteSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := Migrate(db, LatestSchemaVersion()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Record the migrations of a database of which the schema was created as a whole, before the migrations applied
+// to SQLite. Its version was kept as the user version of the database.
+func recordSQLiteSchema(db *sql.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil || version != 0 {
+		return err
+	}
+	userVersion, err := sqliteSchemaVersion(db)
+	if err != nil || userVersion == 0 {
+		return err
+	}
+
+	migrations, err := loadMigrations(StoreSchemeSQLite)
+	if err != nil {
+		return err
+	}
+	if userVersion > len(migrations) {
+		return fmt.Errorf("SQLite database schema version %d is newer than the latest version %d of the server", userVersion, len(migrations))
+	}
+	applied := time.Now().Format(time.RFC3339)
+	for _, m := range migrations[:userVersion] {
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, description, applied) VALUES ($1, $2, $3)",
+			m.version, m.description, applied); err != nil {
+			return databaseError("recordSQLiteSchema", err)
+		}
+	}
+	return nil
+}
+
+// Obtain the version of the schema of an SQLite database created as a whole, 0 when it has none
+func sqliteSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, databaseError("sqliteSchemaVersion", err)
+}
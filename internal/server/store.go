@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Store keeps the registered webhooks, the history of their deliveries, the audit trail, and the key rotations.
+// Lookups return a list of at most one item, which is empty when the webhook does not exist.
+// The listing returns a page of webhooks, and the cursor of the next page.
+type Store interface {
+	AddWebhook(item Item) error
+	GetWebhook(hash string, groupname string, username string) ([]Item, error)
+	GetWebhookByHash(hash string) ([]Item, error)
+	GetWebhookByToken(token string, now string) ([]Item, error)
+	ListWebhooks(groupname string, username string, options ListOptions) ([]Item, string, error)
+	ExpiredWebhooks(now string) ([]Item, error)
+	CountWebhooks(groupname string, username string) (int, error)
+	DeleteWebhook(hash string, groupname string, username string) error
+	UpdateWebhook(update ConfigurationUpdateRequest) error
+	SetWebhookEnabled(hash string, groupname string, username string, enabled bool) error
+	RotateToken(hash string, groupname string, username string, token string, expires string) error
+	DeleteExpiredTokens(now string) error
+
+	AddDelivery(delivery string, hash string, received string, status string, trace string, provider string) error
+	UpdateDelivery(delivery string, status string, job string) error
+	LastJob(hash string) (string, error)
+	PendingDeliveries() ([]pendingDelivery, error)
+	Deliveries(filter DeliveryFilter) ([]DeliveryRecord, error)
+
+	AddAudit(record AuditRecord) error
+	AuditRecords(filter AuditFilter) ([]AuditRecord, error)
+
+	FilterWebhooks(filter WebhookFilter) ([]Item, error)
+	UserStats(since string) ([]UserStats, error)
+
+	AddKeyRotation(rotation KeyRotation) (int, error)
+	LatestKeyRotation() (KeyRotation, bool, error)
+	FinishKeyRotation(id int, finished string) error
+	AddKeyMigration(rotation int, groupname string, username string, migrated string) error
+	Users() ([]webhookUser, error)
+	UnmigratedUsers(rotation int) ([]webhookUser, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Data source name schemes selecting the backend of the store
+const (
+	StoreSchemePostgres = "postgres" // StoreSchemePostgres denotes a PostgreSQL database, also used for data source names without a scheme
+	StoreSchemeSQLite   = "sqlite"   // StoreSchemeSQLite denotes an SQLite database file, for small single-node deployments
+	StoreSchemeMemory   = "memory"   // StoreSchemeMemory denotes a store that is lost when the server stops, for testing only
+)
+
+// StoreScheme returns the scheme of a data source name, which selects the backend of the store.
+// Key-value connection strings without a scheme are PostgreSQL data source names.
+func StoreScheme(dataSourceName string) string {
+	i := strings.Index(dataSourceName, ":")
+	if i <= 0 || strings.ContainsAny(dataSourceName[:i], "= ") {
+		return StoreSchemePostgres
+	}
+	if scheme := dataSourceName[:i]; scheme != "postgresql" {
+		return scheme
+	}
+	return StoreSchemePostgres
+}
+
+// OpenStore opens the store given by the scheme of a data source name: postgres://, sqlite:<path> or memory:.
+// A data source name without a scheme is passed to PostgreSQL as is. The database of the store is returned as well,
+// for the schema migrations; it is nil for the memory store.
+func OpenStore(dataSourceName string, hpcWebhookHost string, hpcWebhookExternalPort string) (Store, *sql.DB, error) {
+	switch scheme := StoreScheme(dataSourceName); scheme {
+	case StoreSchemePostgres:
+		db, err := InitDB(dataSourceName)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewSQLStore(db, hpcWebhookHost, hpcWebhookExternalPort), db, nil
+	case StoreSchemeSQLite:
+		db, err := initSQLite(sqlitePath(dataSourceName))
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewSQLStore(db, hpcWebhookHost, hpcWebhookExternalPort), db, nil
+	case StoreSchemeMemory:
+		return NewMemoryStore(hpcWebhookHost, hpcWebhookExternalPort), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported data source name scheme '%s': expected %s, %s or %s", scheme, StoreSchemePostgres, StoreSchemeSQLite, StoreSchemeMemory)
+	}
+}
+
+// Obtain the store of the webhooks, which defaults to the database of the server
+func (a *API) store() Store {
+	if a.Store != nil {
+		return a.Store
+	}
+	return NewSQLStore(a.DB, a.HPCWebhookHost, a.HPCWebhookExternalPort)
+}
+
+// sqlStore keeps the webhooks in a PostgreSQL or SQLite database
+type sqlStore struct {
+	db                     *sql.DB
+	hpcWebhookHost         string
+	hpcWebhookExternalPort string
+}
+
+// NewSQLStore returns a store keeping the webhooks in a database with the schema of the server
+func NewSQLStore(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string) Store {
+	return sqlStore{
+		db:                     db,
+		hpcWebhookHost:         hpcWebhookHost,
+		hpcWebhookExternalPort: hpcWebhookExternalPort,
+	}
+}
+
+func (s sqlStore) AddWebhook(item Item) error {
+	return addRow(s.db, item)
+}
+
+func (s sqlStore) GetWebhook(hash string, groupname string, username string) ([]Item, error) {
+	return getRow(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, hash, groupname, username)
+}
+
+func (s sqlStore) GetWebhookByHash(hash string) ([]Item, error) {
+	return getRowHashOnly(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, hash)
+}
+
+func (s sqlStore) GetWebhookByToken(token string, now string) ([]Item, error) {
+	return getRowToken(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, token, now)
+}
+
+func (s sqlStore) ListWebhooks(groupname string, username string, options ListOptions) ([]Item, string, error) {
+	return getListRows(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, groupname, username, options)
+}
+
+func (s sqlStore) ExpiredWebhooks(now string) ([]Item, error) {
+	return getExpiredRows(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, now)
+}
+
+func (s sqlStore) CountWebhooks(groupname string, username string) (int, error) {
+	return countUserRows(s.db, groupname, username)
+}
+
+func (s sqlStore) DeleteWebhook(hash string, groupname string, username string) error {
+	return deleteRow(s.db, hash, groupname, username)
+}
+
+func (s sqlStore) UpdateWebhook(update ConfigurationUpdateRequest) error {
+	return updateRow(s.db, update)
+}
+
+func (s sqlStore) SetWebhookEnabled(hash string, groupname string, username string, enabled bool) error {
+	return updateRowEnabled(s.db, hash, groupname, username, enabled)
+}
+
+func (s sqlStore) RotateToken(hash string, groupname string, username string, token string, expires string) error {
+	return rotateToken(s.db, hash, groupname, username, token, expires)
+}
+
+func (s sqlStore) DeleteExpiredTokens(now string) error {
+	return deleteExpiredTokens(s.db, now)
+}
+
+func (s sqlStore) AddDelivery(delivery string, hash string, received string, status string, trace string, provider string) error {
+	return addDeliveryRow(s.db, delivery, hash, received, status, trace, provider)
+}
+
+func (s sqlStore) UpdateDelivery(delivery string, status string, job string) error {
+	return updateDeliveryStatus(s.db, delivery, status, job)
+}
+
+func (s sqlStore) LastJob(hash string) (string, error) {
+	return getLastJob(s.db, hash)
+}
+
+func (s sqlStore) PendingDeliveries() ([]pendingDelivery, error) {
+	return getPendingDeliveries(s.db)
+}
+
+func (s sqlStore) Deliveries(filter DeliveryFilter) ([]DeliveryRecord, error) {
+	return getDeliveryRows(s.db, filter)
+}
+
+func (s sqlStore) AddAudit(record AuditRecord) error {
+	return addAuditRow(s.db, record.Hash, record.Username, record.Action, record.Detail, record.Source, record.Trace, record.Created)
+}
+
+func (s sqlStore) AuditRecords(filter AuditFilter) ([]AuditRecord, error) {
+	return getAuditRows(s.db, filter)
+}
+
+func (s sqlStore) FilterWebhooks(filter WebhookFilter) ([]Item, error) {
+	return getFilteredRows(s.db, s.hpcWebhookHost, s.hpcWebhookExternalPort, filter)
+}
+
+func (s sqlStore) UserStats(since string) ([]UserStats, error) {
+	return getUserStats(s.db, since)
+}
+
+func (s sqlStore) AddKeyRotation(rotation KeyRotation) (int, error) {
+	return addKeyRotation(s.db, rotation)
+}
+
+func (s sqlStore) LatestKeyRotation() (KeyRotation, bool, error) {
+	return getLatestKeyRotation(s.db)
+}
+
+func (s sqlStore) FinishKeyRotation(id int, finished string) error {
+	return finishKeyRotation(s.db, id, finished)
+}
+
+func (s sqlStore) AddKeyMigration(rotation int, groupname string, username string, migrated string) error {
+	return addKeyMigration(s.db, rotation, groupname, username, migrated)
+}
+
+func (s sqlStore) Users() ([]webhookUser, error) {
+	return getUsers(s.db)
+}
+
+func (s sqlStore) UnmigratedUsers(rotation int) ([]webhookUser, error) {
+	return getUnmigratedUsers(s.db, rotation)
+}
+
+func (s sqlStore) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return fmt.Errorf("database is not configured")
+	}
+	return s.db.PingContext(ctx)
+}
+
+func (s sqlStore) Close() error {
+	return s.db.Close()
+}
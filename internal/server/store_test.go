@@ -0,0 +1,440 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Exercise a store: add, get, list, update, disable and delete a webhook, and record its deliveries
+func testStore(t *testing.T, store Store) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	token := "550e8400-e29b-41d4-a716-446655440002"
+	groupname := "dccngroup"
+	username := "dccnuser"
+
+	item := Item{
+		Hash:        hash,
+		Groupname:   groupname,
+		Username:    username,
+		Description: "webhook",
+		Created:     "2019-03-11T19:44:44+01:00",
+		Concurrency: ConcurrencyAllow,
+		Token:       token,
+		Expires:     "2019-04-11T19:44:44+01:00",
+	}
+	if err := store.AddWebhook(item); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddWebhook(item); err == nil {
+		t.Errorf("Expected an error adding the webhook twice")
+	}
+
+	list, err := store.GetWebhook(hash, groupname, username)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Expected the webhook, but got %v and error '%v'", list, err)
+	}
+	if !list[0].Enabled || list[0].Description != "webhook" || list[0].URL != "https://hpc-webhook.dccn.nl:443/webhook/"+token {
+		t.Errorf("Expected an enabled webhook with its payload URL, but got %+v", list[0])
+	}
+	if list, _ := store.GetWebhook(hash, groupname, "otheruser"); len(list) != 0 {
+		t.Errorf("Expected no webhook of another user, but got %v", list)
+	}
+	if list, _ := store.GetWebhookByHash(hash); len(list) != 1 {
+		t.Errorf("Expected the webhook by its hash, but got %v", list)
+	}
+	if list, _ := store.GetWebhookByToken(token, "2019-03-12T00:00:00+01:00"); len(list) != 1 || list[0].Hash != hash {
+		t.Errorf("Expected the webhook by its token, but got %v", list)
+	}
+	if list, _, _ := store.ListWebhooks(groupname, username, ListOptions{}); len(list) != 1 {
+		t.Errorf("Expected the webhooks of the user, but got %v", list)
+	}
+	if count, _ := store.CountWebhooks(groupname, username); count != 1 {
+		t.Errorf("Expected 1 webhook of the user, but got %d", count)
+	}
+	if list, _ := store.ExpiredWebhooks("2019-04-01T00:00:00+01:00"); len(list) != 0 {
+		t.Errorf("Expected no expired webhooks, but got %v", list)
+	}
+	if list, _ := store.ExpiredWebhooks("2019-05-01T00:00:00+01:00"); len(list) != 1 {
+		t.Errorf("Expected the expired webhook, but got %v", list)
+	}
+
+	item.Description = "updated webhook"
+	item.QsubOptions = "-l walltime=00:10:00"
+	if err := store.UpdateWebhook(ConfigurationUpdateRequest{Hash: hash, Groupname: groupname, Username: username, Description: &item.Description, QsubOptions: &item.QsubOptions}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetWebhookEnabled(hash, groupname, username, false); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = store.GetWebhook(hash, groupname, username)
+	if len(list) != 1 || list[0].Enabled || list[0].Description != "updated webhook" || list[0].QsubOptions != item.QsubOptions {
+		t.Errorf("Expected the updated and disabled webhook, but got %v", list)
+	}
+	if err := store.SetWebhookEnabled(hash, groupname, "otheruser", true); err == nil {
+		t.Errorf("Expected an error enabling the webhook of another user")
+	}
+
+	// Deliveries
+	if err := store.AddDelivery("delivery1", hash, "2019-03-12T00:00:00+01:00", DeliveryStatusPending, "", "github"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddDelivery("delivery2", hash, "2019-03-12T00:01:00+01:00", DeliveryStatusPending, "", "github"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateDelivery("delivery1", DeliveryStatusSubmitted, "12345.dccn-l029.dccn.nl"); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := store.LastJob(hash); job != "12345.dccn-l029.dccn.nl" {
+		t.Errorf("Expected the job of the submitted delivery, but got '%s'", job)
+	}
+	deliveries, err := store.PendingDeliveries()
+	if err != nil || len(deliveries) != 1 || deliveries[0].Delivery != "delivery2" || deliveries[0].Hash != hash {
+		t.Errorf("Expected the pending delivery, but got %v and error '%v'", deliveries, err)
+	}
+
+	if err := store.DeleteWebhook(hash, groupname, username); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := store.GetWebhookByHash(hash); len(list) != 0 {
+		t.Errorf("Expected the webhook to be deleted, but got %v", list)
+	}
+}
+
+// Exercise the listing of a store: filter, order and page the webhooks of a user
+func testStoreListing(t *testing.T, store Store) {
+	groupname := "dccngroup"
+	username := "dccnuser"
+	hashes := []string{
+		"550e8400-e29b-41d4-a716-446655440011",
+		"550e8400-e29b-41d4-a716-446655440012",
+		"550e8400-e29b-41d4-a716-446655440013",
+		"550e8400-e29b-41d4-a716-446655440014",
+	}
+	descriptions := []string{"Build docs", "Analysis", "build_pipeline", "Other"}
+	for i, hash := range hashes {
+		err := store.AddWebhook(Item{
+			Hash:        hash,
+			Groupname:   groupname,
+			Username:    username,
+			Description: descriptions[i],
+			Created:     fmt.Sprintf("2019-03-11T19:44:4%d+01:00", i),
+			Concurrency: ConcurrencyAllow,
+			Token:       hash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetWebhookEnabled(hashes[3], groupname, username, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second webhook was triggered last, the fourth one never
+	deliveries := []struct {
+		hash     string
+		received string
+		provider string
+	}{
+		{hashes[0], "2019-03-12T10:00:00+01:00", "github"},
+		{hashes[1], "2019-03-12T12:00:00+01:00", "gitlab"},
+		{hashes[2], "2019-03-12T11:00:00+01:00", "github"},
+		{hashes[0], "2019-03-12T09:00:00+01:00", "github"},
+	}
+	for i, d := range deliveries {
+		if err := store.AddDelivery(fmt.Sprintf("listing%d", i), d.hash, d.received, DeliveryStatusSubmitted, "", d.provider); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enabled := true
+	cases := []struct {
+		options        ListOptions
+		expectedHashes []string
+	}{
+		{ListOptions{}, hashes},
+		{ListOptions{Sort: ListSortLastTriggered}, []string{hashes[1], hashes[2], hashes[0], hashes[3]}},
+		{ListOptions{Description: "BUILD"}, []string{hashes[0], hashes[2]}},
+		{ListOptions{Description: "_"}, []string{hashes[2]}},
+		{ListOptions{Enabled: &enabled}, hashes[:3]},
+		{ListOptions{Provider: "github"}, []string{hashes[0], hashes[2]}},
+	}
+
+	// Walk through every listing in pages of one and three webhooks
+	for i, c := range cases {
+		for _, limit := range []int{1, 3} {
+			options := c.options
+			options.Limit = limit
+			var listed []string
+			for page := 0; page <= len(hashes); page++ {
+				list, nextCursor, err := store.ListWebhooks(groupname, username, options)
+				if err != nil {
+					t.Fatalf("Test case %d: %s", i, err)
+				}
+				if len(list) > limit {
+					t.Errorf("Test case %d: expected at most %d webhooks, but got %d", i, limit, len(list))
+				}
+				for _, item := range list {
+					listed = append(listed, item.Hash)
+				}
+				if nextCursor == "" {
+					break
+				}
+				options.Cursor = nextCursor
+			}
+			if !reflect.DeepEqual(listed, c.expectedHashes) {
+				t.Errorf("Test case %d: expected %v in pages of %d, but got %v", i, c.expectedHashes, limit, listed)
+			}
+		}
+	}
+
+	// The time of the last delivery is listed
+	list, _, err := store.ListWebhooks(groupname, username, ListOptions{Limit: 1})
+	if err != nil || len(list) != 1 || list[0].LastTriggered == "" || !strings.HasPrefix(list[0].LastTriggered, "2019-03-12") {
+		t.Errorf("Expected the time of the last delivery, but got %v and error '%v'", list, err)
+	}
+
+	// A cursor is valid for the order it was issued for only
+	_, nextCursor, _ := store.ListWebhooks(groupname, username, ListOptions{Limit: 1})
+	if _, _, err := store.ListWebhooks(groupname, username, ListOptions{Sort: ListSortLastTriggered, Cursor: nextCursor}); err == nil {
+		t.Errorf("Expected an error for the cursor of another order")
+	}
+}
+
+// Exercise the records a store keeps besides the webhooks: previous tokens, the audit trail,
+// the statistics of the admin API, and the key rotations
+func testStoreRecords(t *testing.T, store Store) {
+	hash := "7d0e8400-e29b-41d4-a716-446655440011"
+	token := "7d0e8400-e29b-41d4-a716-446655440012"
+	groupname := "dccngroup"
+	username := "dccnuser"
+
+	for _, item := range []Item{
+		{Hash: hash, Groupname: groupname, Username: username, Created: "2019-03-11T19:44:44+01:00", Concurrency: ConcurrencyAllow, Token: hash},
+		{Hash: "7d0e8400-e29b-41d4-a716-446655440013", Groupname: "othergroup", Username: "otheruser", Created: "2019-03-11T19:44:44+01:00", Concurrency: ConcurrencyAllow, Token: "7d0e8400-e29b-41d4-a716-446655440013"},
+	} {
+		if err := store.AddWebhook(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The previous token is accepted until it expires
+	if err := store.RotateToken(hash, groupname, "otheruser", token, "2019-03-12T00:00:00+01:00"); err == nil {
+		t.Errorf("Expected an error rotating the token of another user")
+	}
+	if err := store.RotateToken(hash, groupname, username, token, "2019-03-12T00:00:00+01:00"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := store.GetWebhookByToken(hash, "2019-03-11T23:00:00+01:00"); len(list) != 1 || list[0].Token != token {
+		t.Errorf("Expected the webhook by its previous token, but got %v", list)
+	}
+	if err := store.DeleteExpiredTokens("2019-03-12T00:00:00+01:00"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := store.GetWebhookByToken(hash, "2019-03-11T23:00:00+01:00"); len(list) != 0 {
+		t.Errorf("Expected the expired token to be removed, but got %v", list)
+	}
+
+	// Audit trail
+	for _, created := range []string{"2019-03-11T19:44:44+01:00", "2019-03-12T19:44:44+01:00"} {
+		if err := store.AddAudit(AuditRecord{Hash: hash, Username: username, Action: AuditActionAdd, Created: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := store.AuditRecords(AuditFilter{Username: username, From: "2019-03-12T00:00:00+01:00"})
+	if err != nil || len(records) != 1 || records[0].Created != "2019-03-12T19:44:44+01:00" {
+		t.Errorf("Expected the audit record of the second day, but got %v and error '%v'", records, err)
+	}
+	trace := "4bf92f3577b34da6a3ce929d0e0e4736"
+	if err := store.AddAudit(AuditRecord{Hash: hash, Username: username, Action: AuditActionDeliver, Trace: trace, Created: "2019-03-12T19:45:00+01:00"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err = store.AuditRecords(AuditFilter{Trace: trace})
+	if err != nil || len(records) != 1 || records[0].Action != AuditActionDeliver || records[0].Trace != trace {
+		t.Errorf("Expected the audit record of the trace, but got %v and error '%v'", records, err)
+	}
+
+	// Admin queries
+	enabled := true
+	if list, _ := store.FilterWebhooks(WebhookFilter{Username: username, Enabled: &enabled}); len(list) != 1 || list[0].Hash != hash {
+		t.Errorf("Expected the webhook of the user, but got %v", list)
+	}
+	if err := store.AddDelivery("delivery3", hash, "2019-03-12T00:00:00+01:00", DeliveryStatusFailed, trace, "github"); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := store.Deliveries(DeliveryFilter{Hash: hash, Trace: trace})
+	if err != nil || len(deliveries) != 1 || deliveries[0].Delivery != "delivery3" || deliveries[0].Status != DeliveryStatusFailed || deliveries[0].Provider != "github" {
+		t.Errorf("Expected the delivery of the trace, but got %v and error '%v'", deliveries, err)
+	}
+	if deliveries, _ := store.Deliveries(DeliveryFilter{Status: DeliveryStatusSubmitted}); len(deliveries) != 0 {
+		t.Errorf("Expected no submitted deliveries, but got %v", deliveries)
+	}
+	stats, err := store.UserStats("2019-03-11T00:00:00+01:00")
+	expectedStats := []UserStats{
+		{Groupname: groupname, Username: username, Webhooks: 1, Failures: 1, LastFailure: "2019-03-12T00:00:00+01:00"},
+		{Groupname: "othergroup", Username: "otheruser", Webhooks: 1},
+	}
+	if err != nil || !reflect.DeepEqual(stats, expectedStats) {
+		t.Errorf("Expected statistics %v, but got %v and error '%v'", expectedStats, stats, err)
+	}
+
+	// Key rotation
+	if _, ok, err := store.LatestKeyRotation(); ok || err != nil {
+		t.Errorf("Expected no key rotation, but got error '%v'", err)
+	}
+	id, err := store.AddKeyRotation(KeyRotation{PrivateKeyFilename: "new", PublicKeyFilename: "new.pub", PreviousPrivateKeyFilename: "current", PreviousPublicKeyFilename: "current.pub", Started: "2019-03-11T10:10:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddKeyMigration(id, groupname, username, "2019-03-11T10:11:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.UnmigratedUsers(id)
+	if err != nil || !reflect.DeepEqual(users, []webhookUser{{Groupname: "othergroup", Username: "otheruser"}}) {
+		t.Errorf("Expected the user that has not been migrated, but got %v and error '%v'", users, err)
+	}
+	if users, _ := store.Users(); len(users) != 2 {
+		t.Errorf("Expected all users with webhooks, but got %v", users)
+	}
+	if err := store.FinishKeyRotation(id, "2019-03-11T10:20:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	rotation, ok, err := store.LatestKeyRotation()
+	if err != nil || !ok || rotation.ID != id || rotation.Finished != "2019-03-11T10:20:00Z" || rotation.PublicKeyFilename != "new.pub" {
+		t.Errorf("Expected the finished key rotation, but got %+v and error '%v'", rotation, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore("hpc-webhook.dccn.nl", "443"))
+	testStoreListing(t, NewMemoryStore("hpc-webhook.dccn.nl", "443"))
+	testStoreRecords(t, NewMemoryStore("hpc-webhook.dccn.nl", "443"))
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir := path.Join("..", "..", "test", "results", "sqlite")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	store, db, err := OpenStore("sqlite:"+path.Join(dir, "hpc-webhook.db"), "hpc-webhook.dccn.nl", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if db == nil {
+		t.Fatalf("Expected the database of the store")
+	}
+
+	testStore(t, store)
+	testStoreListing(t, store)
+
+	// The audit trail is append-only
+	if err := addAuditRow(db, "550e8400-e29b-41d4-a716-446655440001", "dccnuser", AuditActionAdd, "", "", "", "2019-03-11T19:44:44+01:00"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM hpc_webhook_audit"); err == nil {
+		t.Errorf("Expected an error deleting the audit trail")
+	}
+
+	// The other records start from an empty database
+	records, _, err := OpenStore("sqlite:"+path.Join(dir, "hpc-webhook-records.db"), "hpc-webhook.dccn.nl", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.Close()
+	testStoreRecords(t, records)
+
+	// The SQLite schema is migrated to the latest version, and can be migrated down and up again
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("Expected the SQLite schema to have version %d of the latest migration, but got %d", LatestSchemaVersion(), version)
+	}
+	if err := Migrate(db, 0); err != nil {
+		t.Errorf("Expected to revert all SQLite migrations, but got '%s'", err)
+	}
+	if err := Migrate(db, LatestSchemaVersion()); err != nil {
+		t.Errorf("Expected to apply all SQLite migrations, but got '%s'", err)
+	}
+}
+
+func TestSQLiteSchemaVersion(t *testing.T) {
+	dir := path.Join("..", "..", "test", "results", "sqlite-version")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// A database of which the schema was created as a whole has its version as user version
+	filename := path.Join(dir, "hpc-webhook.db")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Migrate(db, LatestSchemaVersion()-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE schema_migrations; PRAGMA user_version = %d", LatestSchemaVersion()-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its migrations are recorded, and the missing ones applied
+	store, migrated, err := OpenStore("sqlite:"+filename, "hpc-webhook.dccn.nl", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := SchemaVersion(migrated)
+	if err != nil || version != LatestSchemaVersion() {
+		t.Errorf("Expected the SQLite schema to be migrated to version %d, but got %d (%v)", LatestSchemaVersion(), version, err)
+	}
+	store.Close()
+
+	// A database with a newer schema is refused
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE schema_migrations; PRAGMA user_version = %d", LatestSchemaVersion()+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenStore("sqlite:"+filename, "hpc-webhook.dccn.nl", "443"); err == nil {
+		t.Errorf("Expected an error opening a database with schema version %d", LatestSchemaVersion()+1)
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	cases := []struct {
+		dataSourceName string
+		expectedResult bool
+	}{
+		{"memory:", true},
+		{"host=localhost port=5432 user=postgres password=pass:word dbname=hpc_webhook_db sslmode=disable", true},
+		{"postgres://postgres@localhost/hpc_webhook_db?sslmode=disable", true},
+		{"mysql://root@localhost/hpc_webhook_db", false},
+	}
+
+	for i, c := range cases {
+		store, _, err := OpenStore(c.dataSourceName, "hpc-webhook.dccn.nl", "443")
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Test case %d: expected result %v, but got error '%v'", i, c.expectedResult, err)
+		}
+		if store != nil {
+			store.Close()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingServiceName is the name of the server in the exported traces
+const TracingServiceName = "hpc-webhook-server"
+
+// TraceIDHeader is the response header returning the id of the trace of a delivery to its sender.
+// The delivery and its audit entries are recorded with the same id.
+const TraceIDHeader = "X-Trace-ID"
+
+// tracerName identifies the spans created by the server
+const tracerName = "github.com/Donders-Institute/hpc-webhook/internal/server"
+
+// SetupTracing exports the traces of the server to the given exporter, e.g. an OTLP collector.
+// The returned provider has to be shut down to flush the pending spans.
+func SetupTracing(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", TracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider
+}
+
+// startSpan starts a span of the server as child of the span in the context
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// storeAttributes returns the attributes of the spans of store operations: the database system of the store, if any
+func storeAttributes(store Store) []attribute.KeyValue {
+	s, ok := store.(sqlStore)
+	if !ok || s.db == nil {
+		return nil
+	}
+	switch s.db.Driver().(type) {
+	case *pq.Driver:
+		return []attribute.KeyValue{attribute.String("db.system", "postgresql")}
+	case *sqlite3.SQLiteDriver:
+		return []attribute.KeyValue{attribute.String("db.system", "sqlite")}
+	}
+	return nil
+}
+
+// startRequestSpan starts the span of a request, continuing the trace of the sender when it propagates one
+func startRequestSpan(req *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// endSpan records the error of the operation, if any, and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceID returns the id of the trace in the context, or an empty string when it is not traced
+func traceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
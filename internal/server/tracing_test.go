@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := SetupTracing(exporter)
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		provider.Shutdown(context.Background())
+	}()
+
+	if id := traceID(context.Background()); id != "" {
+		t.Errorf("Expected no trace id without a span, but got '%s'", id)
+	}
+
+	// Submit a job as part of the processing of a delivery
+	ctx, span := startSpan(context.Background(), "webhook.process")
+	conf := executeConfiguration{
+		webhookID:  "550e8400-e29b-41d4-a716-446655440001",
+		deliveryID: "7d1c6f2e-5a0b-4c3d-9e8f-0a1b2c3d4e5f",
+	}
+	fc := FakeConnector{
+		Description: "fake SSH connection",
+	}
+	_, err := triggerQsubCommand(ctx, fc, nil, conf)
+	if err != nil {
+		t.Fatalf("Expected no error, but got '%s'", err)
+	}
+	span.End()
+
+	id := traceID(ctx)
+	if len(id) != 32 {
+		t.Fatalf("Expected a trace id of 32 characters, but got '%s'", id)
+	}
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The spans of the submission belong to the trace of the delivery
+	spans := exporter.GetSpans()
+	spanIDs := make(map[string]string)
+	parentIDs := make(map[string]string)
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != id {
+			t.Errorf("Expected span %s in trace %s, but got %s", s.Name, id, s.SpanContext.TraceID())
+		}
+		spanIDs[s.Name] = s.SpanContext.SpanID().String()
+		parentIDs[s.Name] = s.Parent.SpanID().String()
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, but got %d", len(spans))
+	}
+	if parentIDs["qsub"] != spanIDs["webhook.process"] {
+		t.Errorf("Expected the qsub span to be a child of the processing span")
+	}
+	if parentIDs["ssh.session"] != spanIDs["qsub"] {
+		t.Errorf("Expected the SSH session span to be a child of the qsub span")
+	}
+}
+
+func TestTraceIDHeader(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := SetupTracing(exporter)
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		provider.Shutdown(context.Background())
+	}()
+
+	// A delivery for a disabled webhook is refused, and recorded in the audit trail with its trace
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	store := NewMemoryStore("hpc-webhook.dccn.nl", "443")
+	item := Item{Hash: hash, Groupname: "dccngroup", Username: "dccnuser", Created: "2019-03-11T19:44:44+01:00", Concurrency: ConcurrencyAllow, Token: hash}
+	if err := store.AddWebhook(item); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetWebhookEnabled(hash, item.Groupname, item.Username, false); err != nil {
+		t.Fatal(err)
+	}
+	app := &API{Store: store}
+
+	// The trace of the sender is continued
+	senderTrace := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest("POST", WebhookPath+"/"+hash, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+senderTrace+"-00f067aa0ba902b7-01")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.WebhookHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusLocked {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusLocked, rr.Body.String())
+	}
+	if trace := rr.Header().Get(TraceIDHeader); trace != senderTrace {
+		t.Errorf("Expected the trace of the sender in the response, but got '%s'", trace)
+	}
+	records, err := store.AuditRecords(AuditFilter{Trace: senderTrace})
+	if err != nil || len(records) != 1 || records[0].Action != AuditActionDeliver {
+		t.Errorf("Expected the refused delivery in the audit trail with its trace, but got %v and error '%v'", records, err)
+	}
+}
+
+func TestStoreAttributes(t *testing.T) {
+	dir := path.Join("..", "..", "test", "results", "tracing")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sqlite, _, err := OpenStore("sqlite:"+path.Join(dir, "hpc-webhook.db"), "hpc-webhook.dccn.nl", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	// Opening a PostgreSQL database does not connect to it yet
+	postgres, err := sql.Open("postgres", "host=localhost dbname=hpc_webhook_db sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer postgres.Close()
+
+	cases := []struct {
+		store          Store
+		expectedSystem string
+	}{
+		{NewSQLStore(postgres, "hpc-webhook.dccn.nl", "443"), "postgresql"},
+		{sqlite, "sqlite"},
+		{NewMemoryStore("hpc-webhook.dccn.nl", "443"), ""}, // No database
+	}
+
+	for i, c := range cases {
+		var system string
+		for _, a := range storeAttributes(c.store) {
+			if a.Key == "db.system" {
+				system = a.Value.AsString()
+			}
+		}
+		if system != c.expectedSystem {
+			t.Errorf("Test case %d: expected database system '%s', but got '%s'", i, c.expectedSystem, system)
+		}
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
+
+	"github.com/Donders-Institute/hpc-webhook/internal/submit"
 )
 
+// MaxDescriptionLength is the maximum length of a webhook description
+const MaxDescriptionLength = 255
+
 var validConfigurationAddURLPathRegexString = fmt.Sprintf(`^%s$`, ConfigurationPath)
 var validConfigurationAddURLPathRegex = regexp.MustCompile(validConfigurationAddURLPathRegexString)
 
@@ -18,11 +24,34 @@ var validConfigurationListURLPathRegex = regexp.MustCompile(validConfigurationLi
 var validConfigurationDeleteURLPathRegexString = fmt.Sprintf(`^%s/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, ConfigurationPath)
 var validConfigurationDeleteURLPathRegex = regexp.MustCompile(validConfigurationDeleteURLPathRegexString)
 
+var validConfigurationUpdateURLPathRegexString = fmt.Sprintf(`^%s/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, ConfigurationPath)
+var validConfigurationUpdateURLPathRegex = regexp.MustCompile(validConfigurationUpdateURLPathRegexString)
+
+var validConfigurationRotateURLPathRegexString = fmt.Sprintf(`^%s/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}/rotate$`, ConfigurationPath)
+var validConfigurationRotateURLPathRegex = regexp.MustCompile(validConfigurationRotateURLPathRegexString)
+
+var validConfigurationTestURLPathRegexString = fmt.Sprintf(`^%s/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}/test$`, ConfigurationPath)
+var validConfigurationTestURLPathRegex = regexp.MustCompile(validConfigurationTestURLPathRegexString)
+
+var validConfigurationDoctorURLPathRegexString = fmt.Sprintf(`^%s$`, ConfigurationDoctorPath)
+var validConfigurationDoctorURLPathRegex = regexp.MustCompile(validConfigurationDoctorURLPathRegexString)
+
+var validAdminDisableURLPathRegexString = fmt.Sprintf(`^%s/webhooks/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}/disable$`, AdminPath)
+var validAdminDisableURLPathRegex = regexp.MustCompile(validAdminDisableURLPathRegexString)
+
 var validURLPathRegexString = fmt.Sprintf(`^%s/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, WebhookPath)
 var validURLPathRegex = regexp.MustCompile(validURLPathRegexString)
 
 var validWebhookIDRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
 
+var validEventsRegex = regexp.MustCompile(`^[A-Za-z0-9_. ]+(,[A-Za-z0-9_. ]+)*$`)
+
+var validJobIDRegex = regexp.MustCompile(`^[0-9]+(\[[0-9]*\])?(\.[A-Za-z0-9.\-]+)?$`)
+
+var validRequestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var validTraceIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
 func isValidConfigurationAddURLPath(urlPath string) bool {
 	return validConfigurationAddURLPathRegex.MatchString(urlPath)
 }
@@ -39,6 +68,26 @@ func isValidConfigurationDeleteURLPath(urlPath string) bool {
 	return validConfigurationDeleteURLPathRegex.MatchString(urlPath)
 }
 
+func isValidConfigurationUpdateURLPath(urlPath string) bool {
+	return validConfigurationUpdateURLPathRegex.MatchString(urlPath)
+}
+
+func isValidConfigurationRotateURLPath(urlPath string) bool {
+	return validConfigurationRotateURLPathRegex.MatchString(urlPath)
+}
+
+func isValidConfigurationTestURLPath(urlPath string) bool {
+	return validConfigurationTestURLPathRegex.MatchString(urlPath)
+}
+
+func isValidConfigurationDoctorURLPath(urlPath string) bool {
+	return validConfigurationDoctorURLPathRegex.MatchString(urlPath)
+}
+
+func isValidAdminDisableURLPath(urlPath string) bool {
+	return validAdminDisableURLPathRegex.MatchString(urlPath)
+}
+
 func isValidURLPath(urlPath string) bool {
 	return validURLPathRegex.MatchString(urlPath)
 }
@@ -47,6 +96,59 @@ func isValidWebhookID(webhookID string) bool {
 	return validWebhookIDRegex.MatchString(webhookID)
 }
 
+func isValidJobID(jobID string) bool {
+	return validJobIDRegex.MatchString(jobID)
+}
+
+func isValidRequestID(requestID string) bool {
+	return validRequestIDRegex.MatchString(requestID)
+}
+
+func isValidTraceID(traceID string) bool {
+	return validTraceIDRegex.MatchString(traceID)
+}
+
+func isValidEvents(events string) bool {
+	return events == "" || validEventsRegex.MatchString(events)
+}
+
+// The qsub options are checked as the submit command on the relay node does
+func isValidQsubOptions(qsubOptions string) bool {
+	_, err := submit.QsubArgs(qsubOptions)
+	return err == nil
+}
+
+func isValidExpires(expires string) bool {
+	_, err := normalizeExpires(expires)
+	return err == nil
+}
+
+// normalizeExpires parses an expiry time and formats it in the local time zone,
+// as the expiry times are compared as strings in the database
+func normalizeExpires(expires string) (string, error) {
+	if expires == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return "", err
+	}
+	return formatExpires(t), nil
+}
+
+// formatExpires formats a time to be compared with the expiry times in the database
+func formatExpires(t time.Time) string {
+	return t.In(time.Local).Format(time.RFC3339)
+}
+
+func isValidConcurrency(concurrency string) bool {
+	switch concurrency {
+	case "", ConcurrencyAllow, ConcurrencySkip, ConcurrencyCancel:
+		return true
+	}
+	return false
+}
+
 func validateConfigurationRequest(conf ConfigurationRequest, validateHash bool) error {
 	if validateHash && !isValidWebhookID(conf.Hash) {
 		return errors.New("invalid configuration request: invalid hash")
@@ -57,5 +159,51 @@ func validateConfigurationRequest(conf ConfigurationRequest, validateHash bool)
 	if conf.Groupname == "" {
 		return errors.New("invalid configuration request: groupname missing")
 	}
+	if conf.CoalesceSeconds < 0 || conf.CoalesceSeconds > MaxCoalesceSeconds {
+		return fmt.Errorf("invalid configuration request: coalescing window must be between 0 and %d seconds", MaxCoalesceSeconds)
+	}
+	if !isValidConcurrency(conf.Concurrency) {
+		return errors.New("invalid configuration request: concurrency must be allow, skip or cancel")
+	}
+	if !isValidEvents(conf.Events) {
+		return errors.New("invalid configuration request: invalid events filter")
+	}
+	if !isValidQsubOptions(conf.QsubOptions) {
+		return errors.New("invalid configuration request: invalid qsub options")
+	}
+	if !isValidExpires(conf.Expires) {
+		return errors.New("invalid configuration request: expires must be a RFC3339 time")
+	}
+	return nil
+}
+
+func validateConfigurationUpdateRequest(conf ConfigurationUpdateRequest) error {
+	if !isValidWebhookID(conf.Hash) {
+		return errors.New("invalid configuration update request: invalid hash")
+	}
+	if conf.Username == "" {
+		return errors.New("invalid configuration update request: username missing")
+	}
+	if conf.Groupname == "" {
+		return errors.New("invalid configuration update request: groupname missing")
+	}
+	if conf.Enabled == nil && !conf.hasSettings() {
+		return errors.New("invalid configuration update request: nothing to update")
+	}
+	if conf.Description != nil && len(*conf.Description) > MaxDescriptionLength {
+		return fmt.Errorf("invalid configuration update request: description longer than %d characters", MaxDescriptionLength)
+	}
+	if conf.CoalesceSeconds != nil && (*conf.CoalesceSeconds < 0 || *conf.CoalesceSeconds > MaxCoalesceSeconds) {
+		return fmt.Errorf("invalid configuration update request: coalescing window must be between 0 and %d seconds", MaxCoalesceSeconds)
+	}
+	if conf.Concurrency != nil && !isValidConcurrency(*conf.Concurrency) {
+		return errors.New("invalid configuration update request: concurrency must be allow, skip or cancel")
+	}
+	if conf.Events != nil && !isValidEvents(*conf.Events) {
+		return errors.New("invalid configuration update request: invalid events filter")
+	}
+	if conf.QsubOptions != nil && !isValidQsubOptions(*conf.QsubOptions) {
+		return errors.New("invalid configuration update request: invalid qsub options")
+	}
 	return nil
 }
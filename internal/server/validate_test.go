@@ -2,6 +2,7 @@ package server
 
 import (
 	"testing"
+	"time"
 )
 
 func TestValidConfigurationAddURLPath(t *testing.T) {
@@ -144,6 +145,173 @@ func TestValidConfigurationDeleteURLPath(t *testing.T) {
 	}
 }
 
+func TestValidConfigurationUpdateURLPath(t *testing.T) {
+	cases := []struct {
+		urlPath        string
+		expectedResult bool
+	}{
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			expectedResult: true, // Valid configuration URL path, no error
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716",
+			expectedResult: false, // Invalid hash
+		},
+		{
+			urlPath:        "/configuration/nonexisting",
+			expectedResult: false, // Invalid configuration URL path
+		},
+		{
+			urlPath:        "/nonexisting/550e8400-e29b-41d4-a716-446655440001",
+			expectedResult: false, // Invalid configuration URL path
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidConfigurationUpdateURLPath(c.urlPath)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid url path '%s', but got invalid url path", c.urlPath)
+			} else {
+				t.Errorf("Expected invalid url path '%s', but got valid url path", c.urlPath)
+			}
+		}
+	}
+}
+
+func TestValidConfigurationTestURLPath(t *testing.T) {
+	cases := []struct {
+		urlPath        string
+		expectedResult bool
+	}{
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001/test",
+			expectedResult: true, // Valid configuration URL path, no error
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			expectedResult: false, // Missing test
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716/test",
+			expectedResult: false, // Invalid hash
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidConfigurationTestURLPath(c.urlPath)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid url path '%s', but got invalid url path", c.urlPath)
+			} else {
+				t.Errorf("Expected invalid url path '%s', but got valid url path", c.urlPath)
+			}
+		}
+	}
+}
+
+func TestValidConfigurationDoctorURLPath(t *testing.T) {
+	cases := []struct {
+		urlPath        string
+		expectedResult bool
+	}{
+		{
+			urlPath:        "/configuration/doctor",
+			expectedResult: true, // Valid configuration URL path, no error
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001/doctor",
+			expectedResult: false, // Doctor of a single webhook
+		},
+		{
+			urlPath:        "/nonexisting/doctor",
+			expectedResult: false, // Invalid configuration URL path
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidConfigurationDoctorURLPath(c.urlPath)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid url path '%s', but got invalid url path", c.urlPath)
+			} else {
+				t.Errorf("Expected invalid url path '%s', but got valid url path", c.urlPath)
+			}
+		}
+	}
+}
+
+func TestValidConfigurationRotateURLPath(t *testing.T) {
+	cases := []struct {
+		urlPath        string
+		expectedResult bool
+	}{
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001/rotate",
+			expectedResult: true, // Valid configuration URL path, no error
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001",
+			expectedResult: false, // Missing rotate
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716/rotate",
+			expectedResult: false, // Invalid hash
+		},
+		{
+			urlPath:        "/nonexisting/550e8400-e29b-41d4-a716-446655440001/rotate",
+			expectedResult: false, // Invalid configuration URL path
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidConfigurationRotateURLPath(c.urlPath)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid url path '%s', but got invalid url path", c.urlPath)
+			} else {
+				t.Errorf("Expected invalid url path '%s', but got valid url path", c.urlPath)
+			}
+		}
+	}
+}
+
+func TestValidAdminDisableURLPath(t *testing.T) {
+	cases := []struct {
+		urlPath        string
+		expectedResult bool
+	}{
+		{
+			urlPath:        "/admin/webhooks/550e8400-e29b-41d4-a716-446655440001/disable",
+			expectedResult: true, // Valid admin URL path, no error
+		},
+		{
+			urlPath:        "/admin/webhooks/550e8400-e29b-41d4-a716-446655440001",
+			expectedResult: false, // Missing disable
+		},
+		{
+			urlPath:        "/admin/webhooks/550e8400-e29b-41d4-a716/disable",
+			expectedResult: false, // Invalid hash
+		},
+		{
+			urlPath:        "/configuration/550e8400-e29b-41d4-a716-446655440001/disable",
+			expectedResult: false, // Invalid admin URL path
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidAdminDisableURLPath(c.urlPath)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid url path '%s', but got invalid url path", c.urlPath)
+			} else {
+				t.Errorf("Expected invalid url path '%s', but got valid url path", c.urlPath)
+			}
+		}
+	}
+}
+
 func TestValidURLPath(t *testing.T) {
 	cases := []struct {
 		urlPath        string
@@ -210,6 +378,145 @@ func TestValidWebhookID(t *testing.T) {
 	}
 }
 
+func TestNormalizeExpires(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("CET", 60*60)
+	defer func() { time.Local = local }()
+
+	cases := []struct {
+		expires        string
+		expectedResult string
+	}{
+		{
+			expires:        "",
+			expectedResult: "", // never expires
+		},
+		{
+			expires:        "2019-12-31T23:59:59+01:00",
+			expectedResult: "2019-12-31T23:59:59+01:00",
+		},
+		{
+			expires:        "2019-12-31T22:59:59Z",
+			expectedResult: "2019-12-31T23:59:59+01:00", // same time in another time zone
+		},
+		{
+			expires:        "2020-01-01T03:00:00+05:00",
+			expectedResult: "2019-12-31T23:00:00+01:00", // earlier time that compares as a later string
+		},
+	}
+
+	for _, c := range cases {
+		result, err := normalizeExpires(c.expires)
+		if err != nil {
+			t.Errorf("Unexpected error for expiry time '%s': %s", c.expires, err)
+			continue
+		}
+		if result != c.expectedResult {
+			t.Errorf("Expected expiry time '%s' to be stored as '%s', but got '%s'", c.expires, c.expectedResult, result)
+		}
+	}
+
+	if _, err := normalizeExpires("31-12-2019"); err == nil {
+		t.Errorf("Expected an error for an invalid expiry time")
+	}
+}
+
+func TestValidJobID(t *testing.T) {
+	cases := []struct {
+		jobID          string
+		expectedResult bool
+	}{
+		{
+			jobID:          "34986226.dccn-l029.dccn.nl",
+			expectedResult: true, // valid
+		},
+		{
+			jobID:          "34986226",
+			expectedResult: true, // valid, without server name
+		},
+		{
+			jobID:          "34986226[].dccn-l029.dccn.nl",
+			expectedResult: true, // valid array job
+		},
+		{
+			jobID:          "34986226.dccn-l029; rm -rf ~",
+			expectedResult: false, // Invalid characters
+		},
+		{
+			jobID:          "",
+			expectedResult: false, // Empty
+		},
+	}
+
+	for _, c := range cases {
+		result := isValidJobID(c.jobID)
+		if result != c.expectedResult {
+			if c.expectedResult {
+				t.Errorf("Expected valid job id '%s', but got invalid job id", c.jobID)
+			} else {
+				t.Errorf("Expected invalid job id '%s', but got valid job id", c.jobID)
+			}
+		}
+	}
+}
+
+func TestValidateConfigurationUpdateRequest(t *testing.T) {
+	enabled := false
+	cases := []struct {
+		conf           ConfigurationUpdateRequest
+		expectedResult bool
+	}{
+		{
+			conf: ConfigurationUpdateRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "dccngroup",
+				Username:  "dccnuser",
+				Enabled:   &enabled,
+			},
+			expectedResult: true, // valid, no error
+		},
+		{
+			conf: ConfigurationUpdateRequest{
+				Hash:      "550e8400-e29b-41d4-a716-44665544000",
+				Groupname: "dccngroup",
+				Username:  "dccnuser",
+				Enabled:   &enabled,
+			},
+			expectedResult: false, // Invalid hash
+		},
+		{
+			conf: ConfigurationUpdateRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "dccngroup",
+				Username:  "",
+				Enabled:   &enabled,
+			},
+			expectedResult: false, // Invalid username
+		},
+		{
+			conf: ConfigurationUpdateRequest{
+				Hash:      "550e8400-e29b-41d4-a716-446655440001",
+				Groupname: "dccngroup",
+				Username:  "dccnuser",
+			},
+			expectedResult: false, // Nothing to update
+		},
+	}
+
+	for _, c := range cases {
+		err := validateConfigurationUpdateRequest(c.conf)
+		if c.expectedResult {
+			if err != nil {
+				t.Errorf("Expected valid configuration update request '%+v', but got invalid configuration update request", c.conf)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("Expected invalid configuration update request '%+v', but got valid configuration update request", c.conf)
+			}
+		}
+	}
+}
+
 func TestValidateConfigurationRequest(t *testing.T) {
 	cases := []struct {
 		conf           ConfigurationRequest
@@ -236,6 +543,28 @@ func TestValidateConfigurationRequest(t *testing.T) {
 			validateHash:   true,
 			expectedResult: false, // Invalid hash (i.e. capitals A-F instead of a-f)
 		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Expires:     "2019-12-31T23:59:59+01:00",
+			},
+			validateHash:   true,
+			expectedResult: true, // valid, no error
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Expires:     "31-12-2019",
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid expiry date
+		},
 		{
 			conf: ConfigurationRequest{
 				Hash:        "550e8400-e29b-41d4-a716-44665544000",
@@ -276,17 +605,117 @@ func TestValidateConfigurationRequest(t *testing.T) {
 			validateHash:   false,
 			expectedResult: true, // Empty hash but no error because validateHash = false
 		},
+		{
+			conf: ConfigurationRequest{
+				Hash:            "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:       "dccngroup",
+				Username:        "dccnuser",
+				Description:     "description",
+				CoalesceSeconds: 60,
+			},
+			validateHash:   true,
+			expectedResult: true, // valid coalescing window
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:            "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:       "dccngroup",
+				Username:        "dccnuser",
+				Description:     "description",
+				CoalesceSeconds: -1,
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid negative coalescing window
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:            "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:       "dccngroup",
+				Username:        "dccnuser",
+				Description:     "description",
+				CoalesceSeconds: MaxCoalesceSeconds + 1,
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid coalescing window that is too long
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Concurrency: ConcurrencyCancel,
+			},
+			validateHash:   true,
+			expectedResult: true, // valid concurrency policy
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Concurrency: "queue",
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid concurrency policy
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Events:      "push,release",
+				QsubOptions: "-l walltime=00:10:00,mem=1gb -q short",
+			},
+			validateHash:   true,
+			expectedResult: true, // valid events filter and qsub options
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				Events:      "push,",
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid events filter
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				QsubOptions: "-l walltime=00:10:00 $(whoami)",
+			},
+			validateHash:   true,
+			expectedResult: false, // Invalid qsub options
+		},
+		{
+			conf: ConfigurationRequest{
+				Hash:        "550e8400-e29b-41d4-a716-446655440001",
+				Groupname:   "dccngroup",
+				Username:    "dccnuser",
+				Description: "description",
+				QsubOptions: "-o /home/dccngroup/dccnuser/.bashrc",
+			},
+			validateHash:   true,
+			expectedResult: false, // Qsub option that is not allowed
+		},
 	}
 
 	for _, c := range cases {
 		err := validateConfigurationRequest(c.conf, c.validateHash)
 		if c.expectedResult {
 			if err != nil {
-				t.Errorf("Expected valid configuration request '%s', but got invalid configuration request", c.conf)
+				t.Errorf("Expected valid configuration request '%+v', but got invalid configuration request", c.conf)
 			}
 		} else {
 			if err == nil {
-				t.Errorf("Expected invalid configuration request '%s', but got valid configuration request", c.conf)
+				t.Errorf("Expected invalid configuration request '%+v', but got valid configuration request", c.conf)
 			}
 		}
 	}
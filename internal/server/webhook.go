@@ -1,7 +1,7 @@
 package server
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,6 +10,13 @@ import (
 	"path"
 	"strings"
 	"time"
+
+	"github.com/Donders-Institute/hpc-webhook/internal/submit"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Webhook is an inbound github webhook
@@ -34,16 +41,55 @@ func extractWebhookID(u *url.URL, WebhookPath string) (string, error) {
 	return webhookID, nil
 }
 
-// Check if the webhook id exists. Return the username
-func checkWebhookID(db *sql.DB, hpcWebhookHost string, hpcWebhookExternalPort string, webhookID string) (string, string, error) {
-	list, err := getRowHashOnly(db, hpcWebhookHost, hpcWebhookExternalPort, webhookID)
+// Check if the webhook id exists, either as the current public token or as a previous one within its grace period.
+// Return the registered webhook
+func checkWebhookID(ctx context.Context, store Store, webhookID string) (Item, error) {
+	_, span := startSpan(ctx, "db.checkWebhookID", storeAttributes(store)...)
+	list, err := store.GetWebhookByToken(webhookID, formatExpires(time.Now()))
+	endSpan(span, err)
 	if err != nil || len(list) == 0 {
-		return "", "", fmt.Errorf("Invalid webhook ID '%s'", webhookID)
+		return Item{}, fmt.Errorf("Invalid webhook ID '%s'", webhookID)
 	}
 	if len(list) > 1 {
-		return "", "", fmt.Errorf("Invalid database; found multiple webhook with webhook ID '%s'", webhookID)
+		return Item{}, fmt.Errorf("Invalid database; found multiple webhook with webhook ID '%s'", webhookID)
+	}
+	return list[0], nil
+}
+
+// Event headers set by the common webhook senders
+var eventHeaders = []string{"X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event", "X-Gitlab-Event"}
+
+// Obtain the event of the delivery from the request headers (empty if unknown)
+func extractWebhookEvent(req *http.Request) string {
+	for _, header := range eventHeaders {
+		if event := req.Header.Get(header); event != "" {
+			return event
+		}
+	}
+	return ""
+}
+
+// Obtain the sender of the delivery from the event headers ("other" if unknown)
+func extractWebhookProvider(req *http.Request) string {
+	for _, header := range eventHeaders {
+		if req.Header.Get(header) != "" {
+			return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(header, "X-"), "-Event"))
+		}
 	}
-	return list[0].Groupname, list[0].Username, nil
+	return "other"
+}
+
+// Check if the event passes the comma-separated events filter of the webhook
+func eventMatchesFilter(event string, events string) bool {
+	if events == "" {
+		return true
+	}
+	for _, e := range strings.Split(events, ",") {
+		if strings.EqualFold(strings.TrimSpace(e), event) {
+			return true
+		}
+	}
+	return false
 }
 
 // Read the payload from the request body
@@ -52,9 +98,9 @@ func parseWebhookPayload(req *http.Request) ([]byte, error) {
 	return payload, err
 }
 
-// Write the payload to a file
-func writeWebhookPayloadToFile(payloadDir string, payload []byte, username string) error {
-	payloadFilename := path.Join(payloadDir, PayLoadName)
+// Write the payload of a delivery to a file
+func writeWebhookPayloadToFile(payloadDir string, payload []byte, deliveryID string) error {
+	payloadFilename := path.Join(payloadDir, deliveryID)
 	err := ioutil.WriteFile(payloadFilename, payload, 0600)
 	if err != nil {
 		return err
@@ -84,22 +130,150 @@ func parseWebhookRequest(req *http.Request) (*Webhook, string, error) {
 	return webhook, webhookID, err
 }
 
-// Process the webhook and log events
-func processWebhook(c Connector, conf executeConfiguration) {
-	err := ExecuteScript(c, conf)
+// Prepare the execution of the script of a webhook for one of its deliveries, of which the payload has been stored
+func (a *API) newExecuteConfiguration(item Item, deliveryID string) executeConfiguration {
+	targetPayloadDir := path.Join(a.HomeDir, item.Groupname, item.Username, WebhooksWorkDir, item.Hash)
+	return executeConfiguration{
+		privateKeyFilename:       a.PrivateKeyFilename,
+		passphraseFilename:       a.KeyPassphraseFilename,
+		agentSocket:              a.AgentSocket,
+		caKeyFilename:            a.CAKeyFilename,
+		caPassphraseFilename:     a.CAPassphraseFilename,
+		caSocket:                 a.CASocket,
+		certificateValidity:      time.Duration(a.CertValiditySeconds) * time.Second,
+		sourceAddress:            a.AuthorizedKeyFrom,
+		payloadFilename:          path.Join(a.DataDir, "payloads", item.Username, deliveryID),
+		targetPayloadDir:         targetPayloadDir,
+		targetPayloadFilename:    path.Join(targetPayloadDir, submit.PayloadName(deliveryID)),
+		userScriptPathFilename:   path.Join(targetPayloadDir, ScriptName),
+		username:                 item.Username,
+		groupname:                item.Groupname,
+		password:                 a.RelayNodeTestUserPassword,
+		relayNodeName:            a.RelayNode,
+		connectionTimeoutSeconds: a.ConnectionTimeoutSeconds,
+		dataDir:                  a.DataDir,
+		homeDir:                  a.HomeDir,
+		webhookID:                item.Hash,
+		deliveryID:               deliveryID,
+		concurrency:              item.Concurrency,
+		qsubOptions:              item.QsubOptions,
+		submitCommand:            a.AuthorizedKeyCommand,
+	}
+}
+
+// Set the private keys the server authenticates with: the current key, and the previous one during a key rotation
+func (a *API) withServerIdentity(conf executeConfiguration) executeConfiguration {
+	privateKeyFilenames, _ := a.serverIdentity()
+	conf.privateKeyFilename = privateKeyFilenames[0]
+	if len(privateKeyFilenames) > 1 {
+		conf.previousKeyFilename = privateKeyFilenames[1]
+	}
+	return conf
+}
+
+// Process the webhook, record the result in the delivery history and log events
+func (a *API) processWebhook(conf executeConfiguration) {
+	defer a.deliveries.done()
+	defer os.Remove(conf.payloadFilename)
+	deliveriesQueued.Dec()
+	logger := deliveryLogger(conf)
+
+	// Continue the trace of the request that received the delivery
+	ctx, span := startSpan(trace.ContextWithSpanContext(context.Background(), conf.spanContext), "webhook.process",
+		attribute.String("webhook.id", conf.webhookID),
+		attribute.String("delivery.id", conf.deliveryID),
+	)
+	defer span.End()
+
+	// Authenticate with the current server key, and the previous one during a key rotation
+	conf = a.withServerIdentity(conf)
+
+	// Look up the previous job when it may be affected by the concurrency policy
+	if conf.concurrency == ConcurrencySkip || conf.concurrency == ConcurrencyCancel {
+		previousJobID, err := a.store().LastJob(conf.webhookID)
+		if err != nil {
+			logger.Error(err)
+		}
+		conf.previousJobID = previousJobID
+	}
+
+	conf.submitting = func() error {
+		return a.store().UpdateDelivery(conf.deliveryID, DeliveryStatusSubmitting, "")
+	}
+
+	status := DeliveryStatusSubmitted
+	jobID, err := ExecuteScript(ctx, a.Connector, conf)
+	result := fmt.Sprintf("job %s", jobID)
+	switch {
+	case err == errPreviousJobActive:
+		status = DeliveryStatusSkipped
+		result = fmt.Sprintf("job %s %s", conf.previousJobID, err)
+		logger.WithField("job", conf.previousJobID).Infof("Delivery skipped: %s", err)
+	case err != nil:
+		status = DeliveryStatusFailed
+		result = err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.Errorf("Delivery failed: %s", err)
+	default:
+		logger.WithField("job", jobID).Info("Delivery submitted")
+	}
+
+	err = a.store().UpdateDelivery(conf.deliveryID, status, jobID)
 	if err != nil {
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Error(err)
 	}
-	fmt.Printf("%s Success\n", time.Now().Format(time.RFC3339))
+
+	// Record the result of the delivery
+	a.auditDelivery(conf.webhookID, conf.username, fmt.Sprintf("delivery %s %s: %s", conf.deliveryID, status, result), conf.source, conf.trace, time.Now())
+}
+
+// Mark a delivery that has been replaced by a newer one within the coalescing window
+func (a *API) supersedeWebhook(conf executeConfiguration) {
+	defer a.deliveries.done()
+	os.Remove(conf.payloadFilename)
+	deliveriesQueued.Dec()
+	logger := deliveryLogger(conf)
+
+	err := a.store().UpdateDelivery(conf.deliveryID, DeliveryStatusSuperseded, "")
+	if err != nil {
+		logger.Error(err)
+	}
+	logger.Info("Delivery superseded")
+	a.auditDelivery(conf.webhookID, conf.username, fmt.Sprintf("delivery %s %s", conf.deliveryID, DeliveryStatusSuperseded), conf.source, conf.trace, time.Now())
 }
 
 // WebhookHandler handles a HTTP POST request containing the webhook payload in its body
 func (a *API) WebhookHandler(w http.ResponseWriter, req *http.Request) {
+	logger := requestLogger(req)
+	provider := extractWebhookProvider(req)
+	deliveriesReceived.WithLabelValues(provider).Inc()
+
+	ctx, span := startRequestSpan(req, "webhook.receive")
+	span.SetAttributes(attribute.String("webhook.provider", provider))
+	defer span.End()
+
+	// Return the trace to the sender, to find the delivery in the admin API
+	deliveryTrace := traceID(ctx)
+	if deliveryTrace != "" {
+		w.Header().Set(TraceIDHeader, deliveryTrace)
+	}
+
 	// Check the method
 	if !strings.EqualFold(req.Method, "POST") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		fmt.Fprint(w, "Error 405 - Method not allowed: invalid method: ", req.Method)
-		fmt.Printf("%s Error 405 - Method not allowed: invalid method: %s\n", time.Now().Format(time.RFC3339), req.Method)
+		logger.Warnf("Error 405 - Method not allowed: invalid method: %s", req.Method)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonMethod).Inc()
+		return
+	}
+
+	// Refuse deliveries while the server is shutting down, the sender may retry them later
+	if a.deliveries.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "Error 503 - Service unavailable: server is shutting down")
+		logger.Warn("Error 503 - Service unavailable: server is shutting down")
+		deliveriesRejected.WithLabelValues(provider, RejectReasonShutdown).Inc()
 		return
 	}
 
@@ -108,16 +282,18 @@ func (a *API) WebhookHandler(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonURL).Inc()
 		return
 	}
 
 	// Check if webhookID exists
-	groupname, username, err := checkWebhookID(a.DB, a.HPCWebhookHost, a.HPCWebhookExternalPort, webhookID)
+	item, err := checkWebhookID(ctx, a.store(), webhookID)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonUnknown).Inc()
 		return
 	}
 
@@ -127,57 +303,107 @@ func (a *API) WebhookHandler(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonPayload).Inc()
 		return
 	}
 
+	// Refuse deliveries for webhooks that have been disabled
+	if !item.Enabled {
+		w.WriteHeader(http.StatusLocked)
+		fmt.Fprintf(w, "Error 423 - Locked: webhook '%s' is disabled", webhookID)
+		logger.WithField("webhook", item.Hash).Warn("Error 423 - Locked: delivery for disabled webhook")
+		a.auditDelivery(item.Hash, item.Username, "refused: webhook is disabled", requestSource(req), deliveryTrace, time.Now())
+		deliveriesRejected.WithLabelValues(provider, RejectReasonDisabled).Inc()
+		return
+	}
+
+	// Ignore deliveries for events the webhook is not interested in
+	event := extractWebhookEvent(req)
+	if !eventMatchesFilter(event, item.Events) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Payload ignored: event '%s' is filtered out", event)
+		logger.WithField("webhook", item.Hash).Infof("Payload ignored: event '%s' is filtered out", event)
+		a.auditDelivery(item.Hash, item.Username, fmt.Sprintf("ignored: event '%s' is filtered out", event), requestSource(req), deliveryTrace, time.Now())
+		deliveriesRejected.WithLabelValues(provider, RejectReasonFiltered).Inc()
+		return
+	}
+
+	// The public token in the URL may differ from the hash under which the webhook is registered
+	webhookID = item.Hash
+	username := item.Username
+	deliveryID := uuid.New().String()
+	logger = logger.WithFields(log.Fields{
+		"delivery": deliveryID,
+		"webhook":  webhookID,
+	})
+	logger.Tracef("Payload: %s", payload)
+	span.SetAttributes(
+		attribute.String("webhook.id", webhookID),
+		attribute.String("delivery.id", deliveryID),
+	)
+
 	// Create the payload dir
+	_, storeSpan := startSpan(ctx, "payload.store")
 	payloadDir := path.Join(a.DataDir, "payloads", username)
 	err = os.MkdirAll(payloadDir, os.ModePerm)
 	if err != nil {
+		endSpan(storeSpan, err)
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonInternal).Inc()
 		return
 	}
 
 	// Write the payload to file
-	err = writeWebhookPayloadToFile(payloadDir, payload, username)
+	err = writeWebhookPayloadToFile(payloadDir, payload, deliveryID)
+	endSpan(storeSpan, err)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Error 404 - Not found: ", err)
-		fmt.Printf("%s Error %s\n", time.Now().Format(time.RFC3339), err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonInternal).Inc()
+		return
+	}
+
+	// Record the delivery
+	_, dbSpan := startSpan(ctx, "db.addDeliveryRow", storeAttributes(a.store())...)
+	err = a.store().AddDelivery(deliveryID, webhookID, time.Now().Format(time.RFC3339), DeliveryStatusPending, deliveryTrace, provider)
+	endSpan(dbSpan, err)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error 404 - Not found: ", err)
+		logger.Warn(err)
+		deliveriesRejected.WithLabelValues(provider, RejectReasonInternal).Inc()
 		return
 	}
 
 	// Prepare the execution of the script
-	payloadFilename := path.Join(payloadDir, PayLoadName)
-	targetPayloadDir := path.Join(a.HomeDir, groupname, username, WebhooksWorkDir, webhookID)
-	targetPayloadFilename := path.Join(targetPayloadDir, PayLoadName)
-	userScriptPathFilename := path.Join(a.HomeDir, groupname, username, WebhooksWorkDir, webhookID, ScriptName)
-
-	executeConfig := executeConfiguration{
-		privateKeyFilename:     a.PrivateKeyFilename,
-		payloadFilename:        payloadFilename,
-		targetPayloadDir:       targetPayloadDir,
-		targetPayloadFilename:  targetPayloadFilename,
-		userScriptPathFilename: userScriptPathFilename,
-		username:               username,
-		groupname:              groupname,
-		password:               a.RelayNodeTestUserPassword,
-		relayNodeName:          a.RelayNode,
-		dataDir:                a.DataDir,
-		homeDir:                a.HomeDir,
-		webhookID:              webhookID,
-		payload:                payload,
-	}
-
-	// Process the webhook in the background
-	go processWebhook(a.Connector, executeConfig)
+	executeConfig := a.newExecuteConfiguration(item, deliveryID)
+	executeConfig.requestID = requestID(req)
+	executeConfig.spanContext = span.SpanContext()
+	executeConfig.trace = deliveryTrace
+	executeConfig.source = requestSource(req)
+	executeConfig.payload = payload
+
+	// Process the webhook in the background, possibly after coalescing it with later deliveries
+	deliveriesAccepted.WithLabelValues(provider).Inc()
+	deliveriesQueued.Inc()
+	switch {
+	case !a.deliveries.accept():
+		// The server started shutting down meanwhile, the recorded delivery is submitted when it starts again
+		a.leavePending(executeConfig)
+	case item.CoalesceSeconds > 0:
+		window := time.Duration(item.CoalesceSeconds) * time.Second
+		a.coalescer.add(webhookID, window, executeConfig, a.processWebhook, a.supersedeWebhook)
+	default:
+		go a.processWebhook(executeConfig)
+	}
 
 	// Succes
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Payload delivered successfully")
-	fmt.Printf("%s Payload delivered successfully\n", time.Now().Format(time.RFC3339))
+	logger.WithField("event", event).Info("Payload delivered successfully")
 	return
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -215,11 +216,16 @@ func TestHandlerWebhook(t *testing.T) {
 
 		// Set the query that is expected to be executed
 		if c.expectedResult {
-			expectedRows := sqlmock.NewRows([]string{"id", "hash", "groupname", "username", "description", "created"}).
-				AddRow(1, c.hash, c.groupname, c.username, c.description, "2019-03-11T19:44:44+01:00")
-			mock.ExpectQuery("^SELECT id, hash, groupname, username, description, created FROM hpc_webhook").
-				WithArgs(c.hash).
+			expectedRows := sqlmock.NewRows(itemColumnNames).
+				AddRow(1, c.hash, c.groupname, c.username, c.description, "2019-03-11T19:44:44+01:00", 0, "allow", true, "", "", c.hash, nil)
+			mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+				WithArgs(c.hash, AnyTimeString{}).
 				WillReturnRows(expectedRows)
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO hpc_webhook_delivery").
+				WithArgs(sqlmock.AnyArg(), c.hash, AnyTimeString{}, DeliveryStatusPending, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 		}
 
 		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -230,6 +236,11 @@ func TestHandlerWebhook(t *testing.T) {
 		// directly and pass in our Request and ResponseRecorder.
 		handler.ServeHTTP(rr, req)
 
+		// Wait for the delivery to be processed in the background
+		if err := app.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
 		// // Check the status code is what we expect.
 		// if status := rr.Code; status != c.expectedStatus {
 		// 	t.Errorf("handler returned wrong status code: got %v want %v", status, c.expectedStatus)
@@ -250,3 +261,61 @@ func TestHandlerWebhook(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlerWebhookDisabled(t *testing.T) {
+	hash := "550e8400-e29b-41d4-a716-446655440001"
+	username := "dccnuser"
+	groupname := "dccngroup"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	api := API{
+		DB: db,
+		Connector: FakeConnector{
+			Description: "fake SSH connection to relay node",
+		},
+		RelayNode:              "relaynode.dccn.nl",
+		HPCWebhookHost:         "hpc-webhook.dccn.nl",
+		HPCWebhookInternalPort: "5111",
+		HPCWebhookExternalPort: "443",
+	}
+	app := &api
+
+	b, err := obtainWebhookPayloadBody(path.Join("..", "..", "test", "data", "example-github-webhook.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/webhook/"+hash, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The webhook exists, but is disabled
+	expectedRows := sqlmock.NewRows(itemColumnNames).
+		AddRow(1, hash, groupname, username, "", "2019-03-11T19:44:44+01:00", 0, "allow", false, "", "", hash, nil)
+	mock.ExpectQuery("^SELECT (.+) FROM hpc_webhook").
+		WithArgs(hash, AnyTimeString{}).
+		WillReturnRows(expectedRows)
+	expectAudit(mock, hash, username, AuditActionDeliver)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.WebhookHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusLocked {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusLocked)
+	}
+
+	expectedString := "Error 423 - Locked: webhook '" + hash + "' is disabled"
+	if rr.Body.String() != expectedString {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expectedString)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestExtractWebhookEvent(t *testing.T) {
+	cases := []struct {
+		headerInfo    map[string]string
+		expectedEvent string
+	}{
+		{
+			headerInfo: map[string]string{
+				"X-GitHub-Event": "push",
+			},
+			expectedEvent: "push", // GitHub
+		},
+		{
+			headerInfo: map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+			},
+			expectedEvent: "Push Hook", // GitLab
+		},
+		{
+			headerInfo: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			expectedEvent: "", // No event header, e.g. IFTTT or Zapier
+		},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("POST", "/webhook/550e8400-e29b-41d4-a716-446655440001", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range c.headerInfo {
+			req.Header.Set(key, value)
+		}
+
+		event := extractWebhookEvent(req)
+		if event != c.expectedEvent {
+			t.Errorf("Expected event '%s', but got '%s'", c.expectedEvent, event)
+		}
+	}
+}
+
+func TestEventMatchesFilter(t *testing.T) {
+	cases := []struct {
+		event          string
+		events         string
+		expectedResult bool
+	}{
+		{
+			event:          "push",
+			events:         "",
+			expectedResult: true, // No filter
+		},
+		{
+			event:          "",
+			events:         "",
+			expectedResult: true, // No filter and no event
+		},
+		{
+			event:          "release",
+			events:         "push,release",
+			expectedResult: true, // Event in the filter
+		},
+		{
+			event:          "Push Hook",
+			events:         "push hook",
+			expectedResult: true, // Event in the filter, ignoring case
+		},
+		{
+			event:          "issues",
+			events:         "push,release",
+			expectedResult: false, // Event not in the filter
+		},
+		{
+			event:          "",
+			events:         "push",
+			expectedResult: false, // Unknown event
+		},
+	}
+
+	for _, c := range cases {
+		result := eventMatchesFilter(c.event, c.events)
+		if result != c.expectedResult {
+			t.Errorf("Expected %t for event '%s' and filter '%s', but got %t", c.expectedResult, c.event, c.events, result)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package submit implements the restricted entry point of the HPC webhook server on the relay node.
+//
+// The server public key in the authorized keys of a user is bound to a forced command that reads
+// a single structured request from stdin. Only the submission of the webhook script of the user,
+// the check of that script without submitting it, and the status and deletion of a job are supported,
+// so the server cannot run arbitrary commands.
+package submit
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Command is the forced command for the server public key in the authorized keys of a user
+const Command = "hpc-webhook-submit"
+
+// Setup of the user's workspace directories and files, equal to the ones of the HPC webhook server
+const (
+	WebhooksWorkDir = ".webhook" // WebhooksWorkDir denotes the user's work directory
+	PayLoadName     = "payload"  // PayLoadName is the prefix of the payload files of the deliveries in user's work directory
+	ScriptName      = "script"   // ScriptName is the name of the script in the user's work directory
+)
+
+// Actions that can be requested
+const (
+	ActionSubmit = "submit" // ActionSubmit submits the script of a webhook with its payload
+	ActionStatus = "status" // ActionStatus checks if a job is still queued or running
+	ActionCancel = "cancel" // ActionCancel deletes a job
+	ActionCheck  = "check"  // ActionCheck resolves the script of a webhook and checks that it exists, without submitting it
+)
+
+// Request is a structured request of the HPC webhook server
+type Request struct {
+	Action      string `json:"action"`
+	WebhookID   string `json:"webhook"`
+	DeliveryID  string `json:"delivery"`
+	JobID       string `json:"job,omitempty"`
+	QsubOptions string `json:"qsubOptions,omitempty"`
+	Payload     string `json:"payload,omitempty"` // Payload file of the delivery in the webhook directory, named by PayloadName
+}
+
+// PayloadName returns the name of the payload file of a delivery, so that later deliveries do not overwrite
+// the payload of a job that is still queued
+func PayloadName(deliveryID string) string {
+	return PayLoadName + "-" + deliveryID
+}
+
+// Response is the result of a request
+type Response struct {
+	DeliveryID string `json:"delivery"`
+	JobID      string `json:"job,omitempty"`
+	Active     bool   `json:"active,omitempty"`
+	Script     string `json:"script,omitempty"` // Script the webhook points to, set by the check once the pointer is resolved
+	Error      string `json:"error,omitempty"`
+}
+
+// Runner runs a command in the given directory and returns its combined output
+type Runner func(dir string, name string, args ...string) ([]byte, error)
+
+var validIDRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// qsubOptionValues are the qsub options a webhook may set, with their valid values.
+// Options that choose files, interpreters, environment variables or interactive jobs (e.g. -o, -e, -S, -v, -W, -I)
+// are refused, so the server cannot decide what runs on behalf of the user or where its output is written.
+var qsubOptionValues = map[string]*regexp.Regexp{
+	"-l": regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=[A-Za-z0-9_:.+=]+(,[A-Za-z_][A-Za-z0-9_]*=[A-Za-z0-9_:.+=]+)*$`), // Resources
+	"-N": regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,63}$`),                                                         // Job name
+	"-q": regexp.MustCompile(`^[A-Za-z0-9_.-]+(@[A-Za-z0-9_.-]+)?$`),                                                   // Queue
+	"-m": regexp.MustCompile(`^(n|[abe]{1,3})$`),                                                                       // Mail events
+}
+
+// QsubArgs checks the qsub options of a webhook against the options that are allowed, and returns them as arguments.
+// Every option is followed by its value as a separate word.
+func QsubArgs(qsubOptions string) ([]string, error) {
+	args := strings.Fields(qsubOptions)
+	for i := 0; i < len(args); i += 2 {
+		valid, ok := qsubOptionValues[args[i]]
+		if !ok {
+			return nil, fmt.Errorf("qsub option '%s' is not allowed", args[i])
+		}
+		if i+1 == len(args) || !valid.MatchString(args[i+1]) {
+			return nil, fmt.Errorf("invalid value of qsub option '%s'", args[i])
+		}
+	}
+	return args, nil
+}
+
+var validJobIDRegex = regexp.MustCompile(`^[0-9]+(\[[0-9]*\])?(\.[A-Za-z0-9.\-]+)?$`)
+
+// Validate checks the request before anything is run on its behalf
+func Validate(req Request) error {
+	if !validIDRegex.MatchString(req.DeliveryID) {
+		return errors.New("invalid delivery id")
+	}
+
+	switch req.Action {
+	case ActionSubmit, ActionCheck:
+		if !validIDRegex.MatchString(req.WebhookID) {
+			return errors.New("invalid webhook id")
+		}
+		if _, err := QsubArgs(req.QsubOptions); err != nil {
+			return fmt.Errorf("invalid qsub options: %s", err)
+		}
+		if req.Payload != "" && req.Payload != PayloadName(req.DeliveryID) {
+			return errors.New("invalid payload")
+		}
+	case ActionStatus, ActionCancel:
+		if !validJobIDRegex.MatchString(req.JobID) {
+			return errors.New("invalid job id")
+		}
+	default:
+		return fmt.Errorf("invalid action '%s'", req.Action)
+	}
+	return nil
+}
+
+// Handle validates and performs the request in the given home directory
+func Handle(homeDir string, req Request, run Runner) Response {
+	rsp := Response{DeliveryID: req.DeliveryID}
+
+	if err := Validate(req); err != nil {
+		rsp.Error = err.Error()
+		return rsp
+	}
+
+	switch req.Action {
+	case ActionSubmit:
+		jobID, err := submitScript(homeDir, req, run)
+		if err != nil {
+			rsp.Error = err.Error()
+		}
+		rsp.JobID = jobID
+	case ActionCheck:
+		script, err := resolveScript(homeDir, req.WebhookID)
+		if err == nil {
+			err = checkScript(path.Join(homeDir, WebhooksWorkDir, req.WebhookID), script)
+		}
+		if err != nil {
+			rsp.Error = err.Error()
+		}
+		rsp.Script = script
+	case ActionStatus:
+		// qstat fails for jobs that are no longer known by the scheduler
+		output, err := run(homeDir, "qstat", req.JobID)
+		rsp.JobID = req.JobID
+		rsp.Active = err == nil && ParseQstatOutput(output, req.JobID)
+	case ActionCancel:
+		if output, err := run(homeDir, "qdel", req.JobID); err != nil {
+			rsp.Error = fmt.Sprintf("qdel failed: %s %s", err, strings.TrimSpace(string(output)))
+		}
+		rsp.JobID = req.JobID
+	}
+	return rsp
+}
+
+// Obtain the path to the user script from the script pointer in the webhook directory
+func resolveScript(homeDir string, webhookID string) (string, error) {
+	contents, err := ioutil.ReadFile(path.Join(homeDir, WebhooksWorkDir, webhookID, ScriptName))
+	if err != nil {
+		return "", fmt.Errorf("unknown webhook '%s'", webhookID)
+	}
+	script := strings.TrimSpace(string(contents))
+	if script == "" {
+		return "", fmt.Errorf("empty script pointer of webhook '%s'", webhookID)
+	}
+	return script, nil
+}
+
+// Check that the user script exists, relative paths being resolved in the webhook directory as qsub does
+func checkScript(webhookDir string, script string) error {
+	if !path.IsAbs(script) {
+		script = path.Join(webhookDir, script)
+	}
+	fi, err := os.Stat(script)
+	if err != nil {
+		return fmt.Errorf("script '%s' not found", script)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("script '%s' is not a regular file", script)
+	}
+	return nil
+}
+
+// Submit the script of the webhook with its payload from the webhook directory
+func submitScript(homeDir string, req Request, run Runner) (string, error) {
+	webhookDir := path.Join(homeDir, WebhooksWorkDir, req.WebhookID)
+
+	// Grab the path to the user script
+	script, err := resolveScript(homeDir, req.WebhookID)
+	if err != nil {
+		return "", err
+	}
+
+	args, err := QsubArgs(req.QsubOptions)
+	if err != nil {
+		return "", err
+	}
+	// Servers that do not name the payload file write the single payload file of the webhook
+	payload := req.Payload
+	if payload == "" {
+		payload = PayLoadName
+	}
+	args = append(args, "-F", path.Join(webhookDir, payload), script)
+	output, err := run(webhookDir, "qsub", args...)
+	if err != nil {
+		return "", fmt.Errorf("qsub failed: %s %s", err, strings.TrimSpace(string(output)))
+	}
+
+	jobID := ParseQsubOutput(output)
+	if jobID == "" {
+		return "", fmt.Errorf("qsub returned no job id: %s", strings.TrimSpace(string(output)))
+	}
+	return jobID, nil
+}
+
+// ParseQsubOutput obtains the job id from the output of the qsub command (i.e. the last non-empty line)
+func ParseQsubOutput(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	jobID := strings.TrimSpace(lines[len(lines)-1])
+	if !validJobIDRegex.MatchString(jobID) {
+		return ""
+	}
+	return jobID
+}
+
+// ParseQstatOutput checks from the output of the qstat command whether the job is still queued or running
+func ParseQstatOutput(output []byte, jobID string) bool {
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(jobID, strings.TrimSuffix(fields[0], "*")) {
+			continue
+		}
+		// The state column is the fifth one; completed jobs are marked with C
+		return fields[4] != "C"
+	}
+	return false
+}
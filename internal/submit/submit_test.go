@@ -0,0 +1,295 @@
+package submit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	deliveryID := "660e8400-e29b-41d4-a716-446655440002"
+
+	cases := []struct {
+		req            Request
+		expectedResult bool
+	}{
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, QsubOptions: "-l walltime=00:10:00"},
+			expectedResult: true, // Valid submission
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: "../../etc", DeliveryID: deliveryID},
+			expectedResult: false, // Invalid webhook id
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, QsubOptions: "-l walltime=1; rm -rf ~"},
+			expectedResult: false, // Invalid qsub options
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, Payload: PayloadName(deliveryID)},
+			expectedResult: true, // Payload file of the delivery
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, Payload: "../../.bashrc"},
+			expectedResult: false, // Payload file outside the webhook directory
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, Payload: PayloadName("770e8400-e29b-41d4-a716-446655440003")},
+			expectedResult: false, // Payload file of another delivery
+		},
+		{
+			req:            Request{Action: ActionSubmit, WebhookID: webhookID},
+			expectedResult: false, // Missing delivery id
+		},
+		{
+			req:            Request{Action: ActionStatus, DeliveryID: deliveryID, JobID: "34986226.dccn-l029.dccn.nl"},
+			expectedResult: true, // Valid status request
+		},
+		{
+			req:            Request{Action: ActionCancel, DeliveryID: deliveryID, JobID: "34986226 && ls"},
+			expectedResult: false, // Invalid job id
+		},
+		{
+			req:            Request{Action: "bash", DeliveryID: deliveryID},
+			expectedResult: false, // Invalid action
+		},
+	}
+
+	for _, c := range cases {
+		err := Validate(c.req)
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Expected valid %t for request %+v, but got error '%v'", c.expectedResult, c.req, err)
+		}
+	}
+}
+
+func TestQsubArgs(t *testing.T) {
+	cases := []struct {
+		qsubOptions    string
+		expectedResult bool
+	}{
+		{"", true},
+		{"-l walltime=00:10:00,mem=1gb -q short -N build_docs -m ae", true},
+		{"-l nodes=1:ppn=4", true},
+		{"-o /home/dccnuser/.bashrc", false},                // Output file
+		{"-e /home/dccnuser/.profile", false},               // Error file
+		{"-S /home/dccnuser/interpreter", false},            // Interpreter
+		{"-v LD_PRELOAD=/tmp/lib.so", false},                // Environment variables
+		{"-W depend=afterok:1234", false},                   // Additional attributes
+		{"-I", false},                                       // Interactive job
+		{"-l", false},                                       // Missing value
+		{"-lwalltime=00:10:00", false},                      // Value joined to the option
+		{"-q short -o /home/dccnuser/.bashrc", false},       // Refused option after an allowed one
+		{"-N -o", false},                                    // Option as value
+		{"-l walltime=00:10:00 /home/dccnuser/x.sh", false}, // Extra argument
+		{"-l walltime=00:10:00,mem=1gb;rm", false},          // Invalid resource
+	}
+
+	for _, c := range cases {
+		_, err := QsubArgs(c.qsubOptions)
+		if (err == nil) != c.expectedResult {
+			t.Errorf("Expected valid %t for qsub options '%s', but got error '%v'", c.expectedResult, c.qsubOptions, err)
+		}
+	}
+}
+
+func TestHandleSubmit(t *testing.T) {
+	homeDir := path.Join("..", "..", "test", "results", "submit", "home")
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	deliveryID := "660e8400-e29b-41d4-a716-446655440002"
+	webhookDir := path.Join(homeDir, WebhooksWorkDir, webhookID)
+
+	err := os.MkdirAll(webhookDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path.Join("..", "..", "test", "results", "submit"))
+
+	err = ioutil.WriteFile(path.Join(webhookDir, ScriptName), []byte("/home/dccnuser/test.sh"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dir string
+	var command []string
+	run := func(d string, name string, args ...string) ([]byte, error) {
+		dir = d
+		command = append([]string{name}, args...)
+		return []byte("34986226.dccn-l029.dccn.nl\n"), nil
+	}
+
+	rsp := Handle(homeDir, Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID, QsubOptions: "-l walltime=00:10:00", Payload: PayloadName(deliveryID)}, run)
+	if rsp.Error != "" || rsp.JobID != "34986226.dccn-l029.dccn.nl" || rsp.DeliveryID != deliveryID {
+		t.Errorf("Expected job 34986226.dccn-l029.dccn.nl for delivery %s, but got %+v", deliveryID, rsp)
+	}
+
+	// The options are passed as separate arguments, never through a shell
+	expectedCommand := []string{"qsub", "-l", "walltime=00:10:00", "-F", path.Join(webhookDir, PayLoadName+"-"+deliveryID), "/home/dccnuser/test.sh"}
+	if !reflect.DeepEqual(command, expectedCommand) {
+		t.Errorf("Expected command %q, but got %q", expectedCommand, command)
+	}
+	if dir != webhookDir {
+		t.Errorf("Expected the command to run in '%s', but got '%s'", webhookDir, dir)
+	}
+
+	// Servers that do not name the payload file submit the single payload file of the webhook
+	rsp = Handle(homeDir, Request{Action: ActionSubmit, WebhookID: webhookID, DeliveryID: deliveryID}, run)
+	if rsp.Error != "" || command[len(command)-2] != path.Join(webhookDir, PayLoadName) {
+		t.Errorf("Expected the payload file of the webhook, but got %q and error '%s'", command, rsp.Error)
+	}
+
+	// Unknown webhooks are refused
+	rsp = Handle(homeDir, Request{Action: ActionSubmit, WebhookID: "770e8400-e29b-41d4-a716-446655440003", DeliveryID: deliveryID}, run)
+	if rsp.Error == "" {
+		t.Errorf("Expected an error for an unknown webhook, but got %+v", rsp)
+	}
+}
+
+func TestHandleCheck(t *testing.T) {
+	homeDir := path.Join("..", "..", "test", "results", "submit", "home")
+	webhookID := "550e8400-e29b-41d4-a716-446655440001"
+	deliveryID := "660e8400-e29b-41d4-a716-446655440002"
+	webhookDir := path.Join(homeDir, WebhooksWorkDir, webhookID)
+
+	err := os.MkdirAll(webhookDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := filepath.Abs(path.Join(homeDir, "test.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path.Join("..", "..", "test", "results", "submit"))
+
+	err = ioutil.WriteFile(path.Join(webhookDir, ScriptName), []byte(script+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is run by a check
+	run := func(d string, name string, args ...string) ([]byte, error) {
+		t.Errorf("Expected no command, but got %s %q", name, args)
+		return nil, errors.New("not allowed")
+	}
+	req := Request{Action: ActionCheck, WebhookID: webhookID, DeliveryID: deliveryID}
+
+	// The pointer is resolved, but the script does not exist
+	rsp := Handle(homeDir, req, run)
+	if rsp.Error == "" || rsp.Script != script {
+		t.Errorf("Expected script %s not to be found, but got %+v", script, rsp)
+	}
+
+	err = ioutil.WriteFile(script, []byte("#!/bin/bash\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp = Handle(homeDir, req, run)
+	if rsp.Error != "" || rsp.Script != script {
+		t.Errorf("Expected script %s to be found, but got %+v", script, rsp)
+	}
+
+	// Unknown webhooks have no script
+	req.WebhookID = "770e8400-e29b-41d4-a716-446655440003"
+	rsp = Handle(homeDir, req, run)
+	if rsp.Error == "" || rsp.Script != "" {
+		t.Errorf("Expected an error for an unknown webhook, but got %+v", rsp)
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	deliveryID := "660e8400-e29b-41d4-a716-446655440002"
+	jobID := "34986226.dccn-l029.dccn.nl"
+	header := "Job ID                    Name             User            Time Use S Queue\n" +
+		"------------------------- ---------------- --------------- -------- - -----\n"
+
+	run := func(d string, name string, args ...string) ([]byte, error) {
+		return []byte(header + "34986226.dccn-l029          test.sh          dccnuser               0 Q batch\n"), nil
+	}
+	rsp := Handle("", Request{Action: ActionStatus, DeliveryID: deliveryID, JobID: jobID}, run)
+	if !rsp.Active {
+		t.Errorf("Expected job %s to be active, but got %+v", jobID, rsp)
+	}
+
+	// Jobs unknown to the scheduler are not active
+	run = func(d string, name string, args ...string) ([]byte, error) {
+		return []byte("qstat: Unknown Job Id " + jobID + "\n"), errors.New("exit status 153")
+	}
+	rsp = Handle("", Request{Action: ActionStatus, DeliveryID: deliveryID, JobID: jobID}, run)
+	if rsp.Active || rsp.Error != "" {
+		t.Errorf("Expected job %s to be inactive, but got %+v", jobID, rsp)
+	}
+}
+
+func TestParseQsubOutput(t *testing.T) {
+	cases := []struct {
+		output        string
+		expectedJobID string
+	}{
+		{
+			output:        "34986226.dccn-l029.dccn.nl\n",
+			expectedJobID: "34986226.dccn-l029.dccn.nl",
+		},
+		{
+			output:        "Welcome to the DCCN cluster\n\n34986226.dccn-l029.dccn.nl\n",
+			expectedJobID: "34986226.dccn-l029.dccn.nl", // Login messages are ignored
+		},
+		{
+			output:        "qsub: script file 'test.sh' cannot be loaded - No such file or directory\n",
+			expectedJobID: "", // No job id
+		},
+		{
+			output:        "",
+			expectedJobID: "", // No output at all
+		},
+	}
+
+	for _, c := range cases {
+		jobID := ParseQsubOutput([]byte(c.output))
+		if jobID != c.expectedJobID {
+			t.Errorf("Expected job id '%s', but got '%s'", c.expectedJobID, jobID)
+		}
+	}
+}
+
+func TestParseQstatOutput(t *testing.T) {
+	header := "Job ID                    Name             User            Time Use S Queue\n" +
+		"------------------------- ---------------- --------------- -------- - -----\n"
+	cases := []struct {
+		output         string
+		jobID          string
+		expectedActive bool
+	}{
+		{
+			output:         header + "34986226.dccn-l029          test.sh          dccnuser               0 Q batch\n",
+			jobID:          "34986226.dccn-l029.dccn.nl",
+			expectedActive: true, // Queued
+		},
+		{
+			output:         header + "34986226.dccn-l029          test.sh          dccnuser        00:00:01 R batch\n",
+			jobID:          "34986226.dccn-l029.dccn.nl",
+			expectedActive: true, // Running
+		},
+		{
+			output:         header + "34986226.dccn-l029          test.sh          dccnuser        00:00:01 C batch\n",
+			jobID:          "34986226.dccn-l029.dccn.nl",
+			expectedActive: false, // Completed
+		},
+		{
+			output:         "qstat: Unknown Job Id 34986226.dccn-l029.dccn.nl\n",
+			jobID:          "34986226.dccn-l029.dccn.nl",
+			expectedActive: false, // Unknown job
+		},
+	}
+
+	for _, c := range cases {
+		active := ParseQstatOutput([]byte(c.output), c.jobID)
+		if active != c.expectedActive {
+			t.Errorf("Expected active %t for output '%s', but got %t", c.expectedActive, c.output, active)
+		}
+	}
+}
@@ -14,8 +14,9 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -32,6 +33,11 @@ type WebhookConfigInfo struct {
 	CreationTime string
 	Script       string
 	WebhookURL   string
+	Enabled      bool
+	ExpiryTime   string
+
+	LastTriggerTime string // only set by List
+	Local           bool   // the webhook has a working directory in the user's home directory
 }
 
 // TriggerWebhook makes a POST call to the WebhookURL with the given payload in byte array.
@@ -87,21 +93,25 @@ type WebhookConfig struct {
 	HPCWebhookCertFile string
 }
 
+// WebhookConfigUpdate contains the changes to be made to a webhook.
+// Fields that are nil are left unchanged.
+type WebhookConfigUpdate struct {
+	Script          *string
+	Description     *string
+	Events          *string
+	QsubOptions     *string
+	CoalesceSeconds *int
+	Concurrency     *string
+}
+
 // New provisions a new WebhookConfig for HPC webhook and registry the new webhook at the HPC webhook server.
 func (s *WebhookConfig) New(script string, desc string) (*url.URL, error) {
 
 	// check existence of the script and its type.
-	scriptAbs, err := filepath.Abs(script)
+	scriptAbs, err := scriptPath(script)
 	if err != nil {
 		return nil, err
 	}
-	fi, err := os.Lstat(scriptAbs)
-	if err != nil {
-		return nil, err
-	}
-	if !fi.Mode().IsRegular() {
-		return nil, fmt.Errorf("not a regular file: %s", script)
-	}
 
 	// get current user
 	cuser, err := user.Current()
@@ -117,12 +127,7 @@ func (s *WebhookConfig) New(script string, desc string) (*url.URL, error) {
 
 	// provision necessary directory
 	// - write path to the script file
-	f, err := os.Create(path.Join(workdir, server.ScriptName))
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	if _, err := f.WriteString(fmt.Sprintf("%s\n", scriptAbs)); err != nil {
+	if err := writeScriptPointer(workdir, scriptAbs); err != nil {
 		return nil, err
 	}
 
@@ -163,61 +168,208 @@ func (s *WebhookConfig) New(script string, desc string) (*url.URL, error) {
 	return webhookURL, nil
 }
 
-// List retrieves a list of webhooks of the current user.
-// The information of webhooks is returned with a channel.
-func (s *WebhookConfig) List() (chan WebhookConfigInfo, error) {
+// WebhookListOptions selects and orders the webhooks returned by List.
+type WebhookListOptions struct {
+	Sort        string // server.ListSortCreated (default) or server.ListSortLastTriggered
+	Description string // only the webhooks of which the description contains this text, case-insensitive
+	Enabled     *bool  // only the enabled or disabled webhooks
+	Provider    string // only the webhooks with deliveries from this sender, e.g. github
+	PageSize    int    // number of webhooks fetched per request, the default of the server when 0
+}
+
+// WebhookIterator walks through the webhooks of the current user, fetching them from the HPC webhook server page by page.
+//
+//	it := s.List(WebhookListOptions{})
+//	for it.Next() {
+//		fmt.Println(it.Webhook().ID)
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//	orphans := it.LocalOnly()
+type WebhookIterator struct {
+	config  *WebhookConfig
+	options WebhookListOptions
+	homeDir string
+	request *server.ConfigurationRequest
+	page    []server.Item
+	cursor  string
+	last    bool // the current page is the last one
+	current WebhookConfigInfo
+	err     error
+
+	unlisted map[string]bool // local working directories of which the webhook has not been listed yet
+}
+
+// List retrieves the webhooks of the current user registered at the HPC webhook server.
+// The webhooks are returned by an iterator, which fetches the next page when needed.
+//
+// The server is the source of truth: webhooks registered from another machine, or of which the working directory
+// has been removed, are listed without being `Local`. The working directories of webhooks that are not registered
+// at the server are reported by LocalOnly once all webhooks have been listed.
+func (s *WebhookConfig) List(options WebhookListOptions) *WebhookIterator {
+	return &WebhookIterator{config: s, options: options}
+}
 
-	// channel for webhook ids found in local webhooks directory.
-	chanWebhookID := make(chan string)
+// Next advances to the next webhook, and returns false when there are no more webhooks or an error occurred.
+func (it *WebhookIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.last {
+			return false
+		}
+		it.err = it.fetch()
+	}
+	it.current = newWebhookConfigInfo(it.homeDir, it.page[0])
+	delete(it.unlisted, it.current.ID)
+	it.page = it.page[1:]
+	return true
+}
 
-	// channel for webhook information found in the remote HPC webhook server.
-	chanWebhookConfigInfo := make(chan WebhookConfigInfo)
+// LocalOnly returns the ids of the working directories in the user's home directory
+// of which the webhook is not registered at the HPC webhook server, so that they can be cleaned up.
+//
+// The result is only known when all webhooks have been listed without error, and without filters on the listing;
+// otherwise nil is returned.
+func (it *WebhookIterator) LocalOnly() []string {
+	filtered := it.options.Description != "" || it.options.Enabled != nil || it.options.Provider != ""
+	if it.err != nil || !it.last || len(it.page) > 0 || filtered {
+		return nil
+	}
+	ids := []string{}
+	for id := range it.unlisted {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
 
-	wg := new(sync.WaitGroup)
-	nworkers := 4
-	wg.Add(nworkers)
+// Webhook returns the information of the current webhook.
+func (it *WebhookIterator) Webhook() WebhookConfigInfo {
+	return it.current
+}
 
-	for i := 0; i < nworkers; i++ {
-		go func() {
-			for id := range chanWebhookID {
-				info, err := s.GetInfo(id)
-				if err != nil {
-					// only show error message in debug mode
-					log.Debugln(err)
-				} else {
-					chanWebhookConfigInfo <- info
-				}
-			}
-			wg.Done()
-		}()
-	}
-
-	// go routine feeding webhook ids to chanWebhookID, and wait for all local webhook ids are visited to get webhookInfo
-	go func() {
-		// perform ID fetching from user's home directory only when the current user can be determined.
-		if cuser, err := user.Current(); err == nil {
-			// add names of the items under $HOME/.gass into the list if:
-			//
-			// - the item is a directory
-			// - the name of the item can be passed by uuid.Parse() function
-			if items, err := ioutil.ReadDir(path.Join(cuser.HomeDir, server.WebhooksWorkDir)); err == nil {
-				for _, f := range items {
-					if !f.IsDir() {
-						continue
-					}
-					if _, err := uuid.Parse(f.Name()); err == nil {
-						chanWebhookID <- f.Name()
-					}
-				}
-			}
+// Err returns the error that stopped the iteration, if any.
+func (it *WebhookIterator) Err() error {
+	return it.err
+}
+
+// fetch makes GET call to the server for the next page of webhooks.
+func (it *WebhookIterator) fetch() error {
+
+	if it.request == nil {
+		cuser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		cgroup, err := user.LookupGroupId(cuser.Gid)
+		if err != nil {
+			return err
+		}
+		it.homeDir = cuser.HomeDir
+		it.request = &server.ConfigurationRequest{
+			Groupname: cgroup.Name,
+			Username:  cuser.Username,
+		}
+		if it.unlisted, err = localWebhookIDs(cuser.HomeDir); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{}
+	if it.options.Sort != "" {
+		query.Set("sort", it.options.Sort)
+	}
+	if it.options.Description != "" {
+		query.Set("description", it.options.Description)
+	}
+	if it.options.Enabled != nil {
+		query.Set("enabled", fmt.Sprintf("%t", *it.options.Enabled))
+	}
+	if it.options.Provider != "" {
+		query.Set("provider", it.options.Provider)
+	}
+	if it.options.PageSize > 0 {
+		query.Set("limit", fmt.Sprintf("%d", it.options.PageSize))
+	}
+	if it.cursor != "" {
+		query.Set("cursor", it.cursor)
+	}
+
+	myURL := url.URL{
+		Scheme:   "https",
+		Host:     fmt.Sprintf("%s:%d", it.config.HPCWebhookHost, it.config.HPCWebhookPort),
+		Path:     server.ConfigurationListPath,
+		RawQuery: query.Encode(),
+	}
+	var response server.ConfigurationListResponse
+
+	httpCode, err := httpGetJSON(&myURL, it.config.HPCWebhookCertFile, it.request, &response)
+
+	log.Debugf("response data: %+v", response)
+
+	if err != nil {
+		return fmt.Errorf("error listing webhooks on the HPC webhook server: %+v (HTTP CODE: %d)", err, httpCode)
+	}
+
+	it.page = response.Webhooks
+	it.cursor = response.NextCursor
+	it.last = response.NextCursor == ""
+	return nil
+}
+
+// localWebhookIDs returns the ids of the webhook working directories in the user's home directory.
+//
+// These are the items under $HOME/.webhook that are directories, and of which the name can be parsed by uuid.Parse().
+func localWebhookIDs(homeDir string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	items, err := ioutil.ReadDir(path.Join(homeDir, server.WebhooksWorkDir))
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range items {
+		if !f.IsDir() {
+			continue
 		}
-		close(chanWebhookID)
+		if _, err := uuid.Parse(f.Name()); err == nil {
+			ids[f.Name()] = true
+		}
+	}
+	return ids, nil
+}
 
-		wg.Wait()
-		close(chanWebhookConfigInfo)
-	}()
+// newWebhookConfigInfo converts a webhook registered at the server into its information,
+// with the script from the webhook's working directory in the user's home directory.
+func newWebhookConfigInfo(homeDir string, item server.Item) WebhookConfigInfo {
+	info := WebhookConfigInfo{
+		ID:              item.Hash,
+		Description:     item.Description,
+		CreationTime:    item.Created,
+		WebhookURL:      item.URL,
+		Enabled:         item.Enabled,
+		ExpiryTime:      item.Expires,
+		LastTriggerTime: item.LastTriggered,
+	}
+
+	// the webhook may have been registered from another machine, or its working directory may have been removed
+	workdir := path.Join(homeDir, server.WebhooksWorkDir, item.Hash)
+	if w, err := os.Stat(workdir); err != nil || !w.IsDir() {
+		log.Debugf("no working directory for webhook: %s\n", item.Hash)
+		return info
+	}
+	info.Local = true
 
-	return chanWebhookConfigInfo, nil
+	// read local script from the webhook's working directory
+	if script, err := ioutil.ReadFile(path.Join(workdir, server.ScriptName)); err != nil {
+		log.Errorf("cannot locate script of webhook: %s\n", item.Hash)
+	} else {
+		// remove tailing "\n"
+		info.Script = strings.TrimSuffix(string(script), "\n")
+	}
+
+	return info
 }
 
 // GetInfo retrieves information of a single Webhook configuration referred by the hash id.
@@ -265,25 +417,14 @@ func (s *WebhookConfig) GetInfo(id string) (WebhookConfigInfo, error) {
 		return info, fmt.Errorf("expect webhook id: %s, server returns id: %s", id, response.Webhook.Hash)
 	}
 
-	info.Description = response.Webhook.Description
-	info.CreationTime = response.Webhook.Created
-	info.WebhookURL = response.Webhook.URL
-
-	// read local script from the webhook's working directory
-	if script, err := ioutil.ReadFile(path.Join(cuser.HomeDir, server.WebhooksWorkDir, id, server.ScriptName)); err != nil {
-		log.Errorf("cannot locate script of webhook: %s\n", id)
-	} else {
-		// remove tailing "\n"
-		info.Script = strings.TrimSuffix(string(script), "\n")
-	}
-
-	return info, nil
+	return newWebhookConfigInfo(cuser.HomeDir, response.Webhook), nil
 }
 
 // Delete removes a webhook with the given id.
 //
 // The deletion maily removes webhook registry from HPC webhook server.
 // If removeDir is true, the local webhook working directory is removed when the webhook is unregistered from the HPC webhook server.
+// A webhook without a local working directory, e.g. registered from another machine, is only unregistered.
 func (s *WebhookConfig) Delete(id string, removeDir bool) error {
 
 	// check if there is a webhook directory in user's webhooks directory.
@@ -294,10 +435,10 @@ func (s *WebhookConfig) Delete(id string, removeDir bool) error {
 	workdir := path.Join(cuser.HomeDir, server.WebhooksWorkDir, id)
 
 	w, err := os.Lstat(workdir)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if !w.IsDir() {
+	if err == nil && !w.IsDir() {
 		return fmt.Errorf("not a directory: %s", workdir)
 	}
 
@@ -340,6 +481,346 @@ func (s *WebhookConfig) Delete(id string, removeDir bool) error {
 	return nil
 }
 
+// Update changes the description, filters and scheduler options of a webhook with the given id in place,
+// so that its webhook URL remains the same.
+//
+// If a new script is given, the local pointer file `~/.webhook/<id>/script` is rewritten once the server has accepted the update.
+func (s *WebhookConfig) Update(id string, update WebhookConfigUpdate) error {
+
+	// check existence of the new script and its type.
+	var scriptAbs string
+	if update.Script != nil {
+		var err error
+		if scriptAbs, err = scriptPath(*update.Script); err != nil {
+			return err
+		}
+	}
+
+	cuser, err := user.Current()
+	if err != nil {
+		return err
+	}
+	workdir := path.Join(cuser.HomeDir, server.WebhooksWorkDir, id)
+
+	w, err := os.Lstat(workdir)
+	if err != nil {
+		return err
+	}
+	if !w.IsDir() {
+		return fmt.Errorf("not a directory: %s", workdir)
+	}
+
+	// make PATCH call to the server when there are changes to the registry.
+	if update.Description != nil || update.Events != nil || update.QsubOptions != nil || update.CoalesceSeconds != nil || update.Concurrency != nil {
+		cgroup, err := user.LookupGroupId(cuser.Gid)
+		if err != nil {
+			return err
+		}
+
+		myURL := url.URL{
+			Scheme: "https",
+			Host:   fmt.Sprintf("%s:%d", s.HPCWebhookHost, s.HPCWebhookPort),
+			Path:   path.Join(server.ConfigurationPath, id),
+		}
+		var response server.ConfigurationUpdateResponse
+
+		httpCode, err := httpPatchJSON(
+			&myURL,
+			s.HPCWebhookCertFile,
+			&server.ConfigurationUpdateRequest{
+				Hash:            id,
+				Groupname:       cgroup.Name,
+				Username:        cuser.Username,
+				Description:     update.Description,
+				Events:          update.Events,
+				QsubOptions:     update.QsubOptions,
+				CoalesceSeconds: update.CoalesceSeconds,
+				Concurrency:     update.Concurrency,
+			},
+			&response)
+
+		log.Debugf("response data: %+v", response)
+
+		if err != nil {
+			return fmt.Errorf("fail to update webhook %s: %+v (HTTP CODE: %d)", id, err, httpCode)
+		}
+	}
+
+	// rewrite the path to the script file
+	if update.Script != nil {
+		return writeScriptPointer(workdir, scriptAbs)
+	}
+
+	return nil
+}
+
+// Disable pauses a webhook with the given id without deleting it.
+//
+// Deliveries to a disabled webhook are refused by the HPC webhook server.
+func (s *WebhookConfig) Disable(id string) error {
+	return s.setEnabled(id, false)
+}
+
+// Enable resumes a webhook with the given id that has been disabled.
+func (s *WebhookConfig) Enable(id string) error {
+	return s.setEnabled(id, true)
+}
+
+// setEnabled makes PATCH call to the server to enable or disable the webhook.
+func (s *WebhookConfig) setEnabled(id string, enabled bool) error {
+
+	cuser, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	cgroup, err := user.LookupGroupId(cuser.Gid)
+	if err != nil {
+		return err
+	}
+
+	myURL := url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s:%d", s.HPCWebhookHost, s.HPCWebhookPort),
+		Path:   path.Join(server.ConfigurationPath, id),
+	}
+	var response server.ConfigurationUpdateResponse
+
+	httpCode, err := httpPatchJSON(
+		&myURL,
+		s.HPCWebhookCertFile,
+		&server.ConfigurationUpdateRequest{
+			Hash:      id,
+			Groupname: cgroup.Name,
+			Username:  cuser.Username,
+			Enabled:   &enabled,
+		},
+		&response)
+
+	log.Debugf("response data: %+v", response)
+
+	if err != nil {
+		return fmt.Errorf("fail to update webhook %s: %+v (HTTP CODE: %d)", id, err, httpCode)
+	}
+
+	return nil
+}
+
+// Rotate issues a new payload URL for a webhook with the given id, and returns it.
+//
+// The previous payload URL keeps working for a grace period configured on the HPC webhook server.
+func (s *WebhookConfig) Rotate(id string) (*url.URL, error) {
+
+	cuser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	cgroup, err := user.LookupGroupId(cuser.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	myURL := url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s:%d", s.HPCWebhookHost, s.HPCWebhookPort),
+		Path:   path.Join(server.ConfigurationPath, id, "rotate"),
+	}
+	var response server.ConfigurationRotateResponse
+
+	httpCode, err := httpPostJSON(
+		&myURL,
+		s.HPCWebhookCertFile,
+		&server.ConfigurationRequest{
+			Hash:      id,
+			Groupname: cgroup.Name,
+			Username:  cuser.Username,
+		},
+		&response)
+
+	log.Debugf("response data: %+v", response)
+
+	if err != nil {
+		return nil, fmt.Errorf("fail to rotate webhook %s: %+v (HTTP CODE: %d)", id, err, httpCode)
+	}
+
+	webhookURL, err := url.Parse(response.Webhook.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhookURL, nil
+}
+
+// Test checks that a webhook with the given id would be submitted correctly, without submitting it.
+//
+// The HPC webhook server performs every step of the execution of the script up to the submission: it authenticates
+// as the user on the relay node, resolves the script pointer, checks that the script exists, and places a payload
+// in the webhook's working directory. The result of each step is returned; the test stops at the first step that fails.
+func (s *WebhookConfig) Test(id string) (server.ConfigurationTestResponse, error) {
+
+	var response server.ConfigurationTestResponse
+
+	cuser, err := user.Current()
+	if err != nil {
+		return response, err
+	}
+
+	cgroup, err := user.LookupGroupId(cuser.Gid)
+	if err != nil {
+		return response, err
+	}
+
+	myURL := url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s:%d", s.HPCWebhookHost, s.HPCWebhookPort),
+		Path:   path.Join(server.ConfigurationPath, id, "test"),
+	}
+
+	httpCode, err := httpPostJSON(
+		&myURL,
+		s.HPCWebhookCertFile,
+		&server.ConfigurationRequest{
+			Hash:      id,
+			Groupname: cgroup.Name,
+			Username:  cuser.Username,
+		},
+		&response)
+
+	log.Debugf("response data: %+v", response)
+
+	if err != nil {
+		return response, fmt.Errorf("fail to test webhook %s: %+v (HTTP CODE: %d)", id, err, httpCode)
+	}
+
+	return response, nil
+}
+
+// Doctor checks the webhooks of the current user for registrations that drifted from the user's home directory,
+// and repairs the problems if repair is true.
+//
+// The HPC webhook server checks the working directories and script pointers, the server key in `authorized_keys`,
+// and the ownership of the files it writes. The client adds the checks that need the user's view of the cluster:
+// whether the scripts still exist, and whether the working directories belong to a registered webhook.
+// The repair removes the working directories of webhooks that are not registered. A missing script cannot be
+// repaired; use Update with a new script instead.
+func (s *WebhookConfig) Doctor(repair bool) (server.DoctorReport, error) {
+
+	cuser, err := user.Current()
+	if err != nil {
+		return server.DoctorReport{}, err
+	}
+
+	cgroup, err := user.LookupGroupId(cuser.Gid)
+	if err != nil {
+		return server.DoctorReport{}, err
+	}
+
+	myURL := url.URL{
+		Scheme:   "https",
+		Host:     fmt.Sprintf("%s:%d", s.HPCWebhookHost, s.HPCWebhookPort),
+		Path:     server.ConfigurationDoctorPath,
+		RawQuery: url.Values{"repair": {strconv.FormatBool(repair)}}.Encode(),
+	}
+	var report server.DoctorReport
+
+	httpCode, err := httpPostJSON(
+		&myURL,
+		s.HPCWebhookCertFile,
+		&server.ConfigurationRequest{
+			Groupname: cgroup.Name,
+			Username:  cuser.Username,
+		},
+		&report)
+
+	log.Debugf("response data: %+v", report)
+
+	if err != nil {
+		return report, fmt.Errorf("fail to check webhooks: %+v (HTTP CODE: %d)", err, httpCode)
+	}
+
+	local, err := localWebhookIDs(cuser.HomeDir)
+	if err != nil {
+		return report, err
+	}
+
+	// the scripts of the registered webhooks; missing script pointers are reported by the server
+	for _, id := range report.Webhooks {
+		delete(local, id)
+		pointer, err := ioutil.ReadFile(path.Join(cuser.HomeDir, server.WebhooksWorkDir, id, server.ScriptName))
+		script := strings.TrimSpace(string(pointer))
+		if err != nil || script == "" {
+			continue
+		}
+		if _, err := scriptPath(script); err != nil {
+			problem := server.DoctorProblem{
+				Webhook: id,
+				Check:   server.DoctorCheckScript,
+				Path:    script,
+				Problem: err.Error(),
+			}
+			if repair {
+				problem.Error = "update the webhook with a new script"
+			}
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+
+	// the working directories of webhooks that are not registered at the server
+	ids := []string{}
+	for id := range local {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		problem := server.DoctorProblem{
+			Webhook: id,
+			Check:   server.DoctorCheckRegistration,
+			Path:    path.Join(server.WebhooksWorkDir, id),
+			Problem: "webhook is not registered at the HPC webhook server",
+		}
+		if repair {
+			if err := os.RemoveAll(path.Join(cuser.HomeDir, server.WebhooksWorkDir, id)); err != nil {
+				problem.Error = err.Error()
+			} else {
+				problem.Repaired = true
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	return report, nil
+}
+
+// scriptPath checks the existence of the script and its type, and returns its absolute path.
+func scriptPath(script string) (string, error) {
+	scriptAbs, err := filepath.Abs(script)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(scriptAbs)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("not a regular file: %s", script)
+	}
+	return scriptAbs, nil
+}
+
+// writeScriptPointer writes the path to the script into the webhook's working directory.
+func writeScriptPointer(workdir string, scriptAbs string) error {
+	f, err := os.Create(path.Join(workdir, server.ScriptName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(fmt.Sprintf("%s\n", scriptAbs)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // httpPutJSON makes a HTTP PUT request with provided JSON data.
 func httpPutJSON(url *url.URL, cacert string, request interface{}, response interface{}) (int, error) {
 
@@ -372,6 +853,70 @@ func httpPutJSON(url *url.URL, cacert string, request interface{}, response inte
 	return rsp.StatusCode, json.NewDecoder(rsp.Body).Decode(response)
 }
 
+// httpPostJSON makes a HTTP POST request with provided JSON data.
+func httpPostJSON(url *url.URL, cacert string, request interface{}, response interface{}) (int, error) {
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("request data: %s", string(data))
+
+	c := httpsClient(cacert)
+	req, err := http.NewRequest("POST", url.String(), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("content-type", "application/json")
+
+	// make HTTP POST call
+	rsp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		return rsp.StatusCode, fmt.Errorf("%s", rsp.Status)
+	}
+
+	return rsp.StatusCode, json.NewDecoder(rsp.Body).Decode(response)
+}
+
+// httpPatchJSON makes a HTTP PATCH request with provided JSON data.
+func httpPatchJSON(url *url.URL, cacert string, request interface{}, response interface{}) (int, error) {
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("request data: %s", string(data))
+
+	c := httpsClient(cacert)
+	req, err := http.NewRequest("PATCH", url.String(), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("content-type", "application/json")
+
+	// make HTTP PATCH call
+	rsp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		return rsp.StatusCode, fmt.Errorf("%s", rsp.Status)
+	}
+
+	return rsp.StatusCode, json.NewDecoder(rsp.Body).Decode(response)
+}
+
 // httpGetJSON makes a HTTP GET request to the given url and returns unmarshals JSON response.
 func httpGetJSON(url *url.URL, cacert string, request interface{}, response interface{}) (int, error) {
 
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"testing"
 
+	"github.com/Donders-Institute/hpc-webhook/internal/server"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -39,12 +43,78 @@ func TestListWebhook(t *testing.T) {
 		HPCWebhookCertFile: path.Join(os.Getenv("GOPATH"), "src/github.com/Donders-Institute/hpc-webhook/test/cert/TestServer.crt"),
 	}
 
-	chanWebhook, err := c.List()
+	it := c.List(WebhookListOptions{PageSize: 2})
+	for it.Next() {
+		t.Logf("webhook: %+v\n", it.Webhook())
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("test failed: %+v\n", err)
+	}
+	t.Logf("local only: %+v\n", it.LocalOnly())
+}
+
+func TestTestWebhook(t *testing.T) {
+	c := WebhookConfig{
+		HPCWebhookHost:     "localhost",
+		HPCWebhookPort:     443,
+		HPCWebhookCertFile: path.Join(os.Getenv("GOPATH"), "src/github.com/Donders-Institute/hpc-webhook/test/cert/TestServer.crt"),
+	}
+
+	it := c.List(WebhookListOptions{PageSize: 1})
+	if !it.Next() {
+		t.Skipf("no webhook to test: %+v\n", it.Err())
+	}
+	response, err := c.Test(it.Webhook().ID)
 	if err != nil {
 		t.Errorf("test failed: %+v\n", err)
-	} else {
-		for webhook := range chanWebhook {
-			t.Logf("webhook: %+v\n", webhook)
+	}
+	for _, step := range response.Steps {
+		t.Logf("step: %+v\n", step)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	c := WebhookConfig{
+		HPCWebhookHost:     "localhost",
+		HPCWebhookPort:     443,
+		HPCWebhookCertFile: path.Join(os.Getenv("GOPATH"), "src/github.com/Donders-Institute/hpc-webhook/test/cert/TestServer.crt"),
+	}
+
+	report, err := c.Doctor(false)
+	if err != nil {
+		t.Errorf("test failed: %+v\n", err)
+	}
+	for _, problem := range report.Problems {
+		t.Logf("problem: %+v\n", problem)
+	}
+}
+
+func TestLocalWebhookIDs(t *testing.T) {
+	homeDir := path.Join("..", "..", "test", "results", "home", "dccnuser")
+	defer os.RemoveAll(path.Join("..", "..", "test", "results", "home"))
+
+	// no webhooks directory at all
+	ids, err := localWebhookIDs(homeDir)
+	if err != nil || len(ids) != 0 {
+		t.Errorf("expected no webhooks, got %v and error %v", ids, err)
+	}
+
+	workdir := path.Join(homeDir, server.WebhooksWorkDir)
+	for _, name := range []string{"550e8400-e29b-41d4-a716-446655440001", "not-a-webhook"} {
+		if err := os.MkdirAll(path.Join(workdir, name), 0700); err != nil {
+			t.Fatal(err)
 		}
 	}
+	if err := ioutil.WriteFile(path.Join(workdir, "550e8400-e29b-41d4-a716-446655440002"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the directories named after a webhook id
+	ids, err = localWebhookIDs(homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, map[string]bool{"550e8400-e29b-41d4-a716-446655440001": true}) {
+		t.Errorf("unexpected webhook ids: %v", ids)
+	}
 }
@@ -4,4 +4,4 @@ set -e
 
 hpc_webhook_key_dir=../configs/
 
-ssh-keygen -t rsa -C "hpc-webhook-server" -f $hpc_webhook_key_dir/hpc-webhook
\ No newline at end of file
+ssh-keygen -t ed25519 -C "hpc-webhook-server" -f $hpc_webhook_key_dir/hpc-webhook
\ No newline at end of file
@@ -0,0 +1,12 @@
+#!/bin/bash
+set -e
+
+# Fill the test database, after the server has migrated its schema
+PGPASSWORD="$POSTGRES_PASSWORD" psql -v ON_ERROR_STOP=1 --host "${CONTAINER_DATABASE_HOST:-db}" --username "$POSTGRES_USER" --dbname "$POSTGRES_DATABASE" <<-EOSQL
+INSERT INTO hpc_webhook (id, hash, groupname, username, description, created, token)
+VALUES 
+    (1, '9f86d081-884c-4d65-9a2f-eaa0c55ad015', 'dccngroup', 'jonsno', 'Test script', '2019-03-11 10:21:00', 'a3bf4f1b-2b0b-422c-9d15-d6c15b0f00a8'),
+    (2, '1286d081-884c-4d65-9a2f-eaa0c55ad015', 'dccngroup', 'foobar', 'Test script 2', '2019-03-11 11:21:00', 'a3bf4f1b-2b0b-422c-9d15-d6c15b0f00a1'),
+    (3, '2086d081-884c-4d65-9a2f-eaa0c55ad015', 'dccngroup', 'somguy', '', '2019-03-11 12:21:00', 'a3bf4f1b-2b0b-422c-9d15-d6c15b0f00a2'),
+    (4, '2486d081-884c-4d65-9a2f-eaa0c55ad015', 'dccngroup', 'dccnuser', 'Tryout script', '2019-03-11 13:42:00', 'a3bf4f1b-2b0b-422c-9d15-d6c15b0f4242');
+EOSQL
\ No newline at end of file
@@ -0,0 +1,10 @@
+#!/bin/bash
+curl -X POST \
+  http://localhost:5111/configuration/550e8400-e29b-41d4-a716-446655440001/rotate \
+  -H 'Content-Type: application/json' \
+  -H 'cache-control: no-cache' \
+  -d '{
+  "hash": "550e8400-e29b-41d4-a716-446655440001", 
+  "groupname": "dccngroup",
+  "username": "dccnuser"
+}'